@@ -36,25 +36,56 @@ typedef struct hostent {
     char **h_addr_list;
 } HOSTENT;
 
+extern unsigned long __stdcall GetCurrentThreadId(void);
+extern void* __stdcall OpenThread(unsigned long access, int inherit, unsigned long id);
+extern unsigned long __stdcall WaitForSingleObject(void *handle, unsigned long ms);
+extern int __stdcall CloseHandle(void *handle);
+
+static inline unsigned long current_thread_id(void) {
+    return GetCurrentThreadId();
+}
+
+// thread_exited reports whether thread id has exited (or no longer exists).
+static inline int thread_exited(unsigned long id) {
+    void *h = OpenThread(0x00100000, 0, id); // SYNCHRONIZE
+    if (h == 0) {
+        return 1;
+    }
+    int exited = WaitForSingleObject(h, 0) == 0; // WAIT_OBJECT_0
+    CloseHandle(h);
+    return exited;
+}
+
 */
+import "C"
 
 import (
-	"C"
 	"unsafe"
 
 	"klinikal/winsock"
 )
 
+// thread returns the Win32 ID of the calling application thread. Each export
+// that sets or reads the last error captures it once, on entry, and passes it
+// down, so the error lands on the caller's thread whichever goroutine sets it.
+func thread() winsock.Thread {
+	return winsock.Thread(C.current_thread_id())
+}
+
+func init() {
+	winsock.ThreadExited = func(t winsock.Thread) bool { return C.thread_exited(C.ulong(t)) != 0 }
+}
+
 // --- Win32 SOCKET = unsigned int (4 bytes) ---
 
 //export go_accept
 func go_accept(s C.uint, addr unsafe.Pointer, addrlen *C.int) C.uint {
-	return C.uint(winsock.GoAccept(uint64(s), addr, (*int32)(unsafe.Pointer(addrlen))))
+	return C.uint(winsock.GoAccept(thread(), uint64(s), addr, (*int32)(unsafe.Pointer(addrlen))))
 }
 
 //export go_bind
 func go_bind(s C.uint, name unsafe.Pointer, namelen C.int) C.int {
-	return C.int(winsock.GoBind(uint64(s), name, int32(namelen)))
+	return C.int(winsock.GoBind(thread(), uint64(s), name, int32(namelen)))
 }
 
 //export go_closesocket
@@ -64,7 +95,7 @@ func go_closesocket(s C.uint) C.int {
 
 //export go_connect
 func go_connect(s C.uint, name unsafe.Pointer, namelen C.int) C.int {
-	return C.int(winsock.GoConnect(uint64(s), name, int32(namelen)))
+	return C.int(winsock.GoConnect(thread(), uint64(s), name, int32(namelen)))
 }
 
 //export go_freeaddrinfo
@@ -89,12 +120,12 @@ func go_GetAddrInfoW(node *C.ushort, service *C.ushort, hints unsafe.Pointer, re
 
 //export go_gethostbyaddr
 func go_gethostbyaddr(addr *C.char, addrLen C.int, addrType C.int) unsafe.Pointer {
-	return winsock.GoGethostbyaddr((*byte)(unsafe.Pointer(addr)), int32(addrLen), int32(addrType))
+	return winsock.GoGethostbyaddr(thread(), (*byte)(unsafe.Pointer(addr)), int32(addrLen), int32(addrType))
 }
 
 //export go_gethostbyname
 func go_gethostbyname(name *C.char) unsafe.Pointer {
-	return winsock.GoGethostbyname((*byte)(unsafe.Pointer(name)))
+	return winsock.GoGethostbyname(thread(), (*byte)(unsafe.Pointer(name)))
 }
 
 //export go_GetHostNameW
@@ -119,7 +150,7 @@ func go_GetNameInfoW(sa unsafe.Pointer, salen C.int, host *C.ushort, hostlen C.u
 
 //export go_getpeername
 func go_getpeername(s C.uint, name unsafe.Pointer, namelen *C.int) C.int {
-	return C.int(winsock.GoGetpeername(uint64(s), name, (*int32)(unsafe.Pointer(namelen))))
+	return C.int(winsock.GoGetpeername(thread(), uint64(s), name, (*int32)(unsafe.Pointer(namelen))))
 }
 
 //export go_getprotobyname
@@ -144,12 +175,12 @@ func go_getservbyport(port C.int, proto *C.char) unsafe.Pointer {
 
 //export go_getsockname
 func go_getsockname(s C.uint, name unsafe.Pointer, namelen *C.int) C.int {
-	return C.int(winsock.GoGetsockname(uint64(s), name, (*int32)(unsafe.Pointer(namelen))))
+	return C.int(winsock.GoGetsockname(thread(), uint64(s), name, (*int32)(unsafe.Pointer(namelen))))
 }
 
 //export go_getsockopt
 func go_getsockopt(s C.uint, level C.int, optname C.int, optval unsafe.Pointer, optlen *C.int) C.int {
-	return C.int(winsock.GoGetsockopt(uint64(s), int32(level), int32(optname), optval, (*int32)(unsafe.Pointer(optlen))))
+	return C.int(winsock.GoGetsockopt(thread(), uint64(s), int32(level), int32(optname), optval, (*int32)(unsafe.Pointer(optlen))))
 }
 
 //export go_htond
@@ -189,32 +220,32 @@ func go_inet_ntoa(in C.ulong) *C.char {
 
 //export go_inet_pton
 func go_inet_pton(family C.int, src *C.char, dst unsafe.Pointer) C.int {
-	return C.int(winsock.GoInet_pton(int32(family), (*byte)(unsafe.Pointer(src)), dst))
+	return C.int(winsock.GoInet_pton(thread(), int32(family), (*byte)(unsafe.Pointer(src)), dst))
 }
 
 //export go_inet_ntop
 func go_inet_ntop(family C.int, src unsafe.Pointer, dst *C.char, size C.int) *C.char {
-	return (*C.char)(unsafe.Pointer(winsock.GoInet_ntop(int32(family), src, (*byte)(unsafe.Pointer(dst)), int32(size))))
+	return (*C.char)(unsafe.Pointer(winsock.GoInet_ntop(thread(), int32(family), src, (*byte)(unsafe.Pointer(dst)), int32(size))))
 }
 
 //export go_InetPtonW
 func go_InetPtonW(family C.int, src *C.ushort, dst unsafe.Pointer) C.int {
-	return C.int(winsock.GoInetPtonW(int32(family), (*uint16)(unsafe.Pointer(src)), dst))
+	return C.int(winsock.GoInetPtonW(thread(), int32(family), (*uint16)(unsafe.Pointer(src)), dst))
 }
 
 //export go_InetNtopW
 func go_InetNtopW(family C.int, src unsafe.Pointer, dst *C.ushort, size C.int) *C.ushort {
-	return (*C.ushort)(unsafe.Pointer(winsock.GoInetNtopW(int32(family), src, (*uint16)(unsafe.Pointer(dst)), int32(size))))
+	return (*C.ushort)(unsafe.Pointer(winsock.GoInetNtopW(thread(), int32(family), src, (*uint16)(unsafe.Pointer(dst)), int32(size))))
 }
 
 //export go_ioctlsocket
 func go_ioctlsocket(s C.uint, cmd C.int, argp *C.ulong) C.int {
-	return C.int(winsock.GoIoctlsocket(uint64(s), int32(cmd), (*uint32)(unsafe.Pointer(argp))))
+	return C.int(winsock.GoIoctlsocket(thread(), uint64(s), int32(cmd), (*uint32)(unsafe.Pointer(argp))))
 }
 
 //export go_listen
 func go_listen(s C.uint, backlog C.int) C.int {
-	return C.int(winsock.GoListen(uint64(s), int32(backlog)))
+	return C.int(winsock.GoListen(thread(), uint64(s), int32(backlog)))
 }
 
 //export go_ntohd
@@ -244,17 +275,17 @@ func go_ntohs(netshort C.ushort) C.ushort {
 
 //export go_ProcessSocketNotifications
 func go_ProcessSocketNotifications(completionPort unsafe.Pointer, registrationCount C.uint, registrationInfos unsafe.Pointer, timeout C.uint, completionCount C.uint, completionInfos unsafe.Pointer, receivedCount *C.ulong) C.int {
-	return C.int(winsock.GoProcessSocketNotifications(completionPort, uint32(registrationCount), registrationInfos, uint32(timeout), uint32(completionCount), completionInfos, (*uint32)(unsafe.Pointer(receivedCount))))
+	return C.int(winsock.GoProcessSocketNotifications(thread(), completionPort, uint32(registrationCount), registrationInfos, uint32(timeout), uint32(completionCount), completionInfos, (*uint32)(unsafe.Pointer(receivedCount))))
 }
 
 //export go_recv
 func go_recv(s C.uint, buf unsafe.Pointer, len C.int, flags C.int) C.int {
-	return C.int(winsock.GoRecv(uint64(s), buf, int32(len), int32(flags)))
+	return C.int(winsock.GoRecv(thread(), uint64(s), buf, int32(len), int32(flags)))
 }
 
 //export go_recvfrom
 func go_recvfrom(s C.uint, buf unsafe.Pointer, len C.int, flags C.int, from unsafe.Pointer, fromlen *C.int) C.int {
-	return C.int(winsock.GoRecvfrom(uint64(s), buf, int32(len), int32(flags), from, (*int32)(unsafe.Pointer(fromlen))))
+	return C.int(winsock.GoRecvfrom(thread(), uint64(s), buf, int32(len), int32(flags), from, (*int32)(unsafe.Pointer(fromlen))))
 }
 
 //export go_select_
@@ -264,22 +295,22 @@ func go_select_(nfds C.int, readfds unsafe.Pointer, writefds unsafe.Pointer, exc
 
 //export go_send
 func go_send(s C.uint, buf unsafe.Pointer, len C.int, flags C.int) C.int {
-	return C.int(winsock.GoSend(uint64(s), buf, int32(len), int32(flags)))
+	return C.int(winsock.GoSend(thread(), uint64(s), buf, int32(len), int32(flags)))
 }
 
 //export go_sendto
 func go_sendto(s C.uint, buf unsafe.Pointer, len C.int, flags C.int, to unsafe.Pointer, tolen C.int) C.int {
-	return C.int(winsock.GoSendto(uint64(s), buf, int32(len), int32(flags), to, int32(tolen)))
+	return C.int(winsock.GoSendto(thread(), uint64(s), buf, int32(len), int32(flags), to, int32(tolen)))
 }
 
 //export go_setsockopt
 func go_setsockopt(s C.uint, level C.int, optname C.int, optval unsafe.Pointer, optlen C.int) C.int {
-	return C.int(winsock.GoSetsockopt(uint64(s), int32(level), int32(optname), optval, int32(optlen)))
+	return C.int(winsock.GoSetsockopt(thread(), uint64(s), int32(level), int32(optname), optval, int32(optlen)))
 }
 
 //export go_shutdown
 func go_shutdown(s C.uint, how C.int) C.int {
-	return C.int(winsock.GoShutdown(uint64(s), int32(how)))
+	return C.int(winsock.GoShutdown(thread(), uint64(s), int32(how)))
 }
 
 //export go_socket
@@ -289,27 +320,27 @@ func go_socket(af C.int, typ C.int, protocol C.int) C.uint {
 
 //export go_SocketNotificationRetrieveEvents
 func go_SocketNotificationRetrieveEvents(notificationRegistration unsafe.Pointer, notificationEvents unsafe.Pointer) C.int {
-	return C.int(winsock.GoSocketNotificationRetrieveEvents(notificationRegistration, notificationEvents))
+	return C.int(winsock.GoSocketNotificationRetrieveEvents(thread(), notificationRegistration, notificationEvents))
 }
 
 //export go_WSAAccept
 func go_WSAAccept(s C.uint, addr unsafe.Pointer, addrlen *C.int, lpfnCondition unsafe.Pointer, dwCallbackData C.ulong) C.uint {
-	return C.uint(winsock.GoWSAAccept(uint64(s), addr, (*int32)(unsafe.Pointer(addrlen)), lpfnCondition, uint32(dwCallbackData)))
+	return C.uint(winsock.GoWSAAccept(thread(), uint64(s), addr, (*int32)(unsafe.Pointer(addrlen)), lpfnCondition, uint32(dwCallbackData)))
 }
 
 //export go_WSAAddressToStringA
 func go_WSAAddressToStringA(lpsaAddress unsafe.Pointer, dwAddressLength C.ulong, lpProtocolInfo unsafe.Pointer, lpszAddressString *C.char, lpdwAddressStringLength *C.ulong) C.int {
-	return C.int(winsock.GoWSAAddressToStringA(lpsaAddress, uint32(dwAddressLength), lpProtocolInfo, (*byte)(unsafe.Pointer(lpszAddressString)), (*uint32)(unsafe.Pointer(lpdwAddressStringLength))))
+	return C.int(winsock.GoWSAAddressToStringA(thread(), lpsaAddress, uint32(dwAddressLength), lpProtocolInfo, (*byte)(unsafe.Pointer(lpszAddressString)), (*uint32)(unsafe.Pointer(lpdwAddressStringLength))))
 }
 
 //export go_WSAAddressToStringW
 func go_WSAAddressToStringW(lpsaAddress unsafe.Pointer, dwAddressLength C.ulong, lpProtocolInfo unsafe.Pointer, lpszAddressString *C.ushort, lpdwAddressStringLength *C.ulong) C.int {
-	return C.int(winsock.GoWSAAddressToStringW(lpsaAddress, uint32(dwAddressLength), lpProtocolInfo, (*uint16)(unsafe.Pointer(lpszAddressString)), (*uint32)(unsafe.Pointer(lpdwAddressStringLength))))
+	return C.int(winsock.GoWSAAddressToStringW(thread(), lpsaAddress, uint32(dwAddressLength), lpProtocolInfo, (*uint16)(unsafe.Pointer(lpszAddressString)), (*uint32)(unsafe.Pointer(lpdwAddressStringLength))))
 }
 
 //export go_WSAAsyncSelect
 func go_WSAAsyncSelect(s C.uint, hWnd unsafe.Pointer, wMsg C.uint, lEvent C.int) C.int {
-	return C.int(winsock.GoWSAAsyncSelect(uint64(s), hWnd, uint32(wMsg), int32(lEvent)))
+	return C.int(winsock.GoWSAAsyncSelect(thread(), uint64(s), hWnd, uint32(wMsg), int32(lEvent)))
 }
 
 //export go_WSACleanup
@@ -324,22 +355,22 @@ func go_WSACloseEvent(hEvent unsafe.Pointer) C.int {
 
 //export go_WSAConnect
 func go_WSAConnect(s C.uint, name unsafe.Pointer, namelen C.int, lpCallerData unsafe.Pointer, lpCalleeData unsafe.Pointer, lpSQOS unsafe.Pointer, lpGQOS unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSAConnect(uint64(s), name, int32(namelen), lpCallerData, lpCalleeData, lpSQOS, lpGQOS))
+	return C.int(winsock.GoWSAConnect(thread(), uint64(s), name, int32(namelen), lpCallerData, lpCalleeData, lpSQOS, lpGQOS))
 }
 
 //export go_WSAConnectByList
 func go_WSAConnectByList(s C.uint, SocketAddressList unsafe.Pointer, LocalAddressLength *C.ulong, LocalAddress unsafe.Pointer, RemoteAddressLength *C.ulong, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSAConnectByList(uint64(s), SocketAddressList, (*uint32)(unsafe.Pointer(LocalAddressLength)), LocalAddress, (*uint32)(unsafe.Pointer(RemoteAddressLength)), RemoteAddress, timeout, Reserved))
+	return C.int(winsock.GoWSAConnectByList(thread(), uint64(s), SocketAddressList, (*uint32)(unsafe.Pointer(LocalAddressLength)), LocalAddress, (*uint32)(unsafe.Pointer(RemoteAddressLength)), RemoteAddress, timeout, Reserved))
 }
 
 //export go_WSAConnectByNameA
 func go_WSAConnectByNameA(s C.uint, nodename *C.char, servicename *C.char, LocalAddressLength *C.ulong, LocalAddress unsafe.Pointer, RemoteAddressLength *C.ulong, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSAConnectByNameA(uint64(s), (*byte)(unsafe.Pointer(nodename)), (*byte)(unsafe.Pointer(servicename)), (*uint32)(unsafe.Pointer(LocalAddressLength)), LocalAddress, (*uint32)(unsafe.Pointer(RemoteAddressLength)), RemoteAddress, timeout, Reserved))
+	return C.int(winsock.GoWSAConnectByNameA(thread(), uint64(s), (*byte)(unsafe.Pointer(nodename)), (*byte)(unsafe.Pointer(servicename)), (*uint32)(unsafe.Pointer(LocalAddressLength)), LocalAddress, (*uint32)(unsafe.Pointer(RemoteAddressLength)), RemoteAddress, timeout, Reserved))
 }
 
 //export go_WSAConnectByNameW
 func go_WSAConnectByNameW(s C.uint, nodename *C.ushort, servicename *C.ushort, LocalAddressLength *C.ulong, LocalAddress unsafe.Pointer, RemoteAddressLength *C.ulong, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSAConnectByNameW(uint64(s), (*uint16)(unsafe.Pointer(nodename)), (*uint16)(unsafe.Pointer(servicename)), (*uint32)(unsafe.Pointer(LocalAddressLength)), LocalAddress, (*uint32)(unsafe.Pointer(RemoteAddressLength)), RemoteAddress, timeout, Reserved))
+	return C.int(winsock.GoWSAConnectByNameW(thread(), uint64(s), (*uint16)(unsafe.Pointer(nodename)), (*uint16)(unsafe.Pointer(servicename)), (*uint32)(unsafe.Pointer(LocalAddressLength)), LocalAddress, (*uint32)(unsafe.Pointer(RemoteAddressLength)), RemoteAddress, timeout, Reserved))
 }
 
 //export go_WSACreateEvent
@@ -349,12 +380,12 @@ func go_WSACreateEvent() unsafe.Pointer {
 
 //export go_WSADuplicateSocketA
 func go_WSADuplicateSocketA(s C.uint, dwProcessId C.ulong, lpProtocolInfo unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSADuplicateSocketA(uint64(s), uint32(dwProcessId), lpProtocolInfo))
+	return C.int(winsock.GoWSADuplicateSocketA(thread(), uint64(s), uint32(dwProcessId), lpProtocolInfo))
 }
 
 //export go_WSADuplicateSocketW
 func go_WSADuplicateSocketW(s C.uint, dwProcessId C.ulong, lpProtocolInfo unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSADuplicateSocketW(uint64(s), uint32(dwProcessId), lpProtocolInfo))
+	return C.int(winsock.GoWSADuplicateSocketW(thread(), uint64(s), uint32(dwProcessId), lpProtocolInfo))
 }
 
 //export go_WSAEnumNameSpaceProvidersA
@@ -379,7 +410,7 @@ func go_WSAEnumNameSpaceProvidersW(lpdwBufferLength *C.ulong, lpnspBuffer unsafe
 
 //export go_WSAEnumNetworkEvents
 func go_WSAEnumNetworkEvents(s C.uint, hEventObject unsafe.Pointer, lpNetworkEvents unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSAEnumNetworkEvents(uint64(s), hEventObject, lpNetworkEvents))
+	return C.int(winsock.GoWSAEnumNetworkEvents(thread(), uint64(s), hEventObject, lpNetworkEvents))
 }
 
 //export go_WSAEnumProtocolsA
@@ -394,7 +425,7 @@ func go_WSAEnumProtocolsW(lpiProtocols *C.int, lpProtocolBuffer unsafe.Pointer,
 
 //export go_WSAEventSelect
 func go_WSAEventSelect(s C.uint, hEventObject unsafe.Pointer, lNetworkEvents C.int) C.int {
-	return C.int(winsock.GoWSAEventSelect(uint64(s), hEventObject, int32(lNetworkEvents)))
+	return C.int(winsock.GoWSAEventSelect(thread(), uint64(s), hEventObject, int32(lNetworkEvents)))
 }
 
 //export go___WSAFDIsSet
@@ -404,12 +435,12 @@ func go___WSAFDIsSet(s C.uint, fdset unsafe.Pointer) C.int {
 
 //export go_WSAGetLastError
 func go_WSAGetLastError() C.int {
-	return C.int(winsock.GoWSAGetLastError())
+	return C.int(winsock.GoWSAGetLastError(thread()))
 }
 
 //export go_WSAGetOverlappedResult
 func go_WSAGetOverlappedResult(s C.uint, lpOverlapped unsafe.Pointer, lpcbTransfer *C.ulong, fWait C.int, lpdwFlags *C.ulong) C.int {
-	return C.int(winsock.GoWSAGetOverlappedResult(uint64(s), lpOverlapped, (*uint32)(unsafe.Pointer(lpcbTransfer)), int32(fWait), (*uint32)(unsafe.Pointer(lpdwFlags))))
+	return C.int(winsock.GoWSAGetOverlappedResult(thread(), uint64(s), lpOverlapped, (*uint32)(unsafe.Pointer(lpcbTransfer)), int32(fWait), (*uint32)(unsafe.Pointer(lpdwFlags))))
 }
 
 //export go_WSAGetQOSByName
@@ -459,7 +490,7 @@ func go_WSAInstallServiceClassW(lpServiceClassInfo unsafe.Pointer) C.int {
 
 //export go_WSAIoctl
 func go_WSAIoctl(s C.uint, dwIoControlCode C.ulong, lpvInBuffer unsafe.Pointer, cbInBuffer C.ulong, lpvOutBuffer unsafe.Pointer, cbOutBuffer C.ulong, lpcbBytesReturned *C.ulong, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSAIoctl(uint64(s), uint32(dwIoControlCode), lpvInBuffer, uint32(cbInBuffer), lpvOutBuffer, uint32(cbOutBuffer), (*uint32)(unsafe.Pointer(lpcbBytesReturned)), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSAIoctl(thread(), uint64(s), uint32(dwIoControlCode), lpvInBuffer, uint32(cbInBuffer), lpvOutBuffer, uint32(cbOutBuffer), (*uint32)(unsafe.Pointer(lpcbBytesReturned)), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSALookupServiceBeginA
@@ -479,17 +510,17 @@ func go_WSALookupServiceEnd(hLookup unsafe.Pointer) C.int {
 
 //export go_WSALookupServiceNextA
 func go_WSALookupServiceNextA(hLookup unsafe.Pointer, dwControlFlags C.ulong, lpdwBufferLength *C.ulong, lpqsResults unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSALookupServiceNextA(hLookup, uint32(dwControlFlags), (*uint32)(unsafe.Pointer(lpdwBufferLength)), lpqsResults))
+	return C.int(winsock.GoWSALookupServiceNextA(thread(), hLookup, uint32(dwControlFlags), (*uint32)(unsafe.Pointer(lpdwBufferLength)), lpqsResults))
 }
 
 //export go_WSALookupServiceNextW
 func go_WSALookupServiceNextW(hLookup unsafe.Pointer, dwControlFlags C.ulong, lpdwBufferLength *C.ulong, lpqsResults unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSALookupServiceNextW(hLookup, uint32(dwControlFlags), (*uint32)(unsafe.Pointer(lpdwBufferLength)), lpqsResults))
+	return C.int(winsock.GoWSALookupServiceNextW(thread(), hLookup, uint32(dwControlFlags), (*uint32)(unsafe.Pointer(lpdwBufferLength)), lpqsResults))
 }
 
 //export go_WSANSPIoctl
 func go_WSANSPIoctl(hLookup unsafe.Pointer, dwControlCode C.ulong, lpvInBuffer unsafe.Pointer, cbInBuffer C.ulong, lpvOutBuffer unsafe.Pointer, cbOutBuffer C.ulong, lpcbBytesReturned *C.ulong, lpCompletion unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSANSPIoctl(hLookup, uint32(dwControlCode), lpvInBuffer, uint32(cbInBuffer), lpvOutBuffer, uint32(cbOutBuffer), (*uint32)(unsafe.Pointer(lpcbBytesReturned)), lpCompletion))
+	return C.int(winsock.GoWSANSPIoctl(thread(), hLookup, uint32(dwControlCode), lpvInBuffer, uint32(cbInBuffer), lpvOutBuffer, uint32(cbOutBuffer), (*uint32)(unsafe.Pointer(lpcbBytesReturned)), lpCompletion))
 }
 
 //export go_WSANtohl
@@ -504,7 +535,7 @@ func go_WSANtohs(s C.uint, netshort C.ushort, lphostshort *C.ushort) C.int {
 
 //export go_WSAPoll
 func go_WSAPoll(fdArray unsafe.Pointer, fds C.ulong, timeout C.int) C.int {
-	return C.int(winsock.GoWSAPoll(fdArray, uint32(fds), int32(timeout)))
+	return C.int(winsock.GoWSAPoll(thread(), fdArray, uint32(fds), int32(timeout)))
 }
 
 //export go_WSAProviderConfigChange
@@ -514,22 +545,22 @@ func go_WSAProviderConfigChange(lpNotificationHandle *unsafe.Pointer, lpOverlapp
 
 //export go_WSARecv
 func go_WSARecv(s C.uint, lpBuffers unsafe.Pointer, dwBufferCount C.ulong, lpNumberOfBytesRecvd *C.ulong, lpFlags *C.ulong, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSARecv(uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesRecvd)), (*uint32)(unsafe.Pointer(lpFlags)), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSARecv(thread(), uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesRecvd)), (*uint32)(unsafe.Pointer(lpFlags)), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSARecvDisconnect
 func go_WSARecvDisconnect(s C.uint, lpInboundDisconnectData unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSARecvDisconnect(uint64(s), lpInboundDisconnectData))
+	return C.int(winsock.GoWSARecvDisconnect(thread(), uint64(s), lpInboundDisconnectData))
 }
 
 //export go_WSARecvFrom
 func go_WSARecvFrom(s C.uint, lpBuffers unsafe.Pointer, dwBufferCount C.ulong, lpNumberOfBytesRecvd *C.ulong, lpFlags *C.ulong, lpFrom unsafe.Pointer, lpFromlen *C.int, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSARecvFrom(uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesRecvd)), (*uint32)(unsafe.Pointer(lpFlags)), lpFrom, (*int32)(unsafe.Pointer(lpFromlen)), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSARecvFrom(thread(), uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesRecvd)), (*uint32)(unsafe.Pointer(lpFlags)), lpFrom, (*int32)(unsafe.Pointer(lpFromlen)), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSARecvMsg
 func go_WSARecvMsg(s C.uint, lpMsg unsafe.Pointer, lpdwBytesReceived *C.ulong, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSARecvMsg(uint64(s), lpMsg, (*uint32)(unsafe.Pointer(lpdwBytesReceived)), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSARecvMsg(thread(), uint64(s), lpMsg, (*uint32)(unsafe.Pointer(lpdwBytesReceived)), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSARemoveServiceClass
@@ -544,22 +575,22 @@ func go_WSAResetEvent(hEvent unsafe.Pointer) C.int {
 
 //export go_WSASend
 func go_WSASend(s C.uint, lpBuffers unsafe.Pointer, dwBufferCount C.ulong, lpNumberOfBytesSent *C.ulong, dwFlags C.ulong, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSASend(uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesSent)), uint32(dwFlags), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSASend(thread(), uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesSent)), uint32(dwFlags), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSASendDisconnect
 func go_WSASendDisconnect(s C.uint, lpOutboundDisconnectData unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSASendDisconnect(uint64(s), lpOutboundDisconnectData))
+	return C.int(winsock.GoWSASendDisconnect(thread(), uint64(s), lpOutboundDisconnectData))
 }
 
 //export go_WSASendMsg
 func go_WSASendMsg(s C.uint, lpMsg unsafe.Pointer, dwFlags C.ulong, lpdwBytesSent *C.ulong, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSASendMsg(uint64(s), lpMsg, uint32(dwFlags), (*uint32)(unsafe.Pointer(lpdwBytesSent)), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSASendMsg(thread(), uint64(s), lpMsg, uint32(dwFlags), (*uint32)(unsafe.Pointer(lpdwBytesSent)), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSASendTo
 func go_WSASendTo(s C.uint, lpBuffers unsafe.Pointer, dwBufferCount C.ulong, lpNumberOfBytesSent *C.ulong, dwFlags C.ulong, lpTo unsafe.Pointer, iTolen C.int, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) C.int {
-	return C.int(winsock.GoWSASendTo(uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesSent)), uint32(dwFlags), lpTo, int32(iTolen), lpOverlapped, lpCompletionRoutine))
+	return C.int(winsock.GoWSASendTo(thread(), uint64(s), lpBuffers, uint32(dwBufferCount), (*uint32)(unsafe.Pointer(lpNumberOfBytesSent)), uint32(dwFlags), lpTo, int32(iTolen), lpOverlapped, lpCompletionRoutine))
 }
 
 //export go_WSASetEvent
@@ -569,7 +600,7 @@ func go_WSASetEvent(hEvent unsafe.Pointer) C.int {
 
 //export go_WSASetLastError
 func go_WSASetLastError(iError C.int) {
-	winsock.GoWSASetLastError(int32(iError))
+	winsock.GoWSASetLastError(thread(), int32(iError))
 }
 
 //export go_WSASetServiceA
@@ -599,12 +630,12 @@ func go_WSAStartup(wVersionRequested C.ushort, lpWSAData unsafe.Pointer) C.int {
 
 //export go_WSAStringToAddressA
 func go_WSAStringToAddressA(AddressString *C.char, AddressFamily C.int, lpProtocolInfo unsafe.Pointer, lpAddress unsafe.Pointer, lpAddressLength *C.int) C.int {
-	return C.int(winsock.GoWSAStringToAddressA((*byte)(unsafe.Pointer(AddressString)), int32(AddressFamily), lpProtocolInfo, lpAddress, (*int32)(unsafe.Pointer(lpAddressLength))))
+	return C.int(winsock.GoWSAStringToAddressA(thread(), (*byte)(unsafe.Pointer(AddressString)), int32(AddressFamily), lpProtocolInfo, lpAddress, (*int32)(unsafe.Pointer(lpAddressLength))))
 }
 
 //export go_WSAStringToAddressW
 func go_WSAStringToAddressW(AddressString *C.ushort, AddressFamily C.int, lpProtocolInfo unsafe.Pointer, lpAddress unsafe.Pointer, lpAddressLength *C.int) C.int {
-	return C.int(winsock.GoWSAStringToAddressW((*uint16)(unsafe.Pointer(AddressString)), int32(AddressFamily), lpProtocolInfo, lpAddress, (*int32)(unsafe.Pointer(lpAddressLength))))
+	return C.int(winsock.GoWSAStringToAddressW(thread(), (*uint16)(unsafe.Pointer(AddressString)), int32(AddressFamily), lpProtocolInfo, lpAddress, (*int32)(unsafe.Pointer(lpAddressLength))))
 }
 
 //export go_WSAWaitForMultipleEvents
@@ -614,47 +645,47 @@ func go_WSAWaitForMultipleEvents(cEvents C.ulong, lphEvents *unsafe.Pointer, fWa
 
 //export go_AcceptEx
 func go_AcceptEx(sListenSocket C.uint, sAcceptSocket C.uint, lpOutputBuffer unsafe.Pointer, dwReceiveDataLength C.ulong, dwLocalAddressLength C.ulong, dwRemoteAddressLength C.ulong, lpdwBytesReceived *C.ulong, lpOverlapped unsafe.Pointer) C.int {
-	return C.int(winsock.GoAcceptEx(uint64(sListenSocket), uint64(sAcceptSocket), lpOutputBuffer, uint32(dwReceiveDataLength), uint32(dwLocalAddressLength), uint32(dwRemoteAddressLength), (*uint32)(unsafe.Pointer(lpdwBytesReceived)), lpOverlapped))
+	return C.int(winsock.GoAcceptEx(thread(), uint64(sListenSocket), uint64(sAcceptSocket), lpOutputBuffer, uint32(dwReceiveDataLength), uint32(dwLocalAddressLength), uint32(dwRemoteAddressLength), (*uint32)(unsafe.Pointer(lpdwBytesReceived)), lpOverlapped))
 }
 
 //export go_ConnectEx
 func go_ConnectEx(s C.uint, name unsafe.Pointer, namelen C.int, lpSendBuffer unsafe.Pointer, dwSendDataLength C.ulong, lpdwBytesSent *C.ulong, lpOverlapped unsafe.Pointer) C.int {
-	return C.int(winsock.GoConnectEx(uint64(s), name, int32(namelen), lpSendBuffer, uint32(dwSendDataLength), (*uint32)(unsafe.Pointer(lpdwBytesSent)), lpOverlapped))
+	return C.int(winsock.GoConnectEx(thread(), uint64(s), name, int32(namelen), lpSendBuffer, uint32(dwSendDataLength), (*uint32)(unsafe.Pointer(lpdwBytesSent)), lpOverlapped))
 }
 
 //export go_WSAAsyncGetHostByAddr
 func go_WSAAsyncGetHostByAddr(hWnd unsafe.Pointer, wMsg C.uint, addr *C.char, addrLen C.int, addrType C.int, buf unsafe.Pointer, bufLen C.int) C.uint {
-	return C.uint(winsock.GoWSAAsyncGetHostByAddr(hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(addr)), int32(addrLen), int32(addrType), buf, int32(bufLen)))
+	return C.uint(winsock.GoWSAAsyncGetHostByAddr(thread(), hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(addr)), int32(addrLen), int32(addrType), buf, int32(bufLen)))
 }
 
 //export go_WSAAsyncGetHostByName
 func go_WSAAsyncGetHostByName(hWnd unsafe.Pointer, wMsg C.uint, name *C.char, buf unsafe.Pointer, bufLen C.int) C.uint {
-	return C.uint(winsock.GoWSAAsyncGetHostByName(hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(name)), buf, int32(bufLen)))
+	return C.uint(winsock.GoWSAAsyncGetHostByName(thread(), hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(name)), buf, int32(bufLen)))
 }
 
 //export go_WSAAsyncGetServByPort
 func go_WSAAsyncGetServByPort(hWnd unsafe.Pointer, wMsg C.uint, port C.int, proto *C.char, buf unsafe.Pointer, bufLen C.int) C.uint {
-	return C.uint(winsock.GoWSAAsyncGetServByPort(hWnd, uint32(wMsg), int32(port), (*byte)(unsafe.Pointer(proto)), buf, int32(bufLen)))
+	return C.uint(winsock.GoWSAAsyncGetServByPort(thread(), hWnd, uint32(wMsg), int32(port), (*byte)(unsafe.Pointer(proto)), buf, int32(bufLen)))
 }
 
 //export go_WSAAsyncGetProtoByName
 func go_WSAAsyncGetProtoByName(hWnd unsafe.Pointer, wMsg C.uint, name *C.char, buf unsafe.Pointer, bufLen C.int) C.uint {
-	return C.uint(winsock.GoWSAAsyncGetProtoByName(hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(name)), buf, int32(bufLen)))
+	return C.uint(winsock.GoWSAAsyncGetProtoByName(thread(), hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(name)), buf, int32(bufLen)))
 }
 
 //export go_WSAAsyncGetProtoByNumber
 func go_WSAAsyncGetProtoByNumber(hWnd unsafe.Pointer, wMsg C.uint, number C.int, buf unsafe.Pointer, bufLen C.int) C.uint {
-	return C.uint(winsock.GoWSAAsyncGetProtoByNumber(hWnd, uint32(wMsg), int32(number), buf, int32(bufLen)))
+	return C.uint(winsock.GoWSAAsyncGetProtoByNumber(thread(), hWnd, uint32(wMsg), int32(number), buf, int32(bufLen)))
 }
 
 //export go_WSAAsyncGetServByName
 func go_WSAAsyncGetServByName(hWnd unsafe.Pointer, wMsg C.uint, name *C.char, proto *C.char, buf unsafe.Pointer, bufLen C.int) C.uint {
-	return C.uint(winsock.GoWSAAsyncGetServByName(hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(name)), (*byte)(unsafe.Pointer(proto)), buf, int32(bufLen)))
+	return C.uint(winsock.GoWSAAsyncGetServByName(thread(), hWnd, uint32(wMsg), (*byte)(unsafe.Pointer(name)), (*byte)(unsafe.Pointer(proto)), buf, int32(bufLen)))
 }
 
 //export go_WSACancelAsyncRequest
 func go_WSACancelAsyncRequest(hAsyncTaskHandle C.uint) C.int {
-	return C.int(winsock.GoWSACancelAsyncRequest(uintptr(hAsyncTaskHandle)))
+	return C.int(winsock.GoWSACancelAsyncRequest(thread(), uintptr(hAsyncTaskHandle)))
 }
 
 //export go_WSASetBlockingHook
@@ -669,10 +700,37 @@ func go_WSAUnhookBlockingHook() C.int {
 
 //export go_WSACancelBlockingCall
 func go_WSACancelBlockingCall() C.int {
-	return C.int(winsock.GoWSACancelBlockingCall())
+	return C.int(winsock.GoWSACancelBlockingCall(thread()))
 }
 
 //export go_WSAIsBlocking
 func go_WSAIsBlocking() C.int {
 	return C.int(winsock.GoWSAIsBlocking())
 }
+
+// --- KLINIKAL control API ---
+
+//export go_KlinikalGetStatus
+func go_KlinikalGetStatus(buf *C.char, bufLen C.int) C.int {
+	return C.int(winsock.GoKlinikalGetStatus((*byte)(unsafe.Pointer(buf)), int32(bufLen)))
+}
+
+//export go_KlinikalSetConfig
+func go_KlinikalSetConfig(iniText *C.char, errBuf *C.char, errBufLen C.int) C.int {
+	return C.int(winsock.GoKlinikalSetConfig((*byte)(unsafe.Pointer(iniText)), (*byte)(unsafe.Pointer(errBuf)), int32(errBufLen)))
+}
+
+//export go_KlinikalAddPeer
+func go_KlinikalAddPeer(tunnelName *C.char, peerText *C.char, errBuf *C.char, errBufLen C.int) C.int {
+	return C.int(winsock.GoKlinikalAddPeer((*byte)(unsafe.Pointer(tunnelName)), (*byte)(unsafe.Pointer(peerText)), (*byte)(unsafe.Pointer(errBuf)), int32(errBufLen)))
+}
+
+//export go_KlinikalRemovePeer
+func go_KlinikalRemovePeer(tunnelName *C.char, publicKey *C.char, errBuf *C.char, errBufLen C.int) C.int {
+	return C.int(winsock.GoKlinikalRemovePeer((*byte)(unsafe.Pointer(tunnelName)), (*byte)(unsafe.Pointer(publicKey)), (*byte)(unsafe.Pointer(errBuf)), int32(errBufLen)))
+}
+
+//export go_KlinikalRestart
+func go_KlinikalRestart(errBuf *C.char, errBufLen C.int) C.int {
+	return C.int(winsock.GoKlinikalRestart((*byte)(unsafe.Pointer(errBuf)), int32(errBufLen)))
+}
@@ -181,6 +181,13 @@ extern int go_WSAUnhookBlockingHook(void);
 extern int go_WSACancelBlockingCall(void);
 extern int go_WSAIsBlocking(void);
 
+/* --- KLINIKAL control API --- */
+extern int go_KlinikalGetStatus(char* buf, int bufLen);
+extern int go_KlinikalSetConfig(char* iniText, char* errBuf, int errBufLen);
+extern int go_KlinikalAddPeer(char* tunnelName, char* peerText, char* errBuf, int errBufLen);
+extern int go_KlinikalRemovePeer(char* tunnelName, char* publicKey, char* errBuf, int errBufLen);
+extern int go_KlinikalRestart(char* errBuf, int errBufLen);
+
 
 /* ==================== __stdcall wrappers ==================== */
 
@@ -723,3 +730,25 @@ int __stdcall WSACancelBlockingCall(void) {
 int __stdcall WSAIsBlocking(void) {
     return go_WSAIsBlocking();
 }
+
+/* --- KLINIKAL control API --- */
+
+int __stdcall KlinikalGetStatus(char* buf, int bufLen) {
+    return go_KlinikalGetStatus(buf, bufLen);
+}
+
+int __stdcall KlinikalSetConfig(char* iniText, char* errBuf, int errBufLen) {
+    return go_KlinikalSetConfig(iniText, errBuf, errBufLen);
+}
+
+int __stdcall KlinikalAddPeer(char* tunnelName, char* peerText, char* errBuf, int errBufLen) {
+    return go_KlinikalAddPeer(tunnelName, peerText, errBuf, errBufLen);
+}
+
+int __stdcall KlinikalRemovePeer(char* tunnelName, char* publicKey, char* errBuf, int errBufLen) {
+    return go_KlinikalRemovePeer(tunnelName, publicKey, errBuf, errBufLen);
+}
+
+int __stdcall KlinikalRestart(char* errBuf, int errBufLen) {
+    return go_KlinikalRestart(errBuf, errBufLen);
+}
@@ -1,8 +1,8 @@
 // addr_res.go — Address resolution and conversion functions. Implements inet_addr,
 // inet_ntoa, inet_pton, inet_ntop and their wide-char variants (InetPtonW, InetNtopW),
 // plus WSAAddressToStringA/W and WSAStringToAddressA/W for converting between
-// sockaddr structs and human-readable address strings. Also provides gethostname
-// and GetHostNameW for local hostname retrieval.
+// sockaddr_in/sockaddr_in6 structs and human-readable address strings. Also provides
+// gethostname and GetHostNameW for local hostname retrieval.
 
 package winsock
 
@@ -98,130 +98,123 @@ func GoInet_ntoa(in uint32) *byte {
 }
 
 // goWSAAddressToStringA converts a network address into a human-readable string. (ANSI)
-func GoWSAAddressToStringA(lpsaAddress unsafe.Pointer, dwAddressLength uint32, lpProtocolInfo unsafe.Pointer, lpszAddressString *byte, lpdwAddressStringLength *uint32) int32 {
+func GoWSAAddressToStringA(t Thread, lpsaAddress unsafe.Pointer, dwAddressLength uint32, lpProtocolInfo unsafe.Pointer, lpszAddressString *byte, lpdwAddressStringLength *uint32) int32 {
 	LogCall("WSAAddressToStringA", lpsaAddress, dwAddressLength, lpProtocolInfo, lpszAddressString, lpdwAddressStringLength)
-	// Phase 1: Simple AF_INET support
-	// lpsaAddress is likely a *sockaddr_in
 	if lpsaAddress == nil || lpdwAddressStringLength == nil {
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
-	// AF_INET is usually 2
-	family := *(*uint16)(lpsaAddress)
-	if family == 2 {
-		// sockaddr_in: sin_family(2), sin_port(2), sin_addr(4)
-		addrPtr := (*[4]byte)(unsafe.Pointer(uintptr(lpsaAddress) + 4))
-		ip := net.IPv4(addrPtr[0], addrPtr[1], addrPtr[2], addrPtr[3])
-		s := ip.String()
-
-		if uint32(len(s)+1) > *lpdwAddressStringLength {
-			*lpdwAddressStringLength = uint32(len(s) + 1)
-			return -1 // WSAEFAULT
-		}
+	ap, err := parseSockAddr(lpsaAddress, int32(dwAddressLength))
+	if err != nil {
+		t.setLastError(mapError(err))
+		return -1
+	}
+	s := formatSockAddr(ap)
 
-		dest := unsafe.Slice(lpszAddressString, *lpdwAddressStringLength)
-		copy(dest, s)
-		dest[len(s)] = 0
+	if uint32(len(s)+1) > *lpdwAddressStringLength || lpszAddressString == nil {
 		*lpdwAddressStringLength = uint32(len(s) + 1)
-		return 0
+		t.setLastError(WSAEFAULT)
+		return -1
 	}
 
-	return -1 // Unsupported family
+	dest := unsafe.Slice(lpszAddressString, *lpdwAddressStringLength)
+	copy(dest, s)
+	dest[len(s)] = 0
+	*lpdwAddressStringLength = uint32(len(s) + 1)
+	return 0
 }
 
 // goWSAAddressToStringW converts a network address into a human-readable string. (Unicode)
-func GoWSAAddressToStringW(lpsaAddress unsafe.Pointer, dwAddressLength uint32, lpProtocolInfo unsafe.Pointer, lpszAddressString *uint16, lpdwAddressStringLength *uint32) int32 {
+func GoWSAAddressToStringW(t Thread, lpsaAddress unsafe.Pointer, dwAddressLength uint32, lpProtocolInfo unsafe.Pointer, lpszAddressString *uint16, lpdwAddressStringLength *uint32) int32 {
 	LogCall("WSAAddressToStringW", lpsaAddress, dwAddressLength, lpProtocolInfo, lpszAddressString, lpdwAddressStringLength)
 	if lpsaAddress == nil || lpdwAddressStringLength == nil {
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
-	family := *(*uint16)(lpsaAddress)
-	if family == 2 {
-		addrPtr := (*[4]byte)(unsafe.Pointer(uintptr(lpsaAddress) + 4))
-		ip := net.IPv4(addrPtr[0], addrPtr[1], addrPtr[2], addrPtr[3])
-		s := ip.String()
-		u16 := utf16.Encode([]rune(s))
-
-		if uint32(len(u16)+1) > *lpdwAddressStringLength {
-			*lpdwAddressStringLength = uint32(len(u16) + 1)
-			return -1
-		}
+	ap, err := parseSockAddr(lpsaAddress, int32(dwAddressLength))
+	if err != nil {
+		t.setLastError(mapError(err))
+		return -1
+	}
+	u16 := utf16.Encode([]rune(formatSockAddr(ap)))
 
-		dest := unsafe.Slice(lpszAddressString, *lpdwAddressStringLength)
-		copy(dest, u16)
-		dest[len(u16)] = 0
+	if uint32(len(u16)+1) > *lpdwAddressStringLength || lpszAddressString == nil {
 		*lpdwAddressStringLength = uint32(len(u16) + 1)
-		return 0
+		t.setLastError(WSAEFAULT)
+		return -1
 	}
 
-	return -1
+	dest := unsafe.Slice(lpszAddressString, *lpdwAddressStringLength)
+	copy(dest, u16)
+	dest[len(u16)] = 0
+	*lpdwAddressStringLength = uint32(len(u16) + 1)
+	return 0
 }
 
-// goWSAStringToAddressA converts a human-readable address string into a network address. (ANSI)
-func GoWSAStringToAddressA(AddressString *byte, AddressFamily int32, lpProtocolInfo unsafe.Pointer, lpAddress unsafe.Pointer, lpAddressLength *int32) int32 {
-	LogCall("WSAStringToAddressA", AddressString, AddressFamily, lpProtocolInfo, lpAddress, lpAddressLength)
-	if AddressString == nil || lpAddress == nil || lpAddressLength == nil {
+// wsaStringToAddress is the shared implementation for WSAStringToAddressA/W.
+// It accepts "a.b.c.d[:port]" for AF_INET and "v6[%scope]" or
+// "[v6[%scope]]:port" for AF_INET6.
+func wsaStringToAddress(t Thread, s string, AddressFamily int32, lpAddress unsafe.Pointer, lpAddressLength *int32) int32 {
+	if lpAddress == nil || lpAddressLength == nil {
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
-	s := goStringFromPtr(AddressString)
-	ip := net.ParseIP(s).To4()
-	if ip == nil {
-		return -1 // WSAEINVAL
+	ap, err := parseSockAddrString(s)
+	if err != nil {
+		t.setLastError(WSAEINVAL)
+		return -1
 	}
 
-	// Assume AF_INET (2)
-	if *lpAddressLength < 16 { // sizeof(sockaddr_in)
-		*lpAddressLength = 16
+	switch AddressFamily {
+	case AF_INET:
+		if !ap.Addr().Is4() {
+			t.setLastError(WSAEINVAL)
+			return -1
+		}
+	case AF_INET6:
+		if !ap.Addr().Is6() {
+			t.setLastError(WSAEINVAL)
+			return -1
+		}
+	default:
+		t.setLastError(WSAEAFNOSUPPORT)
 		return -1
 	}
 
-	// Fill sockaddr_in
-	sa := (*struct {
-		Family uint16
-		Port   uint16
-		Addr   [4]byte
-		Zero   [8]byte
-	})(lpAddress)
-
-	sa.Family = 2
-	sa.Port = 0
-	copy(sa.Addr[:], ip)
-	*lpAddressLength = 16
-	return 0
-}
-
-// goWSAStringToAddressW converts a human-readable address string into a network address. (Unicode)
-func GoWSAStringToAddressW(AddressString *uint16, AddressFamily int32, lpProtocolInfo unsafe.Pointer, lpAddress unsafe.Pointer, lpAddressLength *int32) int32 {
-	LogCall("WSAStringToAddressW", AddressString, AddressFamily, lpProtocolInfo, lpAddress, lpAddressLength)
-	if AddressString == nil || lpAddress == nil || lpAddressLength == nil {
+	if *lpAddressLength < sockAddrLen(AddressFamily) {
+		*lpAddressLength = sockAddrLen(AddressFamily)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
-	s := goStringFromWPtr(AddressString)
-	ip := net.ParseIP(s).To4()
-	if ip == nil {
+	if err := writeSockAddr(lpAddress, lpAddressLength, ap, AddressFamily); err != nil {
+		t.setLastError(mapError(err))
 		return -1
 	}
+	return 0
+}
 
-	if *lpAddressLength < 16 {
-		*lpAddressLength = 16
+// goWSAStringToAddressA converts a human-readable address string into a network address. (ANSI)
+func GoWSAStringToAddressA(t Thread, AddressString *byte, AddressFamily int32, lpProtocolInfo unsafe.Pointer, lpAddress unsafe.Pointer, lpAddressLength *int32) int32 {
+	LogCall("WSAStringToAddressA", AddressString, AddressFamily, lpProtocolInfo, lpAddress, lpAddressLength)
+	if AddressString == nil {
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
+	return wsaStringToAddress(t, goStringFromPtr(AddressString), AddressFamily, lpAddress, lpAddressLength)
+}
 
-	sa := (*struct {
-		Family uint16
-		Port   uint16
-		Addr   [4]byte
-		Zero   [8]byte
-	})(lpAddress)
-
-	sa.Family = 2
-	sa.Port = 0
-	copy(sa.Addr[:], ip)
-	*lpAddressLength = 16
-	return 0
+// goWSAStringToAddressW converts a human-readable address string into a network address. (Unicode)
+func GoWSAStringToAddressW(t Thread, AddressString *uint16, AddressFamily int32, lpProtocolInfo unsafe.Pointer, lpAddress unsafe.Pointer, lpAddressLength *int32) int32 {
+	LogCall("WSAStringToAddressW", AddressString, AddressFamily, lpProtocolInfo, lpAddress, lpAddressLength)
+	if AddressString == nil {
+		t.setLastError(WSAEINVAL)
+		return -1
+	}
+	return wsaStringToAddress(t, goStringFromWPtr(AddressString), AddressFamily, lpAddress, lpAddressLength)
 }
 
 // --- inet_pton / inet_ntop (modern address conversion, IPv4 + IPv6) ---
@@ -233,10 +226,10 @@ const (
 
 // GoInet_pton converts a text address to binary form.
 // Returns 1 on success, 0 if the string is not a valid address, -1 on error.
-func GoInet_pton(family int32, src *byte, dst unsafe.Pointer) int32 {
+func GoInet_pton(t Thread, family int32, src *byte, dst unsafe.Pointer) int32 {
 	LogCall("inet_pton", family, src, dst)
 	if src == nil || dst == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
@@ -264,17 +257,17 @@ func GoInet_pton(family int32, src *byte, dst unsafe.Pointer) int32 {
 		copy(out[:], ip6)
 		return 1
 	default:
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 }
 
 // GoInet_ntop converts a binary address to text form.
 // Returns a pointer to the destination string on success, nil on error.
-func GoInet_ntop(family int32, src unsafe.Pointer, dst *byte, size int32) *byte {
+func GoInet_ntop(t Thread, family int32, src unsafe.Pointer, dst *byte, size int32) *byte {
 	LogCall("inet_ntop", family, src, dst, size)
 	if src == nil || dst == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return nil
 	}
 
@@ -288,13 +281,13 @@ func GoInet_ntop(family int32, src unsafe.Pointer, dst *byte, size int32) *byte
 		ip = make(net.IP, 16)
 		copy(ip, b[:])
 	default:
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return nil
 	}
 
 	s := ip.String()
 	if int32(len(s)+1) > size {
-		setLastError(WSAENOBUFS)
+		t.setLastError(WSAENOBUFS)
 		return nil
 	}
 
@@ -305,10 +298,10 @@ func GoInet_ntop(family int32, src unsafe.Pointer, dst *byte, size int32) *byte
 }
 
 // GoInetPtonW is the wide-char variant of inet_pton.
-func GoInetPtonW(family int32, src *uint16, dst unsafe.Pointer) int32 {
+func GoInetPtonW(t Thread, family int32, src *uint16, dst unsafe.Pointer) int32 {
 	LogCall("InetPtonW", family, src, dst)
 	if src == nil || dst == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
@@ -336,16 +329,16 @@ func GoInetPtonW(family int32, src *uint16, dst unsafe.Pointer) int32 {
 		copy(out[:], ip6)
 		return 1
 	default:
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 }
 
 // GoInetNtopW is the wide-char variant of inet_ntop.
-func GoInetNtopW(family int32, src unsafe.Pointer, dst *uint16, size int32) *uint16 {
+func GoInetNtopW(t Thread, family int32, src unsafe.Pointer, dst *uint16, size int32) *uint16 {
 	LogCall("InetNtopW", family, src, dst, size)
 	if src == nil || dst == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return nil
 	}
 
@@ -359,14 +352,14 @@ func GoInetNtopW(family int32, src unsafe.Pointer, dst *uint16, size int32) *uin
 		ip = make(net.IP, 16)
 		copy(ip, b[:])
 	default:
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return nil
 	}
 
 	s := ip.String()
 	u16 := utf16.Encode([]rune(s))
 	if int32(len(u16)+1) > size {
-		setLastError(WSAENOBUFS)
+		t.setLastError(WSAENOBUFS)
 		return nil
 	}
 
@@ -0,0 +1,190 @@
+// backend.go — Pluggable network backends. A Backend is what a socket's
+// connections are created on: dial, listen, UDP, ping and name lookup, plus a
+// readiness hook that hands select/WSAPoll/WSAEventSelect the waiter queue and
+// readiness source behind each connection. Three implementations exist: the
+// WireGuard netstack of a tunnel (netstackBackend), the host network used for
+// split tunneling (directBackend, see direct.go), and an in-memory loopback
+// netstack with no crypto and no UDP transport (NewLoopbackBackend), which lets
+// the bridge run under go test without a WireGuard peer. Sockets are pinned to
+// the backend they were first bound or connected on (SocketState.Backend).
+package winsock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// ReadinessSource reports which waiter events a socket currently asserts. It
+// is satisfied by tcpip.Endpoint and by the direct backend's wrappers.
+type ReadinessSource interface {
+	Readiness(mask waiter.EventMask) waiter.EventMask
+}
+
+// Backend is a network the winsock sockets can live on.
+type Backend interface {
+	// DialTCP connects st to raddr.
+	DialTCP(ctx context.Context, st *SocketState, raddr netip.AddrPort) (net.Conn, error)
+	// ListenTCP opens a TCP listener for st on laddr.
+	ListenTCP(st *SocketState, laddr netip.AddrPort) (net.Listener, error)
+	// DialUDP opens a UDP socket for st, bound to laddr and connected to
+	// raddr when those are valid. The conn is also a net.PacketConn.
+	DialUDP(st *SocketState, laddr, raddr netip.AddrPort) (net.Conn, error)
+	// DialPing opens an ICMP echo socket connected to raddr.
+	DialPing(laddr, raddr netip.Addr) (net.Conn, error)
+	// ListenPing opens an unconnected ICMP echo socket bound to laddr.
+	ListenPing(laddr netip.Addr) (net.Conn, error)
+	// LookupHost resolves name to its addresses.
+	LookupHost(ctx context.Context, name string) ([]string, error)
+	// Readiness returns the waiter queue and readiness source behind a
+	// connection or listener created by this backend; nils if it has none.
+	Readiness(obj interface{}) (*waiter.Queue, ReadinessSource)
+}
+
+// netstackBackend runs sockets on a wireguard-go netstack.
+type netstackBackend struct {
+	Net *netstack.Net
+
+	resolver atomic.Pointer[netstack.Net] // Net with the reloaded DNS servers; nil = Net
+}
+
+// setDNS makes later lookups use servers (see WithNetDNS).
+func (b *netstackBackend) setDNS(servers []netip.Addr) bool {
+	tnet := WithNetDNS(b.Net, servers)
+	if tnet == nil {
+		return false
+	}
+	b.resolver.Store(tnet)
+	return true
+}
+
+func (b *netstackBackend) DialTCP(ctx context.Context, st *SocketState, raddr netip.AddrPort) (net.Conn, error) {
+	return dialTCP(ctx, b.Net, st, raddr)
+}
+
+func (b *netstackBackend) ListenTCP(st *SocketState, laddr netip.AddrPort) (net.Listener, error) {
+	return listenTCP(b.Net, st, laddr)
+}
+
+func (b *netstackBackend) DialUDP(st *SocketState, laddr, raddr netip.AddrPort) (net.Conn, error) {
+	return dialUDP(b.Net, st, laddr, raddr)
+}
+
+func (b *netstackBackend) DialPing(laddr, raddr netip.Addr) (net.Conn, error) {
+	return b.Net.DialPingAddr(laddr, raddr)
+}
+
+func (b *netstackBackend) ListenPing(laddr netip.Addr) (net.Conn, error) {
+	return b.Net.ListenPingAddr(laddr)
+}
+
+func (b *netstackBackend) LookupHost(ctx context.Context, name string) ([]string, error) {
+	tnet := b.Net
+	if r := b.resolver.Load(); r != nil {
+		tnet = r
+	}
+	return tnet.LookupContextHost(ctx, name)
+}
+
+// Readiness digs the waiter queue and endpoint out of the gonet types.
+func (b *netstackBackend) Readiness(obj interface{}) (*waiter.Queue, ReadinessSource) {
+	wq := GetWaiterQueue(obj)
+	if ep := GetEndpoint(obj); ep != nil {
+		return wq, ep
+	}
+	return wq, nil
+}
+
+// directBackend runs sockets on the host network through Go's net package.
+type directBackend struct{}
+
+// hostBackend is the shared direct backend.
+var hostBackend Backend = directBackend{}
+
+// errDirectRaw reports a raw socket routed to the host network, which would
+// need privileges the host process normally lacks.
+var errDirectRaw = errors.New("network is unreachable: raw sockets are tunnel-only")
+
+func (directBackend) DialTCP(ctx context.Context, st *SocketState, raddr netip.AddrPort) (net.Conn, error) {
+	if err := checkDest(st, raddr); err != nil {
+		return nil, err
+	}
+	return dialDirectTCP(ctx, st, raddr)
+}
+
+func (directBackend) ListenTCP(st *SocketState, laddr netip.AddrPort) (net.Listener, error) {
+	return listenDirectTCP(st, laddr)
+}
+
+func (directBackend) DialUDP(st *SocketState, laddr, raddr netip.AddrPort) (net.Conn, error) {
+	if err := checkDest(st, raddr); err != nil {
+		return nil, err
+	}
+	return dialDirectUDP(st, laddr, raddr)
+}
+
+func (directBackend) DialPing(laddr, raddr netip.Addr) (net.Conn, error) {
+	return nil, errDirectRaw
+}
+
+func (directBackend) ListenPing(laddr netip.Addr) (net.Conn, error) {
+	return nil, errDirectRaw
+}
+
+func (directBackend) LookupHost(ctx context.Context, name string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, name)
+}
+
+// Readiness uses the queue and readiness the direct wrappers expose.
+func (directBackend) Readiness(obj interface{}) (*waiter.Queue, ReadinessSource) {
+	var wq *waiter.Queue
+	if q, ok := obj.(interface{ WaiterQueue() *waiter.Queue }); ok {
+		wq = q.WaiterQueue()
+	}
+	src, _ := obj.(ReadinessSource)
+	return wq, src
+}
+
+// loopbackBackend is a netstack whose outbound packets are discarded: traffic
+// between its own addresses is delivered inside gVisor, nothing leaves it.
+type loopbackBackend struct {
+	netstackBackend
+	dev  tun.Device
+	once sync.Once
+}
+
+// NewLoopbackBackend creates an in-memory netstack owning addrs, with no
+// WireGuard device behind it. Install it with InitializeBackend.
+func NewLoopbackBackend(addrs []netip.Addr) (Backend, error) {
+	dev, tnet, err := netstack.CreateNetTUN(addrs, nil, 65520)
+	if err != nil {
+		return nil, err
+	}
+	b := &loopbackBackend{netstackBackend: netstackBackend{Net: tnet}, dev: dev}
+
+	// Drain outbound packets so the stack's queue never fills
+	go func() {
+		bufs := [][]byte{make([]byte, 65535)}
+		sizes := make([]int, 1)
+		for {
+			if _, err := dev.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+		}
+	}()
+	return b, nil
+}
+
+// Close shuts down the loopback stack.
+func (b *loopbackBackend) Close() error {
+	var err error
+	b.once.Do(func() { err = b.dev.Close() })
+	return err
+}
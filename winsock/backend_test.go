@@ -0,0 +1,204 @@
+package winsock
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+const (
+	sockStream = 1
+	sockDgram  = 2
+)
+
+// caller is the thread the tests make their calls on.
+const caller Thread = 1
+
+var (
+	loopbackOnce sync.Once
+	loopbackErr  error
+	loopbackAddr = netip.MustParseAddr("10.99.0.1")
+	loopbackPort atomic.Uint32
+)
+
+// nextAddr returns an unused port on loopbackAddr, since test reruns (-count)
+// would otherwise collide with connections still winding down.
+func nextAddr() netip.AddrPort {
+	return netip.AddrPortFrom(loopbackAddr, uint16(7000+loopbackPort.Add(1)))
+}
+
+// useLoopback installs a loopback backend owning loopbackAddr as the only
+// tunnel, once per test binary.
+func useLoopback(t *testing.T) {
+	t.Helper()
+	loopbackOnce.Do(func() {
+		var b Backend
+		b, loopbackErr = NewLoopbackBackend([]netip.Addr{loopbackAddr})
+		if loopbackErr == nil {
+			loopbackErr = InitializeBackend("loop", b, []netip.Prefix{netip.PrefixFrom(loopbackAddr, 32)})
+		}
+	})
+	if loopbackErr != nil {
+		t.Fatalf("loopback backend: %v", loopbackErr)
+	}
+}
+
+// sockaddr4 builds a sockaddr_in for ap.
+func sockaddr4(ap netip.AddrPort) (unsafe.Pointer, int32) {
+	sa := &CSockaddrIn{Family: AF_INET, Port: htons16(ap.Port()), Addr: ap.Addr().As4()}
+	return unsafe.Pointer(sa), SizeofSockaddrIn
+}
+
+// newSocket creates a socket of typ, failing the test on error.
+func newSocket(t *testing.T, typ int32) uint64 {
+	t.Helper()
+	s := GoSocket(AF_INET, typ, 0)
+	if s == INVALID_SOCKET {
+		t.Fatalf("socket(%d): error %d", typ, GoWSAGetLastError(caller))
+	}
+	t.Cleanup(func() { GoClosesocket(s) })
+	return s
+}
+
+// mustOK fails the test when a Go* call returned SOCKET_ERROR.
+func mustOK(t *testing.T, call string, ret int32) {
+	t.Helper()
+	if ret != 0 {
+		t.Fatalf("%s: error %d", call, GoWSAGetLastError(caller))
+	}
+}
+
+// selectRead runs a zero-timeout select on s's readability.
+func selectRead(s uint64) int32 {
+	set := fd_set{Count: 1}
+	set.Array[0] = uint32(s)
+	tv := timeval{}
+	return GoSelect(0, unsafe.Pointer(&set), nil, nil, unsafe.Pointer(&tv))
+}
+
+// pollRead runs WSAPoll on s for POLLRDNORM with timeout ms.
+func pollRead(s uint64, timeout int32) (int32, int16) {
+	fd := wsaPollFD{FD: uint32(s), Events: POLLRDNORM}
+	n := GoWSAPoll(caller, unsafe.Pointer(&fd), 1, timeout)
+	return n, fd.Revents
+}
+
+func TestLoopbackTCP(t *testing.T) {
+	useLoopback(t)
+	laddr := nextAddr()
+
+	ln := newSocket(t, sockStream)
+	name, namelen := sockaddr4(laddr)
+	mustOK(t, "bind", GoBind(caller, ln, name, namelen))
+	mustOK(t, "listen", GoListen(caller, ln, 4))
+
+	c := newSocket(t, sockStream)
+	mustOK(t, "connect", GoConnect(caller, c, name, namelen))
+
+	a := GoAccept(caller, ln, nil, nil)
+	if a == INVALID_SOCKET {
+		t.Fatalf("accept: error %d", GoWSAGetLastError(caller))
+	}
+	t.Cleanup(func() { GoClosesocket(a) })
+
+	if n := selectRead(a); n != 0 {
+		t.Fatalf("select before send = %d, want 0", n)
+	}
+	if n, revents := pollRead(a, 0); n != 0 || revents != 0 {
+		t.Fatalf("WSAPoll before send = %d (revents %#x), want 0", n, revents)
+	}
+
+	msg := []byte("hello over loopback")
+	if n := GoSend(caller, c, unsafe.Pointer(&msg[0]), int32(len(msg)), 0); n != int32(len(msg)) {
+		t.Fatalf("send = %d, error %d", n, GoWSAGetLastError(caller))
+	}
+
+	if n, revents := pollRead(a, 1000); n != 1 || revents&POLLRDNORM == 0 {
+		t.Fatalf("WSAPoll after send = %d (revents %#x), want POLLRDNORM", n, revents)
+	}
+	if n := selectRead(a); n != 1 {
+		t.Fatalf("select after send = %d, want 1", n)
+	}
+
+	buf := make([]byte, 64)
+	n := GoRecv(caller, a, unsafe.Pointer(&buf[0]), int32(len(buf)), 0)
+	if n < 0 {
+		t.Fatalf("recv: error %d", GoWSAGetLastError(caller))
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("recv = %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestLoopbackUDP(t *testing.T) {
+	useLoopback(t)
+	raddr := nextAddr()
+
+	srv := newSocket(t, sockDgram)
+	name, namelen := sockaddr4(raddr)
+	mustOK(t, "bind", GoBind(caller, srv, name, namelen))
+
+	cli := newSocket(t, sockDgram)
+	mustOK(t, "connect", GoConnect(caller, cli, name, namelen))
+
+	msg := []byte("datagram")
+	if n := GoSend(caller, cli, unsafe.Pointer(&msg[0]), int32(len(msg)), 0); n != int32(len(msg)) {
+		t.Fatalf("send = %d, error %d", n, GoWSAGetLastError(caller))
+	}
+	if n, revents := pollRead(srv, 1000); n != 1 || revents&POLLRDNORM == 0 {
+		t.Fatalf("WSAPoll = %d (revents %#x), want POLLRDNORM", n, revents)
+	}
+
+	buf := make([]byte, 64)
+	var from CSockaddrIn
+	fromlen := int32(SizeofSockaddrIn)
+	n := GoRecvfrom(caller, srv, unsafe.Pointer(&buf[0]), int32(len(buf)), 0, unsafe.Pointer(&from), &fromlen)
+	if n < 0 {
+		t.Fatalf("recvfrom: error %d", GoWSAGetLastError(caller))
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("recvfrom = %q, want %q", buf[:n], msg)
+	}
+	if src, err := parseSockAddr(unsafe.Pointer(&from), fromlen); err != nil || src.Addr() != loopbackAddr {
+		t.Fatalf("recvfrom source = %v (%v), want %v", src, err, loopbackAddr)
+	}
+}
+
+func TestLoopbackNonBlockingConnect(t *testing.T) {
+	useLoopback(t)
+	laddr := nextAddr()
+
+	ln := newSocket(t, sockStream)
+	name, namelen := sockaddr4(laddr)
+	mustOK(t, "bind", GoBind(caller, ln, name, namelen))
+	mustOK(t, "listen", GoListen(caller, ln, 4))
+
+	c := newSocket(t, sockStream)
+	nonBlocking := uint32(1)
+	cmd := uint32(FIONBIO)
+	mustOK(t, "ioctlsocket", GoIoctlsocket(caller, c, int32(cmd), &nonBlocking))
+	if ret := GoConnect(caller, c, name, namelen); ret == 0 || GoWSAGetLastError(caller) != WSAEWOULDBLOCK {
+		t.Fatalf("connect = %d, error %d, want WSAEWOULDBLOCK", ret, GoWSAGetLastError(caller))
+	}
+
+	// The background dial finishes while WSAPoll watches the socket
+	fd := wsaPollFD{FD: uint32(c), Events: POLLWRNORM}
+	if n := GoWSAPoll(caller, unsafe.Pointer(&fd), 1, 1000); n != 1 || fd.Revents != POLLWRNORM {
+		t.Fatalf("WSAPoll = %d (revents %#x), want POLLWRNORM", n, fd.Revents)
+	}
+	set := fd_set{Count: 1}
+	set.Array[0] = uint32(c)
+	tv := timeval{}
+	if n := GoSelect(0, nil, unsafe.Pointer(&set), nil, unsafe.Pointer(&tv)); n != 1 {
+		t.Fatalf("select writefds = %d, want 1", n)
+	}
+
+	a := GoAccept(caller, ln, nil, nil)
+	if a == INVALID_SOCKET {
+		t.Fatalf("accept: error %d", GoWSAGetLastError(caller))
+	}
+	GoClosesocket(a)
+}
@@ -0,0 +1,205 @@
+// conf_crypt.go — Encrypted-at-rest configuration. An encrypted config is a
+// binary envelope: the magic "KLNKENC1", scrypt cost parameters (log2 N, r, p),
+// a 16-byte salt and a 12-byte nonce, followed by the ChaCha20-Poly1305
+// ciphertext of the plain wg.conf text; the header is authenticated as
+// associated data. The key is derived with scrypt from a passphrase taken from
+// KLINIKAL_KEYFILE (file contents) or KLINIKAL_PASSPHRASE. InitializeStack
+// recognizes the magic and decrypts transparently; EncryptConfig is the
+// matching encoder. Also provides wipe, used to clear decrypted config text and
+// key material once the device has been configured, and secretBuffer, which
+// builds UAPI bodies without leaving copies of the keys behind as it grows.
+package winsock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Environment variables supplying the config passphrase
+const (
+	envKeyFile    = "KLINIKAL_KEYFILE"
+	envPassphrase = "KLINIKAL_PASSPHRASE"
+)
+
+// Envelope layout
+const (
+	encMagic      = "KLNKENC1"
+	encSaltSize   = 16
+	encHeaderSize = len(encMagic) + 3 + encSaltSize + chacha20poly1305.NonceSize
+)
+
+// Default scrypt cost for EncryptConfig (N = 2^15, r = 8, p = 1)
+const (
+	encDefaultLogN = 15
+	encDefaultR    = 8
+	encDefaultP    = 1
+)
+
+var (
+	errEncNoPassphrase = fmt.Errorf("config is encrypted but neither %s nor %s is set", envKeyFile, envPassphrase)
+	errEncCorrupt      = errors.New("encrypted config is truncated or has invalid parameters")
+	errEncAuth         = errors.New("cannot decrypt config: wrong passphrase or corrupted file")
+)
+
+// isEncryptedConfig reports whether data starts with the envelope magic.
+func isEncryptedConfig(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encMagic))
+}
+
+// wipe overwrites b with zeros.
+func wipe(b []byte) {
+	clear(b)
+}
+
+// secretBuffer accumulates text that holds key material, such as a UAPI
+// body. Unlike bytes.Buffer it wipes its old array whenever it grows, so
+// growth leaves no stale copy of a key behind; the caller wipes Bytes() once
+// it is done.
+type secretBuffer struct {
+	buf []byte
+}
+
+// grow makes room for n more bytes.
+func (b *secretBuffer) grow(n int) {
+	if len(b.buf)+n <= cap(b.buf) {
+		return
+	}
+	next := make([]byte, len(b.buf), max(2*cap(b.buf)+n, 512))
+	copy(next, b.buf)
+	wipe(b.buf[:cap(b.buf)])
+	b.buf = next
+}
+
+// Write implements io.Writer.
+func (b *secretBuffer) Write(p []byte) (int, error) {
+	b.grow(len(p))
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+// WriteString appends s.
+func (b *secretBuffer) WriteString(s string) {
+	b.grow(len(s))
+	b.buf = append(b.buf, s...)
+}
+
+// WriteByte implements io.ByteWriter.
+func (b *secretBuffer) WriteByte(c byte) error {
+	b.grow(1)
+	b.buf = append(b.buf, c)
+	return nil
+}
+
+// Bytes returns the text written so far.
+func (b *secretBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// Len returns the number of bytes written so far.
+func (b *secretBuffer) Len() int {
+	return len(b.buf)
+}
+
+// deriveConfigKey runs scrypt over passphrase with the envelope parameters.
+func deriveConfigKey(passphrase, salt []byte, logN, r, p int) ([]byte, error) {
+	if logN < 10 || logN > 22 || r < 1 || p < 1 {
+		return nil, errEncCorrupt
+	}
+	return scrypt.Key(passphrase, salt, 1<<logN, r, p, chacha20poly1305.KeySize)
+}
+
+// configPassphrase reads the passphrase from the keyfile (trailing line
+// endings stripped) or the environment. The caller wipes the returned slice.
+func configPassphrase() ([]byte, error) {
+	if path := os.Getenv(envKeyFile); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envKeyFile, err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if pass := os.Getenv(envPassphrase); pass != "" {
+		return []byte(pass), nil
+	}
+	return nil, errEncNoPassphrase
+}
+
+// EncryptConfig seals plaintext wg.conf data into an encrypted envelope
+// using a key derived from passphrase.
+func EncryptConfig(plaintext, passphrase []byte) ([]byte, error) {
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	header[len(encMagic)] = encDefaultLogN
+	header[len(encMagic)+1] = encDefaultR
+	header[len(encMagic)+2] = encDefaultP
+	saltAndNonce := header[len(encMagic)+3:]
+	if _, err := rand.Read(saltAndNonce); err != nil {
+		return nil, err
+	}
+	salt := saltAndNonce[:encSaltSize]
+	nonce := saltAndNonce[encSaltSize:]
+
+	key, err := deriveConfigKey(passphrase, salt, encDefaultLogN, encDefaultR, encDefaultP)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// DecryptConfig opens an envelope produced by EncryptConfig.
+func DecryptConfig(envelope, passphrase []byte) ([]byte, error) {
+	if !isEncryptedConfig(envelope) || len(envelope) < encHeaderSize+chacha20poly1305.Overhead {
+		return nil, errEncCorrupt
+	}
+	header := envelope[:encHeaderSize]
+	params := header[len(encMagic):]
+	salt := params[3 : 3+encSaltSize]
+	nonce := params[3+encSaltSize:]
+
+	key, err := deriveConfigKey(passphrase, salt, int(params[0]), int(params[1]), int(params[2]))
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, envelope[encHeaderSize:], header)
+	if err != nil {
+		return nil, errEncAuth
+	}
+	return plaintext, nil
+}
+
+// openConfig returns the plain config text for src, decrypting it with the
+// environment-supplied passphrase when it is an encrypted envelope.
+func openConfig(src *configSource) ([]byte, error) {
+	if !isEncryptedConfig(src.Data) {
+		return src.Data, nil
+	}
+	passphrase, err := configPassphrase()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Name, err)
+	}
+	defer wipe(passphrase)
+
+	plaintext, err := DecryptConfig(src.Data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", src.Name, err)
+	}
+	return plaintext, nil
+}
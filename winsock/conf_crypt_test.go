@@ -0,0 +1,92 @@
+package winsock
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestConfigEnvelopeRoundTrip(t *testing.T) {
+	plain := []byte("[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nAddress = 10.0.0.2/32\n")
+	pass := []byte("correct horse")
+
+	envelope, err := EncryptConfig(plain, pass)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !isEncryptedConfig(envelope) {
+		t.Fatal("envelope does not start with the magic")
+	}
+	if bytes.Contains(envelope, []byte("PrivateKey")) {
+		t.Fatal("envelope contains the plaintext")
+	}
+
+	got, err := DecryptConfig(envelope, pass)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("decrypt = %q, want %q", got, plain)
+	}
+
+	tests := []struct {
+		name     string
+		envelope []byte
+		pass     string
+		want     error
+	}{
+		{"wrong passphrase", envelope, "wrong horse", errEncAuth},
+		{"tampered header", flipByte(envelope, len(encMagic)+3), "correct horse", errEncAuth},
+		{"tampered ciphertext", flipByte(envelope, len(envelope)-1), "correct horse", errEncAuth},
+		{"truncated", envelope[:encHeaderSize], "correct horse", errEncCorrupt},
+		{"bad cost", setByte(envelope, len(encMagic), 40), "correct horse", errEncCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecryptConfig(tt.envelope, []byte(tt.pass))
+			if !errors.Is(err, tt.want) || got != nil {
+				t.Fatalf("decrypt = %q, %v, want error %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// flipByte returns a copy of b with byte i inverted.
+func flipByte(b []byte, i int) []byte {
+	return setByte(b, i, ^b[i])
+}
+
+// setByte returns a copy of b with byte i set to v.
+func setByte(b []byte, i int, v byte) []byte {
+	b = bytes.Clone(b)
+	b[i] = v
+	return b
+}
+
+func TestSecretBufferWipesOnGrowth(t *testing.T) {
+	var key wgKey
+	for i := range key {
+		key[i] = 0xAB
+	}
+	var b secretBuffer
+	key.writeUAPI(&b, "private_key")
+	old := b.Bytes()[:cap(b.Bytes())]
+
+	// Enough allowed IPs to outgrow any fixed per-peer estimate
+	peer := WGPeer{}
+	for i := 0; i < 64; i++ {
+		peer.AllowedIPs = append(peer.AllowedIPs, netip.MustParsePrefix("10.0.0.0/8"))
+	}
+	peer.writeAllowedIPsUAPI(&b)
+
+	if cap(b.Bytes()) == len(old) {
+		t.Fatal("buffer did not grow")
+	}
+	if bytes.ContainsFunc(old, func(r rune) bool { return r != 0 }) {
+		t.Fatal("old array still holds key material after growth")
+	}
+	if !bytes.HasPrefix(b.Bytes(), []byte("private_key="+key.Hex()+"\n")) {
+		t.Fatalf("body starts %q", b.Bytes()[:80])
+	}
+}
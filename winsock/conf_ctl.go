@@ -1,15 +1,17 @@
 // conf_ctl.go — Socket configuration and I/O control. Implements setsockopt and
 // getsockopt with a dispatch table that stores options per-socket and applies them
 // to live connections (SO_KEEPALIVE, SO_LINGER, SO_RCVTIMEO, SO_SNDTIMEO,
-// SO_RCVBUF, SO_SNDBUF, TCP_NODELAY, SO_REUSEADDR, SO_ERROR, SO_TYPE). Also
-// implements ioctlsocket (FIONBIO, FIONREAD, SIOCATMARK), WSAIoctl
-// (SIO_GET_EXTENSION_FUNCTION_POINTER, SIO_KEEPALIVE_VALS), and WSANSPIoctl.
+// SO_RCVBUF, SO_SNDBUF, TCP_NODELAY, SO_REUSEADDR, SO_ERROR, SO_TYPE,
+// IPV6_V6ONLY). Also implements ioctlsocket (FIONBIO, FIONREAD, SIOCATMARK),
+// WSAIoctl (SIO_GET_EXTENSION_FUNCTION_POINTER, SIO_KEEPALIVE_VALS), and
+// WSANSPIoctl.
 
 package winsock
 
 import (
 	"encoding/binary"
 	"net"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -39,9 +41,10 @@ var (
 
 // Socket option level constants
 const (
-	SOL_SOCKET  = 0xFFFF
-	IPPROTO_IP  = 0
-	IPPROTO_TCP = 6
+	SOL_SOCKET   = 0xFFFF
+	IPPROTO_IP   = 0
+	IPPROTO_TCP  = 6
+	IPPROTO_IPV6 = 41
 )
 
 // Socket option name constants (SOL_SOCKET level)
@@ -63,6 +66,11 @@ const (
 	IP_TOS = 3
 )
 
+// Socket option name constants (IPPROTO_IPV6 level)
+const (
+	IPV6_V6ONLY = 27
+)
+
 // Socket option name constants (IPPROTO_TCP level)
 const (
 	TCP_NODELAY = 0x0001
@@ -76,19 +84,28 @@ type lingerOpt struct {
 }
 
 // GoSetsockopt stores the option and applies it to the underlying connection where possible.
-func GoSetsockopt(s uint64, level int32, optname int32, optval unsafe.Pointer, optlen int32) int32 {
+func GoSetsockopt(t Thread, s uint64, level int32, optname int32, optval unsafe.Pointer, optlen int32) int32 {
 	LogCall("Setsockopt", s, level, optname, optval, optlen)
 
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 	if optval == nil || optlen <= 0 {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
+	// IPV6_V6ONLY selects the endpoint families, so like Windows it is only
+	// accepted on AF_INET6 sockets before bind, connect or listen.
+	if level == IPPROTO_IPV6 && optname == IPV6_V6ONLY {
+		if st.AddressFamily != AF_INET6 || optlen < 4 || st.BoundAddr.IsValid() || st.Conn != nil || st.Listener != nil {
+			t.setLastError(WSAEINVAL)
+			return -1
+		}
+	}
+
 	// Store raw option bytes
 	raw := make([]byte, int(optlen))
 	copy(raw, unsafe.Slice((*byte)(optval), int(optlen)))
@@ -101,25 +118,24 @@ func GoSetsockopt(s uint64, level int32, optname int32, optval unsafe.Pointer, o
 }
 
 // GoGetsockopt retrieves a stored socket option value.
-func GoGetsockopt(s uint64, level int32, optname int32, optval unsafe.Pointer, optlen *int32) int32 {
+func GoGetsockopt(t Thread, s uint64, level int32, optname int32, optval unsafe.Pointer, optlen *int32) int32 {
 	LogCall("Getsockopt", s, level, optname, optval, optlen)
 
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 	if optval == nil || optlen == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
 	// Handle special computed options first
 	switch {
 	case level == SOL_SOCKET && optname == SO_ERROR:
-		// Return and clear the last error
-		errCode := st.LastErrorCode
-		st.LastErrorCode = 0
+		// Return and clear the pending socket error
+		errCode := atomic.SwapInt32(&st.LastErrorCode, 0)
 		if *optlen >= 4 {
 			*(*int32)(optval) = errCode
 			*optlen = 4
@@ -136,6 +152,21 @@ func GoGetsockopt(s uint64, level int32, optname int32, optval unsafe.Pointer, o
 			*optlen = 4
 		}
 		return 0
+
+	case level == IPPROTO_IPV6 && optname == IPV6_V6ONLY:
+		if st.AddressFamily != AF_INET6 {
+			t.setLastError(WSAEINVAL)
+			return -1
+		}
+		if *optlen >= 4 {
+			v6only := int32(0)
+			if st.V6Only {
+				v6only = 1
+			}
+			*(*int32)(optval) = v6only
+			*optlen = 4
+		}
+		return 0
 	}
 
 	// Look up stored option
@@ -168,6 +199,8 @@ func applySockOpt(st *SocketState, level, optname int32, val []byte) {
 		applySolSocketOpt(st, optname, val)
 	case IPPROTO_IP:
 		applyIPOpt(st, optname, val)
+	case IPPROTO_IPV6:
+		applyIPv6Opt(st, optname, val)
 	case IPPROTO_TCP:
 		applyTCPOpt(st, optname, val)
 	}
@@ -199,21 +232,25 @@ func applySolSocketOpt(st *SocketState, optname int32, val []byte) {
 		if len(val) >= 4 && st.Conn != nil {
 			// DWORD milliseconds on Windows
 			ms := binary.LittleEndian.Uint32(val)
+			st.rxMu.Lock()
 			if ms > 0 {
-				st.Conn.SetReadDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond))
+				st.setReadDeadline(st.Conn, time.Now().Add(time.Duration(ms)*time.Millisecond))
 			} else {
-				st.Conn.SetReadDeadline(time.Time{}) // no deadline
+				st.setReadDeadline(st.Conn, time.Time{}) // no deadline
 			}
+			st.rxMu.Unlock()
 		}
 
 	case SO_SNDTIMEO:
 		if len(val) >= 4 && st.Conn != nil {
 			ms := binary.LittleEndian.Uint32(val)
+			st.txMu.Lock()
 			if ms > 0 {
-				st.Conn.SetWriteDeadline(time.Now().Add(time.Duration(ms) * time.Millisecond))
+				st.setWriteDeadline(st.Conn, time.Now().Add(time.Duration(ms)*time.Millisecond))
 			} else {
-				st.Conn.SetWriteDeadline(time.Time{})
+				st.setWriteDeadline(st.Conn, time.Time{})
 			}
+			st.txMu.Unlock()
 		}
 
 	case SO_RCVBUF:
@@ -258,6 +295,16 @@ func applyIPOpt(st *SocketState, optname int32, val []byte) {
 	}
 }
 
+func applyIPv6Opt(st *SocketState, optname int32, val []byte) {
+	switch optname {
+	case IPV6_V6ONLY:
+		// Consulted when the endpoint is created (see dualstack.go)
+		if len(val) >= 4 {
+			st.V6Only = binary.LittleEndian.Uint32(val) != 0
+		}
+	}
+}
+
 func applyTCPOpt(st *SocketState, optname int32, val []byte) {
 	switch optname {
 	case TCP_NODELAY:
@@ -276,19 +323,19 @@ func applyTCPOpt(st *SocketState, optname int32, val []byte) {
 }
 
 // goIoctlsocket controls the I/O mode of a socket.
-func GoIoctlsocket(s uint64, cmd int32, argp *uint32) int32 {
+func GoIoctlsocket(t Thread, s uint64, cmd int32, argp *uint32) int32 {
 	LogCall("Ioctlsocket", s, cmd, argp)
 
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
 	switch uint32(cmd) {
 	case FIONBIO:
 		if argp == nil {
-			setLastError(WSAEFAULT)
+			t.setLastError(WSAEFAULT)
 			return -1
 		}
 		st.IsNonBlocking = (*argp != 0)
@@ -297,7 +344,7 @@ func GoIoctlsocket(s uint64, cmd int32, argp *uint32) int32 {
 	case FIONREAD:
 		// Return bytes available to read
 		if argp == nil {
-			setLastError(WSAEFAULT)
+			t.setLastError(WSAEFAULT)
 			return -1
 		}
 		// We can't directly query Go net.Conn for available bytes without reading.
@@ -308,7 +355,7 @@ func GoIoctlsocket(s uint64, cmd int32, argp *uint32) int32 {
 	case SIOCATMARK:
 		// OOB mark check — no OOB support in Go net, always return 0 (not at mark)
 		if argp == nil {
-			setLastError(WSAEFAULT)
+			t.setLastError(WSAEFAULT)
 			return -1
 		}
 		*argp = 0
@@ -319,19 +366,19 @@ func GoIoctlsocket(s uint64, cmd int32, argp *uint32) int32 {
 }
 
 // goWSAIoctl controls the I/O mode of a socket (extended).
-func GoWSAIoctl(s uint64, dwIoControlCode uint32, lpvInBuffer unsafe.Pointer, cbInBuffer uint32, lpvOutBuffer unsafe.Pointer, cbOutBuffer uint32, lpcbBytesReturned *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSAIoctl(t Thread, s uint64, dwIoControlCode uint32, lpvInBuffer unsafe.Pointer, cbInBuffer uint32, lpvOutBuffer unsafe.Pointer, cbOutBuffer uint32, lpcbBytesReturned *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSAIoctl", s, dwIoControlCode, lpvInBuffer, cbInBuffer, lpvOutBuffer, cbOutBuffer, lpcbBytesReturned, lpOverlapped, lpCompletionRoutine)
 
 	_, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
 	switch dwIoControlCode {
 	case SIO_GET_EXTENSION_FUNCTION_POINTER:
 		if lpvInBuffer == nil || cbInBuffer < 16 || lpvOutBuffer == nil || cbOutBuffer < uint32(unsafe.Sizeof(uintptr(0))) {
-			setLastError(WSAEFAULT)
+			t.setLastError(WSAEFAULT)
 			return -1
 		}
 		guid := *(*[16]byte)(lpvInBuffer)
@@ -350,7 +397,7 @@ func GoWSAIoctl(s uint64, dwIoControlCode uint32, lpvInBuffer unsafe.Pointer, cb
 			return 0
 		}
 
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 
 	case SIO_KEEPALIVE_VALS:
@@ -382,8 +429,8 @@ func GoWSAIoctl(s uint64, dwIoControlCode uint32, lpvInBuffer unsafe.Pointer, cb
 }
 
 // goWSANSPIoctl performs I/O control for a namespace provider.
-func GoWSANSPIoctl(hLookup unsafe.Pointer, dwControlCode uint32, lpvInBuffer unsafe.Pointer, cbInBuffer uint32, lpvOutBuffer unsafe.Pointer, cbOutBuffer uint32, lpcbBytesReturned *uint32, lpCompletion unsafe.Pointer) int32 {
+func GoWSANSPIoctl(t Thread, hLookup unsafe.Pointer, dwControlCode uint32, lpvInBuffer unsafe.Pointer, cbInBuffer uint32, lpvOutBuffer unsafe.Pointer, cbOutBuffer uint32, lpcbBytesReturned *uint32, lpCompletion unsafe.Pointer) int32 {
 	LogCall("WSANSPIoctl", hLookup, dwControlCode, lpvInBuffer, cbInBuffer, lpvOutBuffer, cbOutBuffer, lpcbBytesReturned, lpCompletion)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return -1
 }
@@ -0,0 +1,140 @@
+// conf_discovery.go — WireGuard configuration discovery. Locates the config to
+// load when the application did not name one, trying in order: the
+// KLINIKAL_CONFIG environment variable (a file, or a directory to search), the
+// directory of the loaded DLL, the process working directory, and finally a
+// config embedded at build time from winsock/embedded/. Each directory is
+// searched for a per-process profile first (wg.<exe>.conf, keyed by the host
+// executable name or KLINIKAL_PROFILE) and then the shared wg.conf, so one DLL
+// build can route different applications through different tunnels. Encrypted
+// configs (see conf_crypt.go) may use the same names or a ".enc" suffix.
+package winsock
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables consulted during discovery
+const (
+	envConfig  = "KLINIKAL_CONFIG"
+	envProfile = "KLINIKAL_PROFILE"
+)
+
+// defaultConfigName is the shared config file name searched in every location.
+const defaultConfigName = "wg.conf"
+
+// embeddedConfigs holds configs compiled into the DLL. Drop wg.conf and/or
+// wg.<exe>.conf into winsock/embedded/ before building to ship them inside
+// the binary.
+//
+//go:embed embedded
+var embeddedConfigs embed.FS
+
+// configSource is a located configuration: Name labels diagnostics, Data is
+// the raw file contents.
+type configSource struct {
+	Name string
+	Data []byte
+}
+
+// errNoConfig reports that no location in the discovery chain had a config.
+var errNoConfig = errors.New("no WireGuard config found")
+
+// processProfile returns the profile name for this process: KLINIKAL_PROFILE
+// when set, otherwise the lowercased executable name without extension.
+func processProfile() string {
+	if p := strings.TrimSpace(os.Getenv(envProfile)); p != "" {
+		return p
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	base := filepath.Base(exe)
+	return strings.ToLower(strings.TrimSuffix(base, filepath.Ext(base)))
+}
+
+// configNames returns the file names to try in each directory, most specific
+// first. Each name may also exist as an encrypted ".enc" variant.
+func configNames(profile string) []string {
+	bases := []string{defaultConfigName}
+	if profile != "" {
+		bases = []string{"wg." + profile + ".conf", defaultConfigName}
+	}
+	var names []string
+	for _, base := range bases {
+		names = append(names, base, base+".enc")
+	}
+	return names
+}
+
+// readConfigIn returns the first config from names found in dir.
+func readConfigIn(dir string, names []string) (*configSource, bool, error) {
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		data, err := os.ReadFile(p)
+		if err == nil {
+			return &configSource{Name: p, Data: data}, true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, false, fmt.Errorf("reading %s: %w", p, err)
+		}
+	}
+	return nil, false, nil
+}
+
+// discoverConfig walks the discovery chain and returns the first config found.
+// searched lists every location tried, for the not-found diagnostic.
+func discoverConfig() (*configSource, error) {
+	names := configNames(processProfile())
+	var searched []string
+
+	if env := strings.TrimSpace(os.Getenv(envConfig)); env != "" {
+		info, err := os.Stat(env)
+		if err != nil {
+			// An explicit override that is wrong should not fall through silently
+			return nil, fmt.Errorf("%s=%s: %w", envConfig, env, err)
+		}
+		if !info.IsDir() {
+			data, err := os.ReadFile(env)
+			if err != nil {
+				return nil, fmt.Errorf("%s=%s: %w", envConfig, env, err)
+			}
+			return &configSource{Name: env, Data: data}, nil
+		}
+		if src, ok, err := readConfigIn(env, names); ok || err != nil {
+			return src, err
+		}
+		searched = append(searched, env)
+	}
+
+	var dirs []string
+	if dir, err := moduleDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+	if wd, err := os.Getwd(); err == nil {
+		dirs = append(dirs, wd)
+	}
+	for _, dir := range dirs {
+		if src, ok, err := readConfigIn(dir, names); ok || err != nil {
+			return src, err
+		}
+		searched = append(searched, dir)
+	}
+
+	for _, name := range names {
+		data, err := embeddedConfigs.ReadFile(path.Join("embedded", name))
+		if err == nil {
+			return &configSource{Name: "embedded:" + name, Data: data}, nil
+		}
+	}
+	searched = append(searched, "embedded")
+
+	return nil, fmt.Errorf("%w (looked for %s in %s)", errNoConfig, strings.Join(names, ", "), strings.Join(searched, ", "))
+}
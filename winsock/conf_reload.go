@@ -0,0 +1,449 @@
+// conf_reload.go — Hot reload of the WireGuard configuration. ReloadStack
+// re-reads the config the stack was started from, diffs it against the applied
+// one and pushes only the difference to the running device through an
+// incremental UAPI set (private key, listen port, fwmark, and per-peer add /
+// remove / update_only with replace_allowed_ips). Tunnels are matched by name;
+// added and removed tunnels are started and stopped. Interface addresses and
+// DNS servers are swapped on the live gVisor stack, so sockets on addresses
+// that did not change keep running. Only an MTU change or adding/removing an
+// address family needs a full restart of that tunnel, which closes the network
+// side of its sockets. A background watcher polls the config file and reloads
+// it on change; set KLINIKAL_WATCH=0 to disable it.
+package winsock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// configWatchInterval is how often the watcher checks the config file.
+const configWatchInterval = 2 * time.Second
+
+// watchEnabled is KLINIKAL_WATCH, defaulting to on.
+var watchEnabled = parseBoolDefault(os.Getenv("KLINIKAL_WATCH"), true)
+
+// parseBoolDefault parses s with strconv.ParseBool, returning def when s is
+// empty or malformed.
+func parseBoolDefault(s string, def bool) bool {
+	if v, err := strconv.ParseBool(s); err == nil {
+		return v
+	}
+	return def
+}
+
+// appliedPeer is the non-secret view of a peer kept for diffing reloads.
+type appliedPeer struct {
+	Endpoint            string
+	Transport           string
+	AllowedIPs          []netip.Prefix
+	PersistentKeepalive int
+	PresharedDigest     [32]byte // SHA-256 of the preshared key; zero when none
+}
+
+// appliedConfig records what the running device was configured with. Secret
+// keys are kept only as digests so the config itself can be wiped.
+type appliedConfig struct {
+	PrivateDigest [32]byte
+	ListenPort    int
+	FwMark        uint32
+	MTU           int
+	Addresses     []netip.Prefix
+	Peers         map[wgKey]appliedPeer
+}
+
+func newAppliedConfig(cfg *WGConfig) *appliedConfig {
+	a := &appliedConfig{
+		PrivateDigest: sha256.Sum256(cfg.Interface.PrivateKey[:]),
+		ListenPort:    cfg.Interface.ListenPort,
+		FwMark:        cfg.Interface.FwMark,
+		MTU:           cfg.Interface.MTU,
+		Addresses:     cfg.Interface.Addresses,
+		Peers:         make(map[wgKey]appliedPeer, len(cfg.Peers)),
+	}
+	for i := range cfg.Peers {
+		a.Peers[cfg.Peers[i].PublicKey] = newAppliedPeer(&cfg.Peers[i])
+	}
+	return a
+}
+
+func newAppliedPeer(peer *WGPeer) appliedPeer {
+	ap := appliedPeer{
+		Endpoint:            peer.Endpoint,
+		Transport:           peer.Transport,
+		AllowedIPs:          peer.AllowedIPs,
+		PersistentKeepalive: peer.PersistentKeepalive,
+	}
+	if peer.HasPresharedKey {
+		ap.PresharedDigest = sha256.Sum256(peer.PresharedKey[:])
+	}
+	return ap
+}
+
+// routes returns the union of the applied peers' AllowedIPs, as
+// WGConfig.Routes does for a parsed config.
+func (a *appliedConfig) routes() []netip.Prefix {
+	var routes []netip.Prefix
+	for _, peer := range a.Peers {
+		if len(peer.AllowedIPs) == 0 {
+			routes = append(routes, netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+			continue
+		}
+		routes = append(routes, peer.AllowedIPs...)
+	}
+	return routes
+}
+
+// addrFamilies reports which address families the interface has.
+func addrFamilies(prefixes []netip.Prefix) (v4, v6 bool) {
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4 = true
+		} else {
+			v6 = true
+		}
+	}
+	return v4, v6
+}
+
+// needsRestart reports whether moving from a to next cannot be done on the
+// live stack: netstack fixes the MTU and per-family default routes at creation.
+func (a *appliedConfig) needsRestart(next *appliedConfig) bool {
+	if a.MTU != next.MTU {
+		return true
+	}
+	oldV4, oldV6 := addrFamilies(a.Addresses)
+	newV4, newV6 := addrFamilies(next.Addresses)
+	return oldV4 != newV4 || oldV6 != newV6
+}
+
+// ipcDelta builds the incremental UAPI body turning a into cfg. An empty
+// result means the device needs no change. The caller wipes the body.
+func (a *appliedConfig) ipcDelta(cfg *WGConfig, next *appliedConfig) ([]byte, error) {
+	var request secretBuffer
+
+	if a.PrivateDigest != next.PrivateDigest {
+		cfg.Interface.PrivateKey.writeUAPI(&request, "private_key")
+	}
+	if a.ListenPort != next.ListenPort {
+		fmt.Fprintf(&request, "listen_port=%d\n", next.ListenPort)
+	}
+	if a.FwMark != next.FwMark {
+		fmt.Fprintf(&request, "fwmark=%d\n", next.FwMark)
+	}
+
+	for pub := range a.Peers {
+		if _, ok := next.Peers[pub]; !ok {
+			pub.writeUAPI(&request, "public_key")
+			request.WriteString("remove=true\n")
+		}
+	}
+
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		want := next.Peers[peer.PublicKey]
+		have, existed := a.Peers[peer.PublicKey]
+
+		var body secretBuffer
+		if !existed || have.PresharedDigest != want.PresharedDigest {
+			// An all-zero preshared_key clears it on the device
+			peer.PresharedKey.writeUAPI(&body, "preshared_key")
+		}
+		if !existed || have.Endpoint != want.Endpoint || have.Transport != want.Transport {
+			if err := peer.writeEndpointUAPI(&body); err != nil {
+				wipe(body.Bytes())
+				wipe(request.Bytes())
+				return nil, err
+			}
+		}
+		if !existed || have.PersistentKeepalive != want.PersistentKeepalive {
+			fmt.Fprintf(&body, "persistent_keepalive_interval=%d\n", want.PersistentKeepalive)
+		}
+		if !existed || !slices.Equal(have.AllowedIPs, want.AllowedIPs) {
+			peer.writeAllowedIPsUAPI(&body)
+		}
+		if body.Len() == 0 {
+			continue
+		}
+
+		peer.PublicKey.writeUAPI(&request, "public_key")
+		if existed {
+			request.WriteString("update_only=true\n")
+		}
+		request.Write(body.Bytes())
+		wipe(body.Bytes())
+	}
+
+	return request.Bytes(), nil
+}
+
+// applyAddresses moves the stack's interface addresses from old to next,
+// leaving addresses present in both untouched.
+func applyAddresses(tnet *netstack.Net, old, next []netip.Prefix) error {
+	s := GetTCPIPStack(tnet)
+	if s == nil {
+		return errors.New("netstack internals unavailable")
+	}
+
+	has := func(list []netip.Prefix, ip netip.Addr) bool {
+		return slices.ContainsFunc(list, func(p netip.Prefix) bool { return p.Addr() == ip })
+	}
+
+	for _, p := range old {
+		if !has(next, p.Addr()) {
+			if tcpipErr := s.RemoveAddress(1, tcpip.AddrFromSlice(p.Addr().AsSlice())); tcpipErr != nil {
+				return fmt.Errorf("RemoveAddress(%v): %v", p.Addr(), tcpipErr)
+			}
+		}
+	}
+	for _, p := range next {
+		if has(old, p.Addr()) {
+			continue
+		}
+		proto := ipv4.ProtocolNumber
+		if p.Addr().Is6() {
+			proto = ipv6.ProtocolNumber
+		}
+		protoAddr := tcpip.ProtocolAddress{
+			Protocol:          proto,
+			AddressWithPrefix: tcpip.AddrFromSlice(p.Addr().AsSlice()).WithPrefix(),
+		}
+		if tcpipErr := s.AddProtocolAddress(1, protoAddr, stack.AddressProperties{}); tcpipErr != nil {
+			return fmt.Errorf("AddProtocolAddress(%v): %v", p.Addr(), tcpipErr)
+		}
+	}
+	return nil
+}
+
+// tunnelReload is the prepared change for one tunnel of the new config.
+type tunnelReload struct {
+	cfg     *WGConfig
+	proxy   *ProxyConfig // [Proxy] of the new config; nil = direct
+	old     *tunnel      // running tunnel with the same name; nil if new
+	next    *appliedConfig
+	restart bool
+	request []byte // incremental UAPI body when not restarting
+}
+
+// apply carries out the change. The returned tunnel, if non-nil, is running
+// and stays published even when an error is also returned.
+func (pl *tunnelReload) apply() (*tunnel, error) {
+	if pl.old == nil {
+		return startTunnel(pl.cfg, pl.proxy)
+	}
+
+	t := pl.old
+	if pl.restart {
+		// The stack itself has to be rebuilt; sockets on it cannot survive
+		registry.DropConnections(t.Backend)
+		t.stop()
+		return startTunnel(pl.cfg, pl.proxy)
+	}
+
+	if t.bind.setProxy(pl.proxy) {
+		// Reopen the bind on the new path; the peers keep their endpoints
+		if err := t.Device.BindUpdate(); err != nil {
+			return t, fmt.Errorf("failed to switch proxy: %w", err)
+		}
+	}
+	t.bind.setObfuscation(pl.cfg.Interface.Obfuscation)
+	if len(pl.request) > 0 {
+		if err := t.Device.IpcSetOperation(bytes.NewReader(pl.request)); err != nil {
+			return t, fmt.Errorf("failed to set device IPC: %w", err)
+		}
+	}
+	if err := applyAddresses(t.Net, t.applied.Addresses, pl.next.Addresses); err != nil {
+		return t, err
+	}
+	if b, ok := t.Backend.(*netstackBackend); !ok || !b.setDNS(pl.cfg.Interface.DNS) {
+		return t, errors.New("netstack internals unavailable")
+	}
+	t.setConfig(pl.cfg)
+	t.kickResolver()
+	t.startUAPI(&pl.cfg.Interface)
+	return t, nil
+}
+
+// reloadMu serializes reloads, which load the new config and resolve its peer
+// endpoints before taking stackMu so socket calls are not stalled meanwhile.
+var reloadMu sync.Mutex
+
+// ReloadStack re-reads the active configuration and applies any changes to
+// the running tunnels, matched by name: new tunnels are started, removed ones
+// stopped, and changed ones updated in place where possible. A config that
+// fails to load, parse or resolve leaves every running tunnel untouched.
+func ReloadStack() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	stackMu.RLock()
+	load := globalLoader
+	running := stackInitialized
+	stackMu.RUnlock()
+	if !running || load == nil {
+		return errors.New("stack not initialized")
+	}
+
+	src, err := load()
+	if err != nil {
+		return err
+	}
+	file, err := loadResolvedConfig(src)
+	if err != nil {
+		return err
+	}
+	defer file.Wipe()
+
+	stackMu.Lock()
+	defer stackMu.Unlock()
+	if !stackInitialized || globalLoader == nil {
+		// Stopped while the config was being loaded
+		return errors.New("stack not initialized")
+	}
+	_, err = reloadStackLocked(src.Name, file)
+	return err
+}
+
+// loadResolvedConfig loads src like loadConfig and resolves the peer endpoints
+// of every tunnel in it: the slow part of a reload, done without stackMu. The
+// caller wipes the returned file.
+func loadResolvedConfig(src *configSource) (*ConfigFile, error) {
+	file, err := loadConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfg := range file.Tunnels {
+		cfg.ResolveEndpoints()
+	}
+	return file, nil
+}
+
+// reloadStackLocked applies file, loaded from the config named name, to the
+// running tunnels. applied is false when the config was rejected before
+// anything was changed. Caller holds stackMu.
+func reloadStackLocked(name string, file *ConfigFile) (applied bool, err error) {
+	cfgs := file.Tunnels
+	LogCall("ReloadStack", name)
+
+	running := make(map[string]*tunnel, len(globalTunnels))
+	for _, t := range globalTunnels {
+		running[t.Name] = t
+	}
+
+	// Prepare every change first so that a bad endpoint aborts the reload
+	// before anything has been touched
+	plans := make([]*tunnelReload, 0, len(cfgs))
+	defer func() {
+		for _, pl := range plans {
+			wipe(pl.request)
+		}
+	}()
+	for _, cfg := range cfgs {
+		pl := &tunnelReload{cfg: cfg, proxy: file.Proxy, old: running[cfg.Interface.Name], next: newAppliedConfig(cfg)}
+		plans = append(plans, pl)
+		if pl.old == nil {
+			continue
+		}
+		if pl.old.applied.needsRestart(pl.next) {
+			pl.restart = true
+			continue
+		}
+		pl.request, err = pl.old.applied.ipcDelta(cfg, pl.next)
+		if err != nil {
+			return false, fmt.Errorf("tunnel %s: invalid WG config: %w", cfg.Interface.Name, err)
+		}
+		delete(running, cfg.Interface.Name)
+	}
+
+	// Whatever is left in running was removed from the config (or renamed)
+	for _, pl := range plans {
+		if pl.restart {
+			delete(running, pl.cfg.Interface.Name)
+		}
+	}
+	for _, t := range running {
+		registry.DropConnections(t.Backend)
+		t.stop()
+	}
+
+	var tunnels []*tunnel
+	var errs []error
+	for _, pl := range plans {
+		t, err := pl.apply()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %s: %w", pl.cfg.Interface.Name, err))
+		}
+		if t != nil {
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	globalTunnels = tunnels
+	globalSplit = file.Split
+	stackInitialized = len(tunnels) > 0
+	globalSource = name
+	kickHealth()
+	return true, errors.Join(errs...)
+}
+
+// startConfigWatcher polls the active config file and reloads the stack when
+// its size or modification time changes. It exits when stop is closed.
+func startConfigWatcher(stop chan struct{}) {
+	if !watchEnabled {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+
+		var lastPath string
+		var lastMod time.Time
+		var lastSize int64
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			stackMu.RLock()
+			path := globalSource
+			stackMu.RUnlock()
+			if path == "" || strings.HasPrefix(path, "embedded:") || strings.HasPrefix(path, "memory:") {
+				continue
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if path != lastPath {
+				lastPath, lastMod, lastSize = path, info.ModTime(), info.Size()
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+
+			if err := ReloadStack(); err != nil {
+				LogCall("ReloadStackFailed", err)
+			}
+		}
+	}()
+}
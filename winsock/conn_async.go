@@ -0,0 +1,130 @@
+// conn_async.go — Non-blocking connect. A TCP connect on a non-blocking socket
+// (FIONBIO, or WSAEventSelect) returns WSAEWOULDBLOCK at once and dials in the
+// background. The outcome is reported as Winsock reports it: success makes the
+// socket writable (select writefds, WSAPoll POLLWRNORM) and posts FD_CONNECT;
+// failure puts the socket in select's exceptfds, sets POLLERR, posts FD_CONNECT
+// with the error in iErrorCode[FD_CONNECT_BIT] and leaves it in SO_ERROR. The
+// socket is in StateConnecting meanwhile, so another connect fails with
+// WSAEALREADY (see sock_state.go). closesocket aborts a dial in progress. In
+// on-demand mode, bringing the stack up is part of the background work.
+package winsock
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// connectAsync dials addr on backend for st in the background. A nil backend
+// is chosen in the background too, for a socket whose on-demand stack is
+// still down (see stackAsleep).
+func connectAsync(st *SocketState, backend Backend, addr netip.AddrPort) {
+	ctx, cancel := context.WithCancel(context.Background())
+	st.stateMu.Lock()
+	prev := st.State
+	st.State = StateConnecting
+	st.cancelConnect = cancel
+	st.stateMu.Unlock()
+
+	go func() {
+		defer cancel()
+		var err error
+		if backend == nil {
+			backend, err = socketBackend(st, addr.Addr())
+			if err == nil {
+				err = checkRoute(backend, addr.Addr())
+			}
+		}
+		if err == nil {
+			err = backendReady(backend)
+		}
+		var conn net.Conn
+		if err == nil {
+			conn, err = backend.DialTCP(ctx, st, addr)
+		}
+
+		st.stateMu.Lock()
+		st.State = prev
+		st.cancelConnect = nil
+		if cur, ok := registry.Get(st.Handle); !ok || cur != st {
+			// Closed while dialing
+			st.stateMu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			st.State = StateConnected
+			st.Conn = conn
+			st.Backend = backend
+			UpdateWaiterQueue(st)
+			applyPendingOpts(st)
+		}
+		st.stateMu.Unlock()
+
+		st.connectDone(mapError(err))
+	}()
+}
+
+// abortConnect cancels a background connect in progress on st, if any.
+func (st *SocketState) abortConnect() {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	if st.cancelConnect != nil {
+		st.cancelConnect()
+	}
+}
+
+// connectDone reports the outcome of a connect, 0 for success: FD_CONNECT
+// carrying the code, and for a failure select's exceptfds, WSAPoll's POLLERR
+// and SO_ERROR. Waiting select and WSAPoll calls are woken.
+func (st *SocketState) connectDone(errCode int32) {
+	if errCode != 0 {
+		atomic.StoreInt32(&st.LastErrorCode, errCode)
+	}
+	atomic.StoreInt32(&st.ConnectError, errCode)
+	atomic.StoreInt32(&st.EventErrors[FD_CONNECT_BIT], errCode)
+	st.fireEvents(FD_CONNECT)
+	st.StateQueue.Notify(waiter.EventOut | waiter.EventErr)
+}
+
+// pollView returns what select and WSAPoll inspect of st: its readiness
+// source, waiter queue and connection. They are read under stateMu, as a
+// background connect publishes them from its own goroutine.
+func (st *SocketState) pollView() (ReadinessSource, *waiter.Queue, net.Conn) {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	return st.Ready, st.WaiterQueue, st.Conn
+}
+
+// rebind runs set, which assigns st's connection, listener or backend, and
+// then rebinds st's waiter queue and readiness source, all under stateMu, so
+// that pollView and backend see either the old connection or the new one.
+// set may be nil to only rebind.
+func (st *SocketState) rebind(set func()) {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	if set != nil {
+		set()
+	}
+	UpdateWaiterQueue(st)
+}
+
+// backend returns the network st is on, read under stateMu for the same
+// reason as pollView.
+func (st *SocketState) backend() Backend {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	return st.Backend
+}
+
+// connectFailed records a connect that failed on the calling thread: the
+// thread's last error, plus everything connectDone reports.
+func (st *SocketState) connectFailed(t Thread, errCode int32) {
+	t.setLastError(errCode)
+	st.connectDone(errCode)
+}
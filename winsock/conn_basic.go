@@ -1,170 +1,173 @@
 // conn_basic.go — Core connection lifecycle functions. Implements bind (stores
 // local address), listen (opens a net.Listener with optional SO_REUSEADDR via
 // ListenConfig), accept (accepts incoming connections and registers new socket
-// handles), connect (dials TCP or UDP and applies pre-set socket options), and
-// shutdown (half-close via CloseRead/CloseWrite). Also provides the parseSockAddrIn
-// helper for converting C sockaddr_in structs to Go "ip:port" strings.
+// handles), connect (dials TCP or UDP after checking the destination against
+// the tunnel's AllowedIPs, in the background for non-blocking TCP sockets, see
+// conn_async.go, and applies pre-set socket options), and shutdown (half-close
+// via CloseRead/CloseWrite). Each checks the socket's lifecycle state first
+// (see sock_state.go). Addresses are read and written through the
+// family-independent helpers in sockaddr.go.
 package winsock
 
 import (
-	"fmt"
+	"context"
 	"net"
 	"net/netip"
-	"strconv"
+	"sync/atomic"
 	"unsafe"
-
-	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
-// helper to parse sockaddr_in to "ip:port"
-func parseSockAddrIn(name unsafe.Pointer) (string, error) {
-	if name == nil {
-		return "", fmt.Errorf("NULL pointer")
-	}
-	// sin_family(2), sin_port(2), sin_addr(4)
-	family := *(*uint16)(name)
-	if family != 2 {
-		return "", fmt.Errorf("Unsupported AF: %d", family)
+// pingProtocolSupported reports whether a raw socket's protocol can be served
+// by the netstack ping endpoints (ICMP for AF_INET, ICMPv6 for AF_INET6).
+func pingProtocolSupported(st *SocketState) bool {
+	if st.AddressFamily == AF_INET6 {
+		return st.Protocol == IPPROTO_ICMPV6
 	}
+	return st.Protocol == IPPROTO_ICMP
+}
 
-	portBytes := (*[2]byte)(unsafe.Pointer(uintptr(name) + 2))
-	// In-network order (BigEndian)
-	port := uint16(portBytes[0])<<8 | uint16(portBytes[1])
-
-	addrBytes := (*[4]byte)(unsafe.Pointer(uintptr(name) + 4))
-	ip := net.IPv4(addrBytes[0], addrBytes[1], addrBytes[2], addrBytes[3])
-
-	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+// checkSockAddrFamily rejects addresses whose family does not match the socket.
+func checkSockAddrFamily(st *SocketState, ap netip.AddrPort) bool {
+	switch st.AddressFamily {
+	case AF_INET:
+		return ap.Addr().Is4()
+	case AF_INET6:
+		return ap.Addr().Is6()
+	}
+	return true
 }
 
 // goBind associates a local address with a socket.
-func GoBind(s uint64, name unsafe.Pointer, namelen int32) int32 {
+func GoBind(t Thread, s uint64, name unsafe.Pointer, namelen int32) int32 {
 	LogCall("Bind", s, name, namelen)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
 		return -1
 	}
 
-	if st.BoundAddr != "" {
-		setLastError(WSAEINVAL)
+	if code := st.bindError(); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 
-	addr, err := parseSockAddrIn(name)
+	addr, err := parseSockAddr(name, namelen)
 	if err != nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(mapError(err))
+		return -1
+	}
+	if !checkSockAddrFamily(st, addr) {
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
-
-	st.BoundAddr = addr
 
 	if st.Type == TypeUDP {
-		stack, err := GetStack()
+		backend, err := localBackend(addr.Addr())
 		if err != nil {
-			setLastError(WSAEHOSTUNREACH)
-			return -1
-		}
-		udpAddr, err := net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			setLastError(WSAEINVAL)
+			t.setLastError(mapError(err))
 			return -1
 		}
 		if st.Conn != nil {
 			st.Conn.Close()
 		}
-		conn, err := stack.ListenUDP(udpAddr)
+		conn, err := backend.DialUDP(st, addr, netip.AddrPort{})
 		if err != nil {
-			setLastError(mapError(err))
+			t.setLastError(mapError(err))
 			return -1
 		}
-		st.Conn = conn
-		UpdateWaiterQueue(st)
+		st.rebind(func() { st.Conn, st.Backend = conn, backend })
 	} else if st.Type == TypeRaw {
-		stack, err := GetStack()
-		if err != nil {
-			setLastError(WSAEHOSTUNREACH)
-			return -1
-		}
-		if st.Protocol != 1 { // IPPROTO_ICMP
-			setLastError(WSAEPROTONOSUPPORT)
-			return -1
-		}
-		host, _, err := net.SplitHostPort(addr)
+		backend, err := localBackend(addr.Addr())
 		if err != nil {
-			setLastError(WSAEINVAL)
+			t.setLastError(mapError(err))
 			return -1
 		}
-		netipAddr, err := netip.ParseAddr(host)
-		if err != nil {
-			setLastError(WSAEINVAL)
+		if !pingProtocolSupported(st) {
+			t.setLastError(WSAEPROTONOSUPPORT)
 			return -1
 		}
-		pingAddr := netstack.PingAddrFromAddr(netipAddr)
 		if st.Conn != nil {
 			st.Conn.Close()
 		}
-		conn, err := stack.ListenPing(pingAddr)
+		conn, err := backend.ListenPing(addr.Addr())
 		if err != nil {
-			setLastError(mapError(err))
+			t.setLastError(mapError(err))
 			return -1
 		}
-		st.Conn = conn
-		UpdateWaiterQueue(st)
+		st.rebind(func() { st.Conn, st.Backend = conn, backend })
 	}
 
+	st.BoundAddr = addr
+	st.setState(StateBound)
 	return 0
 }
 
 // goListen places a socket in a state where it is listening for incoming connections.
-func GoListen(s uint64, backlog int32) int32 {
+func GoListen(t Thread, s uint64, backlog int32) int32 {
 	LogCall("Listen", s, backlog)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
-
-	addr := st.BoundAddr
-	if addr == "" {
-		addr = ":0"
+	if netDown(t, st) {
+		return -1
 	}
-
-	stack, err := GetStack()
-	if err != nil {
-		setLastError(WSAEHOSTUNREACH)
+	if code := st.listenError(); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
+	if st.state() == StateListening {
+		// Listening already; Winsock keeps the socket as it is
+		return 0
+	}
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	backend, err := socketBackend(st, netip.Addr{})
 	if err != nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(mapError(err))
 		return -1
 	}
 
-	ln, err := stack.ListenTCP(tcpAddr)
+	ln, err := backend.ListenTCP(st, st.BoundAddr)
 	if err != nil {
-		setLastError(mapError(err))
+		t.setLastError(mapError(err))
 		return -1
 	}
-	st.Listener = ln
-	UpdateWaiterQueue(st)
+	st.rebind(func() { st.Listener, st.Backend = ln, backend })
+	st.setState(StateListening)
 
 	return 0
 }
 
 // goAccept permits an incoming connection attempt on a socket.
-func GoAccept(s uint64, addr unsafe.Pointer, addrlen *int32) uint64 {
+func GoAccept(t Thread, s uint64, addr unsafe.Pointer, addrlen *int32) uint64 {
 	LogCall("Accept", s, addr, addrlen)
 	st, ok := registry.Get(s)
-	if !ok || st.Listener == nil {
-		setLastError(WSAENOTSOCK)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
+		return INVALID_SOCKET
+	}
+	if netDown(t, st) {
+		return INVALID_SOCKET
+	}
+	if code := st.acceptError(); code != 0 {
+		t.setLastError(code)
+		return INVALID_SOCKET
+	}
+
+	// Validate the peer address buffer before dequeuing a connection so a
+	// short buffer does not silently drop the accepted socket.
+	if addr != nil && (addrlen == nil || *addrlen < sockAddrLen(st.AddressFamily)) {
+		t.setLastError(WSAEFAULT)
 		return INVALID_SOCKET
 	}
 
 	conn, err := st.Listener.Accept()
 	if err != nil {
-		setLastError(mapError(err))
+		t.setLastError(mapError(err))
 		return INVALID_SOCKET
 	}
 
@@ -173,155 +176,184 @@ func GoAccept(s uint64, addr unsafe.Pointer, addrlen *int32) uint64 {
 		Type:          st.Type,
 		AddressFamily: st.AddressFamily,
 		Protocol:      st.Protocol,
+		V6Only:        st.V6Only,
+		Backend:       st.Backend,
 		Options:       make(map[int32][]byte),
+		State:         StateConnected,
 	}
 
-	newHandle := registry.Register(newSt)
 	UpdateWaiterQueue(newSt)
+	newHandle := registry.Register(newSt)
 
 	// Fill addr with peer info if provided
-	if addr != nil && addrlen != nil {
-		// RemoteAddr() for netstack should work and return a compatible addr type
-		raddr := conn.RemoteAddr()
-		if tcpAddr, ok := raddr.(*net.TCPAddr); ok {
-			sa := (*struct {
-				Family uint16
-				Port   uint16
-				Addr   [4]byte
-				Zero   [8]byte
-			})(addr)
-
-			sa.Family = 2
-			sa.Port = uint16(tcpAddr.Port>>8) | uint16(tcpAddr.Port&0xFF)<<8
-			copy(sa.Addr[:], tcpAddr.IP.To4())
-			*addrlen = 16
-		}
+	if addr != nil {
+		writeSockAddr(addr, addrlen, netAddrToAddrPort(conn.RemoteAddr()), st.AddressFamily)
 	}
 
 	return newHandle
 }
 
 // goConnect establishes a connection to a specified socket.
-func GoConnect(s uint64, name unsafe.Pointer, namelen int32) int32 {
+func GoConnect(t Thread, s uint64, name unsafe.Pointer, namelen int32) int32 {
 	LogCall("Connect", s, name, namelen)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.connectError(); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 
-	addr, err := parseSockAddrIn(name)
+	addr, err := parseSockAddr(name, namelen)
 	if err != nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(mapError(err))
+		return -1
+	}
+	if !checkSockAddrFamily(st, addr) {
+		t.setLastError(WSAEFAULT)
+		return -1
+	}
+
+	if st.Type == TypeTCP && st.IsNonBlocking && stackAsleep(st) {
+		// Bring the stack up and pick the network in the background
+		atomic.StoreInt32(&st.ConnectError, 0)
+		connectAsync(st, nil, addr)
+		t.setLastError(WSAEWOULDBLOCK)
 		return -1
 	}
 
-	stack, err := GetStack()
+	backend, err := socketBackend(st, addr.Addr())
+	if err == nil {
+		err = checkRoute(backend, addr.Addr())
+	}
 	if err != nil {
-		setLastError(WSAEHOSTUNREACH)
+		st.connectFailed(t, mapError(err))
+		return -1
+	}
+	atomic.StoreInt32(&st.ConnectError, 0)
+
+	if st.Type == TypeTCP && st.IsNonBlocking {
+		// Dial in the background; the outcome is reported through select,
+		// WSAPoll, FD_CONNECT and SO_ERROR (see conn_async.go)
+		connectAsync(st, backend, addr)
+		t.setLastError(WSAEWOULDBLOCK)
+		return -1
+	}
+	if err := backendReady(backend); err != nil {
+		st.connectFailed(t, mapError(err))
 		return -1
 	}
 
 	if st.Type == TypeUDP {
-		raddr, err := net.ResolveUDPAddr("udp", addr)
-		if err != nil {
-			setLastError(WSAEINVAL)
-			return -1
+		laddr := st.BoundAddr
+		var released net.Conn
+		if backend == hostBackend && st.Conn != nil {
+			// The host will not bind the same port twice; release it first
+			// and take it back below if the dial fails
+			released = st.Conn
+			laddr = netAddrToAddrPort(released.LocalAddr())
+			released.Close()
+			st.rebind(func() { st.Conn = nil })
 		}
-		var laddr *net.UDPAddr
-		if st.BoundAddr != "" {
-			laddr, _ = net.ResolveUDPAddr("udp", st.BoundAddr)
-		}
-
-		conn, err := stack.DialUDP(laddr, raddr)
+		conn, err := backend.DialUDP(st, laddr, addr)
 		if err != nil {
-			setLastError(mapError(err))
+			if released != nil {
+				restoreHostUDP(st, laddr, netAddrToAddrPort(released.RemoteAddr()))
+			}
+			st.connectFailed(t, mapError(err))
 			return -1
 		}
 
 		if st.Conn != nil {
 			st.Conn.Close()
 		}
-		st.Conn = conn
-		UpdateWaiterQueue(st)
+		st.rebind(func() { st.Conn, st.Backend = conn, backend })
 	} else if st.Type == TypeRaw {
-		if st.Protocol != 1 { // IPPROTO_ICMP
-			setLastError(WSAEPROTONOSUPPORT)
-			return -1
-		}
-		host, _, err := net.SplitHostPort(addr)
-		if err != nil {
-			setLastError(WSAEINVAL)
+		if !pingProtocolSupported(st) {
+			t.setLastError(WSAEPROTONOSUPPORT)
 			return -1
 		}
-		raddr, err := netip.ParseAddr(host)
+		conn, err := backend.DialPing(st.BoundAddr.Addr(), addr.Addr())
 		if err != nil {
-			setLastError(WSAEINVAL)
-			return -1
-		}
-		var laddr netip.Addr
-		if st.BoundAddr != "" {
-			lhost, _, _ := net.SplitHostPort(st.BoundAddr)
-			laddr, _ = netip.ParseAddr(lhost)
-		} else {
-			laddr = netip.MustParseAddr("0.0.0.0")
-		}
-
-		conn, err := stack.DialPing(netstack.PingAddrFromAddr(laddr), netstack.PingAddrFromAddr(raddr))
-		if err != nil {
-			setLastError(mapError(err))
+			st.connectFailed(t, mapError(err))
 			return -1
 		}
 
 		if st.Conn != nil {
 			st.Conn.Close()
 		}
-		st.Conn = conn
-		UpdateWaiterQueue(st)
+		st.rebind(func() { st.Conn, st.Backend = conn, backend })
 	} else {
-		conn, err := stack.Dial("tcp", addr)
+		conn, err := backend.DialTCP(context.Background(), st, addr)
 		if err != nil {
-			setLastError(mapError(err))
+			st.connectFailed(t, mapError(err))
 			return -1
 		}
-		st.Conn = conn
-		UpdateWaiterQueue(st)
+		st.rebind(func() { st.Conn, st.Backend = conn, backend })
+	}
+
+	st.setState(StateConnected)
+	applyPendingOpts(st)
+	return 0
+}
+
+// restoreHostUDP reopens the host UDP socket GoConnect released to reconnect
+// st, on its old local address laddr and connected to raddr if it was, so a
+// failed connect leaves the socket bound as before.
+func restoreHostUDP(st *SocketState, laddr, raddr netip.AddrPort) {
+	conn, err := dialDirectUDP(st, laddr, raddr)
+	if err != nil {
+		LogNotice("socket %d: cannot rebind %v after failed connect: %v", st.Handle, laddr, err)
+		st.rebind(nil)
+		return
 	}
+	st.rebind(func() { st.Conn = conn })
+}
 
-	// Apply any pre-set socket options to the new connection
+// applyPendingOpts applies the socket options set before connect to the new
+// connection.
+func applyPendingOpts(st *SocketState) {
 	for key, val := range st.Options {
 		level := key >> 16
 		opt := key & 0xFFFF
 		applySockOpt(st, level, opt, val)
 	}
-
-	return 0
 }
 
 // goShutdown disables sends, receives, or both on a socket.
-func GoShutdown(s uint64, how int32) int32 {
+func GoShutdown(t Thread, s uint64, how int32) int32 {
 	LogCall("Shutdown", s, how)
 	st, ok := registry.Get(s)
-	if !ok || st.Conn == nil {
-		setLastError(WSAENOTSOCK)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
-
-	// 0: SD_RECEIVE, 1: SD_SEND, 2: SD_BOTH
-	tcpConn, ok := st.Conn.(*net.TCPConn)
+	if code := st.shutdownError(how); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	st.markShutdown(how)
+
+	// Streams half-close the connection; datagram sockets only refuse further
+	// sends or receives (see sock_state.go)
+	halfCloser, ok := st.Conn.(interface {
+		CloseRead() error
+		CloseWrite() error
+	})
 	if !ok {
 		return 0
 	}
 
-	switch how {
-	case 0:
-		tcpConn.CloseRead()
-	case 1:
-		tcpConn.CloseWrite()
-	case 2:
-		tcpConn.CloseRead()
-		tcpConn.CloseWrite()
+	if how == SD_RECEIVE || how == SD_BOTH {
+		halfCloser.CloseRead()
+	}
+	if how == SD_SEND || how == SD_BOTH {
+		halfCloser.CloseWrite()
 	}
-
 	return 0
 }
@@ -1,30 +1,35 @@
 // conn_extd.go — Extended WSA connection APIs. Implements WSAAccept (delegates to
 // GoAccept), WSAConnect (delegates to GoConnect, ignoring QOS), WSAConnectByNameA/W
-// (resolves node+service strings and dials via netstack with optional timeout),
-// and WSAConnectByList (returns WSAEOPNOTSUPP).
+// (resolves node+service strings and dials each address on the backend that routes
+// it, with optional timeout), and WSAConnectByList (dials each listed address in
+// turn). Addresses outside every peer's AllowedIPs are skipped with WSAENETUNREACH.
 package winsock
 
 import (
 	"context"
+	"errors"
 	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
 // GoWSAAccept permits an incoming connection attempt on a socket. (Extended)
 // Delegates to GoAccept; the condition function (lpfnCondition) is ignored.
-func GoWSAAccept(s uint64, addr unsafe.Pointer, addrlen *int32, lpfnCondition unsafe.Pointer, dwCallbackData uint32) uint64 {
+func GoWSAAccept(t Thread, s uint64, addr unsafe.Pointer, addrlen *int32, lpfnCondition unsafe.Pointer, dwCallbackData uint32) uint64 {
 	LogCall("WSAAccept", s, addr, addrlen, lpfnCondition, dwCallbackData)
 	// Delegate to the basic accept — condition function is not supported in this bridge
-	return GoAccept(s, addr, addrlen)
+	return GoAccept(t, s, addr, addrlen)
 }
 
 // GoWSAConnect establishes a connection to another socket application. (Extended)
 // Delegates to GoConnect; QOS and caller/callee data are ignored.
-func GoWSAConnect(s uint64, name unsafe.Pointer, namelen int32, lpCallerData unsafe.Pointer, lpCalleeData unsafe.Pointer, lpSQOS unsafe.Pointer, lpGQOS unsafe.Pointer) int32 {
+func GoWSAConnect(t Thread, s uint64, name unsafe.Pointer, namelen int32, lpCallerData unsafe.Pointer, lpCalleeData unsafe.Pointer, lpSQOS unsafe.Pointer, lpGQOS unsafe.Pointer) int32 {
 	LogCall("WSAConnect", s, name, namelen, lpCallerData, lpCalleeData, lpSQOS, lpGQOS)
 	// Delegate to basic connect — QOS/caller/callee data ignored
-	return GoConnect(s, name, namelen)
+	return GoConnect(t, s, name, namelen)
 }
 
 type socketAddress struct {
@@ -38,24 +43,29 @@ type socketAddressList struct {
 }
 
 // GoWSAConnectByList establishes a connection to one of a collection of endpoints.
-func GoWSAConnectByList(s uint64, SocketAddressList unsafe.Pointer, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) int32 {
+func GoWSAConnectByList(t Thread, s uint64, SocketAddressList unsafe.Pointer, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) int32 {
 	LogCall("WSAConnectByList", s, SocketAddressList, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout, Reserved)
 
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+
+	if code := st.connectError(); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 
 	if SocketAddressList == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
 	list := (*socketAddressList)(SocketAddressList)
 	count := int(list.iAddressCount)
 	if count <= 0 {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
 
@@ -67,9 +77,7 @@ func GoWSAConnectByList(s uint64, SocketAddressList unsafe.Pointer, LocalAddress
 
 	addresses := unsafe.Slice((*socketAddress)(addrArrayPtr), count)
 
-	stack, err := GetStack()
-	if err != nil {
-		setLastError(WSAEHOSTUNREACH)
+	if netDown(t, st) {
 		return -1
 	}
 
@@ -88,24 +96,33 @@ func GoWSAConnectByList(s uint64, SocketAddressList unsafe.Pointer, LocalAddress
 
 	var lastErr error
 	var connectedConn net.Conn
+	var connectedBackend Backend
 	var connectedAddr unsafe.Pointer
 	var connectedAddrLen int32
 
 	// Try sequentially
 	for i := 0; i < count; i++ {
 		sa := addresses[i]
-		if sa.lpSockaddr == nil || sa.iSockaddrLength < 16 {
+		addr, err := parseSockAddr(sa.lpSockaddr, sa.iSockaddrLength)
+		if err != nil || !checkSockAddrFamily(st, addr) {
 			continue
 		}
 
-		addrStr, err := parseSockAddrIn(sa.lpSockaddr)
+		backend, err := socketBackend(st, addr.Addr())
+		if err == nil {
+			err = checkRoute(backend, addr.Addr())
+		}
+		if err == nil {
+			err = backendReady(backend)
+		}
 		if err != nil {
+			lastErr = err
 			continue
 		}
-
-		conn, err := stack.DialContext(ctx, "tcp", addrStr)
+		conn, err := backend.DialTCP(ctx, st, addr)
 		if err == nil {
 			connectedConn = conn
+			connectedBackend = backend
 			connectedAddr = sa.lpSockaddr
 			connectedAddrLen = sa.iSockaddrLength
 			break
@@ -115,21 +132,20 @@ func GoWSAConnectByList(s uint64, SocketAddressList unsafe.Pointer, LocalAddress
 
 	if connectedConn == nil {
 		if lastErr != nil {
-			setLastError(mapError(lastErr))
+			st.connectFailed(t, mapError(lastErr))
 		} else {
-			setLastError(WSAECONNREFUSED)
+			st.connectFailed(t, WSAECONNREFUSED)
 		}
 		return -1
 	}
+	atomic.StoreInt32(&st.ConnectError, 0)
 
-	st.Conn = connectedConn
+	st.rebind(func() { st.Conn, st.Backend = connectedConn, connectedBackend })
+	st.setState(StateConnected)
 
 	// Fill local address if requested
-	if LocalAddress != nil && LocalAddressLength != nil && *LocalAddressLength >= 16 {
-		if tcpAddr, ok := connectedConn.LocalAddr().(*net.TCPAddr); ok {
-			fillSockAddrIn(LocalAddress, tcpAddr.IP, tcpAddr.Port)
-			*LocalAddressLength = 16
-		}
+	if LocalAddress != nil && LocalAddressLength != nil {
+		writeSockAddrU32(LocalAddress, LocalAddressLength, netAddrToAddrPort(connectedConn.LocalAddr()), st.AddressFamily)
 	}
 
 	// Fill remote address if requested
@@ -143,18 +159,31 @@ func GoWSAConnectByList(s uint64, SocketAddressList unsafe.Pointer, LocalAddress
 }
 
 // wsaConnectByName is the shared implementation for WSAConnectByNameA/W.
-func wsaConnectByName(s uint64, node string, service string, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer) int32 {
+func wsaConnectByName(t Thread, s uint64, node string, service string, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer) int32 {
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
-	addr := net.JoinHostPort(node, service)
+	if code := st.connectError(); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
 
-	stack, err := GetStack()
+	port, err := strconv.ParseUint(service, 10, 16)
 	if err != nil {
-		setLastError(WSAEHOSTUNREACH)
+		t.setLastError(WSAEINVAL)
+		return -1
+	}
+
+	// Resolve first so that each address is routed on its own: over the
+	// tunnel whose AllowedIPs hold it, or direct under the split rules
+	var hosts []string
+	if ip, perr := netip.ParseAddr(node); perr == nil {
+		hosts = []string{ip.String()}
+	} else if hosts, err = lookupHost(node); err != nil {
+		t.setLastError(EAI_NONAME) // WSAHOST_NOT_FOUND
 		return -1
 	}
 
@@ -171,74 +200,91 @@ func wsaConnectByName(s uint64, node string, service string, LocalAddressLength
 		defer cancel()
 	}
 
-	conn, err := stack.DialContext(ctx, "tcp", addr)
-	if err != nil {
-		setLastError(mapError(err))
+	var conn net.Conn
+	lastErr := error(errors.New("no suitable address"))
+	for _, h := range hosts {
+		ip, perr := netip.ParseAddr(h)
+		if perr != nil || (st.AddressFamily == AF_INET && !ip.Is4()) || (st.AddressFamily == AF_INET6 && st.V6Only && ip.Is4()) {
+			continue
+		}
+		if st.AddressFamily == AF_INET6 && ip.Is4() {
+			ip = netip.AddrFrom16(ip.As16())
+		}
+		dest := netip.AddrPortFrom(ip, uint16(port))
+
+		backend, err := socketBackend(st, ip)
+		if err == nil {
+			err = checkRoute(backend, ip)
+		}
+		if err == nil {
+			err = backendReady(backend)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		conn, err = backend.DialTCP(ctx, st, dest)
+		if err == nil {
+			st.rebind(func() { st.Conn, st.Backend = conn, backend })
+			st.setState(StateConnected)
+			break
+		}
+		lastErr = err
+	}
+	if conn == nil {
+		st.connectFailed(t, mapError(lastErr))
 		return -1
 	}
-	st.Conn = conn
+	atomic.StoreInt32(&st.ConnectError, 0)
 
 	// Fill local address if requested
-	if LocalAddress != nil && LocalAddressLength != nil && *LocalAddressLength >= 16 {
-		if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
-			fillSockAddrIn(LocalAddress, tcpAddr.IP, tcpAddr.Port)
-			*LocalAddressLength = 16
-		}
+	if LocalAddress != nil && LocalAddressLength != nil {
+		writeSockAddrU32(LocalAddress, LocalAddressLength, netAddrToAddrPort(conn.LocalAddr()), st.AddressFamily)
 	}
 
 	// Fill remote address if requested
-	if RemoteAddress != nil && RemoteAddressLength != nil && *RemoteAddressLength >= 16 {
-		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-			fillSockAddrIn(RemoteAddress, tcpAddr.IP, tcpAddr.Port)
-			*RemoteAddressLength = 16
-		}
+	if RemoteAddress != nil && RemoteAddressLength != nil {
+		writeSockAddrU32(RemoteAddress, RemoteAddressLength, netAddrToAddrPort(conn.RemoteAddr()), st.AddressFamily)
 	}
 
 	return 1 // TRUE
 }
 
-// fillSockAddrIn writes an IPv4 address + port into a sockaddr_in buffer.
-func fillSockAddrIn(sa unsafe.Pointer, ip net.IP, port int) {
-	addr := (*struct {
-		Family uint16
-		Port   uint16
-		Addr   [4]byte
-		Zero   [8]byte
-	})(sa)
-	addr.Family = 2 // AF_INET
-	addr.Port = uint16(port>>8) | uint16(port&0xFF)<<8
-	ip4 := ip.To4()
-	if ip4 != nil {
-		copy(addr.Addr[:], ip4)
+// writeSockAddrU32 adapts writeSockAddr to the LPDWORD length parameters
+// used by WSAConnectByName and WSAConnectByList.
+func writeSockAddrU32(sa unsafe.Pointer, salen *uint32, ap netip.AddrPort, family int32) {
+	n := int32(*salen)
+	if writeSockAddr(sa, &n, ap, family) == nil {
+		*salen = uint32(n)
 	}
 }
 
 // GoWSAConnectByNameA establishes a connection to a specified host and port. (ANSI)
-func GoWSAConnectByNameA(s uint64, nodename *byte, servicename *byte, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) int32 {
+func GoWSAConnectByNameA(t Thread, s uint64, nodename *byte, servicename *byte, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) int32 {
 	LogCall("WSAConnectByNameA", s, nodename, servicename, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout, Reserved)
 	node := goStringFromPtr(nodename)
 	service := goStringFromPtr(servicename)
-	return wsaConnectByName(s, node, service, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout)
+	return wsaConnectByName(t, s, node, service, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout)
 }
 
 // GoWSAConnectByNameW establishes a connection to a specified host and port. (Unicode)
-func GoWSAConnectByNameW(s uint64, nodename *uint16, servicename *uint16, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) int32 {
+func GoWSAConnectByNameW(t Thread, s uint64, nodename *uint16, servicename *uint16, LocalAddressLength *uint32, LocalAddress unsafe.Pointer, RemoteAddressLength *uint32, RemoteAddress unsafe.Pointer, timeout unsafe.Pointer, Reserved unsafe.Pointer) int32 {
 	LogCall("WSAConnectByNameW", s, nodename, servicename, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout, Reserved)
 	node := goStringFromWPtr(nodename)
 	service := goStringFromWPtr(servicename)
-	return wsaConnectByName(s, node, service, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout)
+	return wsaConnectByName(t, s, node, service, LocalAddressLength, LocalAddress, RemoteAddressLength, RemoteAddress, timeout)
 }
 
 // GoAcceptEx is the Go implementation of AcceptEx.
-func GoAcceptEx(sListenSocket uint64, sAcceptSocket uint64, lpOutputBuffer unsafe.Pointer, dwReceiveDataLength uint32, dwLocalAddressLength uint32, dwRemoteAddressLength uint32, lpdwBytesReceived *uint32, lpOverlapped unsafe.Pointer) int32 {
+func GoAcceptEx(t Thread, sListenSocket uint64, sAcceptSocket uint64, lpOutputBuffer unsafe.Pointer, dwReceiveDataLength uint32, dwLocalAddressLength uint32, dwRemoteAddressLength uint32, lpdwBytesReceived *uint32, lpOverlapped unsafe.Pointer) int32 {
 	LogCall("AcceptEx", sListenSocket, sAcceptSocket, lpOutputBuffer, dwReceiveDataLength, dwLocalAddressLength, dwRemoteAddressLength, lpdwBytesReceived, lpOverlapped)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return 0 // FALSE
 }
 
 // GoConnectEx is the Go implementation of ConnectEx.
-func GoConnectEx(s uint64, name unsafe.Pointer, namelen int32, lpSendBuffer unsafe.Pointer, dwSendDataLength uint32, lpdwBytesSent *uint32, lpOverlapped unsafe.Pointer) int32 {
+func GoConnectEx(t Thread, s uint64, name unsafe.Pointer, namelen int32, lpSendBuffer unsafe.Pointer, dwSendDataLength uint32, lpdwBytesSent *uint32, lpOverlapped unsafe.Pointer) int32 {
 	LogCall("ConnectEx", s, name, namelen, lpSendBuffer, dwSendDataLength, lpdwBytesSent, lpOverlapped)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return 0 // FALSE
 }
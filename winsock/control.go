@@ -0,0 +1,300 @@
+// control.go — Runtime control API for applications that embed the DLL.
+// SetConfig runs the bridge from config text held in memory instead of a file
+// (hot-applied like a reload when the stack is already up), AddPeer and
+// RemovePeer change the peers of a running tunnel, and Restart replaces every
+// tunnel with a fresh one from the current config source. All of them take
+// the stack write lock, so socket calls in flight finish on the old state
+// first and later ones see the new one; configs are parsed and peer endpoints
+// resolved before the lock is taken. The GoKlinikal* wrappers back
+// the DLL exports and report failures as text in a caller buffer. Runtime peer
+// changes last until the next reload or restart replaces the config.
+package winsock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// memoryConfigName labels configs supplied through SetConfig.
+const memoryConfigName = "memory:KlinikalSetConfig"
+
+// globalMemConfig is the config text installed by SetConfig, kept for
+// reloads and restarts and wiped when replaced.
+var globalMemConfig []byte
+
+// memoryLoader returns a loader handing out copies of data, since loadConfig
+// wipes what it is given.
+func memoryLoader(data []byte) configLoader {
+	return func() (*configSource, error) {
+		return &configSource{Name: memoryConfigName, Data: bytes.Clone(data)}, nil
+	}
+}
+
+// SetConfig makes text the running configuration. A running stack is updated
+// in place as by ReloadStack; otherwise the stack is started from it. text may
+// be an encrypted envelope (see conf_crypt.go). It is copied, and the caller
+// may wipe it afterwards.
+func SetConfig(text []byte) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	data := bytes.Clone(text)
+	load := memoryLoader(data)
+
+	// Parse and resolve before taking the stack lock (see ReloadStack)
+	src, _ := load()
+	file, err := loadResolvedConfig(src)
+	if err != nil {
+		wipe(data)
+		return err
+	}
+	defer file.Wipe()
+
+	stackMu.Lock()
+	defer stackMu.Unlock()
+
+	if stackInitialized && globalLoader != nil {
+		var applied bool
+		if applied, err = reloadStackLocked(src.Name, file); !applied {
+			wipe(data)
+			return err
+		}
+		// A partial reload still leaves the stack running on the new config
+		globalLoader = load
+	} else {
+		if stackInitialized {
+			// A custom backend from InitializeBackend; replace it
+			closeStackLocked()
+		}
+		if err = startStackLocked(load, src.Name, file); err != nil {
+			wipe(data)
+			return err
+		}
+	}
+	wipe(globalMemConfig)
+	globalMemConfig = data
+	return err
+}
+
+// AddPeer adds peer to the named tunnel ("" for the primary one), or updates it
+// if a peer with the same public key exists.
+func AddPeer(tunnelName string, peer *WGPeer) error {
+	// A hostname Endpoint is looked up before taking the stack lock, so socket
+	// calls do not wait on DNS
+	if peer.Endpoint != "" {
+		peer.lookupEndpoint()
+	}
+
+	stackMu.Lock()
+	defer stackMu.Unlock()
+
+	t, err := controlTunnel(tunnelName)
+	if err != nil {
+		return err
+	}
+
+	var request secretBuffer
+	defer func() { wipe(request.Bytes()) }()
+	peer.PublicKey.writeUAPI(&request, "public_key")
+	// An all-zero preshared_key clears it on the device
+	peer.PresharedKey.writeUAPI(&request, "preshared_key")
+	if err := peer.writeEndpointUAPI(&request); err != nil {
+		return err
+	}
+	fmt.Fprintf(&request, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+	peer.writeAllowedIPsUAPI(&request)
+
+	if err := t.Device.IpcSetOperation(bytes.NewReader(request.Bytes())); err != nil {
+		return fmt.Errorf("tunnel %s: failed to set device IPC: %w", t.Name, err)
+	}
+	t.applied.Peers[peer.PublicKey] = newAppliedPeer(peer)
+	t.Routes = t.applied.routes()
+	t.kickResolver()
+	return nil
+}
+
+// RemovePeer removes the peer with public key pub from the named tunnel (""
+// for the primary one).
+func RemovePeer(tunnelName string, pub wgKey) error {
+	stackMu.Lock()
+	defer stackMu.Unlock()
+
+	t, err := controlTunnel(tunnelName)
+	if err != nil {
+		return err
+	}
+	if _, ok := t.applied.Peers[pub]; !ok {
+		return fmt.Errorf("tunnel %s: no peer %s", t.Name, base64.StdEncoding.EncodeToString(pub[:]))
+	}
+
+	if err := t.Device.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", pub.Hex())); err != nil {
+		return fmt.Errorf("tunnel %s: failed to set device IPC: %w", t.Name, err)
+	}
+	delete(t.applied.Peers, pub)
+	t.Routes = t.applied.routes()
+	return nil
+}
+
+// Restart starts every tunnel again from the current config source (the
+// discovery chain if the stack is not running) and then stops the old ones,
+// closing the network side of their sockets. If the new tunnels fail to
+// start, the old ones keep running.
+func Restart() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	stackMu.RLock()
+	load := globalLoader
+	if load == nil {
+		load = suspendedLoader
+	}
+	stackMu.RUnlock()
+	if load == nil {
+		load = discoverConfig
+	}
+
+	// Load and resolve before taking the stack lock (see ReloadStack)
+	src, err := load()
+	if err != nil {
+		return err
+	}
+	file, err := loadResolvedConfig(src)
+	if err != nil {
+		return err
+	}
+	defer file.Wipe()
+
+	stackMu.Lock()
+	defer stackMu.Unlock()
+	LogCall("ConfigSource", src.Name)
+
+	// The old tunnels are only paused while the new ones start, so a failed
+	// start brings them back with their sockets intact
+	old := globalTunnels
+	for _, t := range old {
+		t.pause()
+	}
+	tunnels, err := startTunnels(file)
+	if err != nil {
+		for _, t := range old {
+			t.resume()
+		}
+		return err
+	}
+
+	for _, t := range old {
+		registry.DropConnections(t.Backend)
+	}
+	closeStackLocked()
+	installStackLocked(load, src.Name, file, tunnels)
+	return nil
+}
+
+// controlTunnel finds the WireGuard tunnel a control call is for. Caller
+// holds stackMu.
+func controlTunnel(name string) (*tunnel, error) {
+	if !stackInitialized || len(globalTunnels) == 0 {
+		return nil, errors.New("stack not initialized")
+	}
+	t := globalTunnels[0]
+	if name != "" {
+		t = nil
+		for _, cand := range globalTunnels {
+			if cand.Name == name {
+				t = cand
+				break
+			}
+		}
+		if t == nil {
+			return nil, fmt.Errorf("no tunnel named %q", name)
+		}
+	}
+	if t.Device == nil || t.applied == nil {
+		return nil, fmt.Errorf("tunnel %s has no WireGuard device", t.Name)
+	}
+	return t, nil
+}
+
+// cBytes copies a NUL-terminated C string into a byte slice the caller can
+// wipe, unlike goStringFromPtr.
+func cBytes(ptr *byte) []byte {
+	if ptr == nil {
+		return nil
+	}
+	var n int
+	for p := ptr; *p != 0; p = (*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + 1)) {
+		n++
+	}
+	return bytes.Clone(unsafe.Slice(ptr, n))
+}
+
+// controlResult turns err into the return value of a control export: 0 on
+// success, otherwise -1 with the message (truncated to fit) in errBuf.
+func controlResult(call string, err error, errBuf *byte, errBufLen int32) int32 {
+	if err == nil {
+		if errBuf != nil && errBufLen > 0 {
+			*errBuf = 0
+		}
+		return 0
+	}
+	LogCall(call+"Failed", err)
+	if errBuf != nil && errBufLen > 0 {
+		dest := unsafe.Slice(errBuf, errBufLen)
+		n := copy(dest[:errBufLen-1], err.Error())
+		dest[n] = 0
+	}
+	return -1
+}
+
+// GoKlinikalSetConfig installs the wg.conf text at iniText (see SetConfig).
+func GoKlinikalSetConfig(iniText *byte, errBuf *byte, errBufLen int32) int32 {
+	LogCall("KlinikalSetConfig", errBuf, errBufLen)
+	if iniText == nil {
+		return controlResult("KlinikalSetConfig", errors.New("config text is NULL"), errBuf, errBufLen)
+	}
+	text := cBytes(iniText)
+	defer wipe(text)
+	return controlResult("KlinikalSetConfig", SetConfig(text), errBuf, errBufLen)
+}
+
+// GoKlinikalAddPeer adds or updates the peer described by peerText, the lines
+// of a [Peer] section, on tunnelName (NULL or "" for the primary tunnel).
+func GoKlinikalAddPeer(tunnelName *byte, peerText *byte, errBuf *byte, errBufLen int32) int32 {
+	name := goStringFromPtr(tunnelName)
+	LogCall("KlinikalAddPeer", name, errBuf, errBufLen)
+	text := cBytes(peerText)
+	defer wipe(text)
+
+	peer, err := ParsePeer("KlinikalAddPeer", text)
+	if err == nil {
+		err = AddPeer(name, peer)
+		wipe(peer.PresharedKey[:])
+	}
+	return controlResult("KlinikalAddPeer", err, errBuf, errBufLen)
+}
+
+// GoKlinikalRemovePeer removes the peer with the base64 publicKey from
+// tunnelName (NULL or "" for the primary tunnel).
+func GoKlinikalRemovePeer(tunnelName *byte, publicKey *byte, errBuf *byte, errBufLen int32) int32 {
+	name := goStringFromPtr(tunnelName)
+	key := strings.TrimSpace(goStringFromPtr(publicKey))
+	LogCall("KlinikalRemovePeer", name, key, errBuf, errBufLen)
+
+	pub, err := parseKey(key)
+	if err != nil {
+		err = fmt.Errorf("invalid public key: %w", err)
+	} else {
+		err = RemovePeer(name, pub)
+	}
+	return controlResult("KlinikalRemovePeer", err, errBuf, errBufLen)
+}
+
+// GoKlinikalRestart restarts every tunnel (see Restart).
+func GoKlinikalRestart(errBuf *byte, errBufLen int32) int32 {
+	LogCall("KlinikalRestart", errBuf, errBufLen)
+	return controlResult("KlinikalRestart", Restart(), errBuf, errBufLen)
+}
@@ -0,0 +1,416 @@
+// direct.go — Host-network connections for the direct backend (directBackend in
+// backend.go) used by split tunneling. Destinations the split rules exclude
+// from the tunnels are reached through the host OS network with Go's net
+// package. Host connections are wrapped so they look like the
+// netstack ones to the rest of the bridge: a pump goroutine drains the host
+// socket into a bounded queue and signals a waiter.Queue, which lets select,
+// WSAPoll and WSAEventSelect treat both kinds of socket alike, and reads honour
+// the deadline-based non-blocking mode used by recv/recvfrom.
+package winsock
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// Queue limits for pumped host sockets
+const (
+	directStreamLimit   = 256 << 10 // bytes buffered per TCP connection
+	directDatagramLimit = 512       // datagrams buffered per UDP socket
+	directAcceptBacklog = 128       // connections accepted ahead of Accept
+	directReadSize      = 64 << 10
+)
+
+// directChunk is one read from the host socket.
+type directChunk struct {
+	data []byte
+	from net.Addr
+}
+
+// directQueue buffers data pumped from a host socket and tracks readiness.
+type directQueue struct {
+	wq       waiter.Queue
+	mu       sync.Mutex
+	drained  *sync.Cond // signalled when a stream queue drops below its limit
+	changed  chan struct{}
+	chunks   []directChunk
+	queued   int
+	err      error // terminal read error, reported once the queue is empty
+	closed   bool
+	deadline time.Time
+}
+
+func newDirectQueue() *directQueue {
+	q := &directQueue{changed: make(chan struct{}, 1)}
+	q.drained = sync.NewCond(&q.mu)
+	return q
+}
+
+// signal wakes a blocked reader and notifies waiters with mask.
+func (q *directQueue) signal(mask waiter.EventMask) {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+	if mask != 0 {
+		q.wq.Notify(mask)
+	}
+}
+
+// pump reads from the host socket until it fails. Stream queues apply
+// back-pressure at directStreamLimit; datagram queues drop when full.
+func (q *directQueue) pump(read func([]byte) (int, net.Addr, error), datagram bool) {
+	buf := make([]byte, directReadSize)
+	for {
+		n, from, err := read(buf)
+
+		q.mu.Lock()
+		if n > 0 && (!datagram || len(q.chunks) < directDatagramLimit) {
+			q.chunks = append(q.chunks, directChunk{data: append([]byte(nil), buf[:n]...), from: from})
+			q.queued += n
+		} else if n == 0 && datagram && err == nil {
+			// Zero-length datagrams are still datagrams
+			q.chunks = append(q.chunks, directChunk{from: from})
+		}
+		if err != nil && q.err == nil {
+			q.err = err
+		}
+		for !datagram && err == nil && q.queued >= directStreamLimit && !q.closed {
+			q.drained.Wait()
+		}
+		q.mu.Unlock()
+
+		if err != nil {
+			q.signal(waiter.EventIn | waiter.EventHUp)
+			return
+		}
+		q.signal(waiter.EventIn)
+	}
+}
+
+// read returns queued data, blocking until data arrives, the socket fails or
+// the read deadline passes. Datagram reads return one whole datagram.
+func (q *directQueue) read(b []byte, datagram bool) (int, net.Addr, error) {
+	for {
+		q.mu.Lock()
+		if len(q.chunks) > 0 {
+			c := &q.chunks[0]
+			n := copy(b, c.data)
+			from := c.from
+			if datagram || n == len(c.data) {
+				q.queued -= len(c.data)
+				q.chunks = q.chunks[1:]
+			} else {
+				c.data = c.data[n:]
+				q.queued -= n
+			}
+			q.drained.Signal()
+			q.mu.Unlock()
+			return n, from, nil
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return 0, nil, net.ErrClosed
+		}
+		if q.err != nil {
+			err := q.err
+			q.mu.Unlock()
+			return 0, nil, err
+		}
+		deadline := q.deadline
+		q.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-q.changed:
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (q *directQueue) setDeadline(t time.Time) {
+	q.mu.Lock()
+	q.deadline = t
+	q.mu.Unlock()
+	q.signal(0)
+}
+
+func (q *directQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.drained.Broadcast()
+	q.mu.Unlock()
+	q.signal(waiter.EventIn | waiter.EventHUp)
+}
+
+// Readiness reports the waiter events currently asserted, like
+// tcpip.Endpoint.Readiness.
+func (q *directQueue) Readiness(mask waiter.EventMask) waiter.EventMask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ready waiter.EventMask
+	if len(q.chunks) > 0 || q.err != nil || q.closed {
+		ready |= waiter.EventIn
+	}
+	if !q.closed && q.err == nil {
+		ready |= waiter.EventOut
+	}
+	if q.closed || q.err != nil {
+		ready |= waiter.EventHUp
+	}
+	return ready & mask
+}
+
+// WaiterQueue returns the queue notified when readiness changes.
+func (q *directQueue) WaiterQueue() *waiter.Queue {
+	return &q.wq
+}
+
+// directConn is a host TCP connection with a pumped receive side.
+type directConn struct {
+	net.Conn
+	*directQueue
+}
+
+func newDirectConn(c net.Conn) *directConn {
+	dc := &directConn{Conn: c, directQueue: newDirectQueue()}
+	go dc.pump(func(b []byte) (int, net.Addr, error) {
+		n, err := c.Read(b)
+		return n, nil, err
+	}, false)
+	return dc
+}
+
+func (c *directConn) Read(b []byte) (int, error) {
+	n, _, err := c.read(b, false)
+	return n, err
+}
+
+func (c *directConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return nil
+}
+
+func (c *directConn) SetDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *directConn) Close() error {
+	c.close()
+	return c.Conn.Close()
+}
+
+// CloseRead and CloseWrite half-close the host connection for shutdown.
+func (c *directConn) CloseRead() error {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		return tc.CloseRead()
+	}
+	return nil
+}
+
+func (c *directConn) CloseWrite() error {
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		return tc.CloseWrite()
+	}
+	return nil
+}
+
+// directPacketConn is a host UDP socket with a pumped receive side. It is
+// both a net.Conn (when connected) and a net.PacketConn.
+type directPacketConn struct {
+	*net.UDPConn
+	*directQueue
+}
+
+func newDirectPacketConn(c *net.UDPConn) *directPacketConn {
+	dc := &directPacketConn{UDPConn: c, directQueue: newDirectQueue()}
+	go dc.pump(func(b []byte) (int, net.Addr, error) {
+		n, ap, err := c.ReadFromUDPAddrPort(b)
+		if err != nil {
+			return n, nil, err
+		}
+		return n, net.UDPAddrFromAddrPort(netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())), nil
+	}, true)
+	return dc
+}
+
+func (c *directPacketConn) Read(b []byte) (int, error) {
+	n, _, err := c.read(b, true)
+	return n, err
+}
+
+func (c *directPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.read(b, true)
+}
+
+// RemoteAddr returns nil for an unconnected socket, as gonet.UDPConn does.
+func (c *directPacketConn) RemoteAddr() net.Addr {
+	if ra, ok := c.UDPConn.RemoteAddr().(*net.UDPAddr); ok && ra != nil {
+		return ra
+	}
+	return nil
+}
+
+func (c *directPacketConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return nil
+}
+
+func (c *directPacketConn) SetDeadline(t time.Time) error {
+	c.setDeadline(t)
+	return c.UDPConn.SetWriteDeadline(t)
+}
+
+func (c *directPacketConn) Close() error {
+	c.close()
+	return c.UDPConn.Close()
+}
+
+// directListener is a host TCP listener that accepts ahead of Accept so that
+// pending connections can be reported as FD_ACCEPT readiness.
+type directListener struct {
+	net.Listener
+	wq       waiter.Queue
+	accepted chan net.Conn
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	err      error
+}
+
+func newDirectListener(l net.Listener) *directListener {
+	dl := &directListener{
+		Listener: l,
+		accepted: make(chan net.Conn, directAcceptBacklog),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				dl.mu.Lock()
+				dl.err = err
+				dl.mu.Unlock()
+				dl.wq.Notify(waiter.EventIn | waiter.EventHUp)
+				return
+			}
+			select {
+			case dl.accepted <- newDirectConn(c):
+				dl.wq.Notify(waiter.EventIn)
+			case <-dl.done:
+				c.Close()
+				return
+			}
+		}
+	}()
+	return dl
+}
+
+func (l *directListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *directListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	l.wq.Notify(waiter.EventIn | waiter.EventHUp)
+	return l.Listener.Close()
+}
+
+func (l *directListener) Readiness(mask waiter.EventMask) waiter.EventMask {
+	var ready waiter.EventMask
+	if len(l.accepted) > 0 {
+		ready |= waiter.EventIn
+	}
+	l.mu.Lock()
+	if l.err != nil {
+		ready |= waiter.EventIn | waiter.EventHUp
+	}
+	l.mu.Unlock()
+	return ready & mask
+}
+
+func (l *directListener) WaiterQueue() *waiter.Queue {
+	return &l.wq
+}
+
+// udpNetwork returns the host dial network matching the socket family.
+func udpNetwork(st *SocketState) string {
+	switch {
+	case st.AddressFamily == AF_INET:
+		return "udp4"
+	case st.AddressFamily == AF_INET6 && st.V6Only:
+		return "udp6"
+	}
+	return "udp"
+}
+
+// hostAddrPort strips the v4-mapped form so the host stack picks the IPv4 path.
+func hostAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// dialDirectTCP connects st to raddr over the host network.
+func dialDirectTCP(ctx context.Context, st *SocketState, raddr netip.AddrPort) (net.Conn, error) {
+	d := net.Dialer{}
+	if st.BoundAddr.IsValid() {
+		d.LocalAddr = net.TCPAddrFromAddrPort(hostAddrPort(st.BoundAddr))
+	}
+	c, err := d.DialContext(ctx, tcpNetwork(st), hostAddrPort(raddr).String())
+	if err != nil {
+		return nil, err
+	}
+	return newDirectConn(c), nil
+}
+
+// listenDirectTCP opens a host TCP listener for st on laddr.
+func listenDirectTCP(st *SocketState, laddr netip.AddrPort) (net.Listener, error) {
+	l, err := net.ListenTCP(tcpNetwork(st), net.TCPAddrFromAddrPort(laddr))
+	if err != nil {
+		return nil, err
+	}
+	return newDirectListener(l), nil
+}
+
+// dialDirectUDP opens a host UDP socket for st, bound to laddr and connected
+// to raddr when those are valid.
+func dialDirectUDP(st *SocketState, laddr, raddr netip.AddrPort) (net.Conn, error) {
+	var la *net.UDPAddr
+	if laddr.IsValid() {
+		la = net.UDPAddrFromAddrPort(laddr)
+	}
+
+	var c *net.UDPConn
+	var err error
+	if raddr.IsValid() {
+		c, err = net.DialUDP(udpNetwork(st), la, net.UDPAddrFromAddrPort(hostAddrPort(raddr)))
+	} else {
+		c, err = net.ListenUDP(udpNetwork(st), la)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newDirectPacketConn(c), nil
+}
@@ -0,0 +1,152 @@
+// dualstack.go — IPV6_V6ONLY and v4-mapped address handling. AF_INET6 sockets
+// default to V6ONLY as on Windows; clearing it makes a socket dual-stack, so a
+// single listener accepts IPv4 peers (reported as ::ffff:a.b.c.d) and sends or
+// connects to v4-mapped destinations over the tunnel's IPv4 path. Listening and
+// UDP endpoints are created directly on the gVisor stack so the option is in
+// place before bind; wildcard addresses are passed as the empty address so that
+// gVisor binds both families for dual-stack endpoints.
+package winsock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// listenBacklog matches the backlog gonet.ListenTCP uses.
+const listenBacklog = 4096
+
+// errV6OnlyMapped reports a v4-mapped destination on an IPV6_V6ONLY socket.
+var errV6OnlyMapped = errors.New("network is unreachable: v4-mapped address on IPV6_V6ONLY socket")
+
+// isDualStack reports whether st is an AF_INET6 socket with IPV6_V6ONLY cleared.
+func isDualStack(st *SocketState) bool {
+	return st.AddressFamily == AF_INET6 && !st.V6Only
+}
+
+// checkDest validates a destination against the socket's IPV6_V6ONLY setting.
+func checkDest(st *SocketState, ap netip.AddrPort) error {
+	if st.AddressFamily == AF_INET6 && st.V6Only && ap.Addr().Is4In6() {
+		return errV6OnlyMapped
+	}
+	return nil
+}
+
+// tcpNetwork returns the netstack dial network matching the socket family.
+func tcpNetwork(st *SocketState) string {
+	switch {
+	case st.AddressFamily == AF_INET:
+		return "tcp4"
+	case st.AddressFamily == AF_INET6 && st.V6Only:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// tcpipFullAddr converts ap into a tcpip.FullAddress on the tunnel NIC.
+func tcpipFullAddr(ap netip.AddrPort) tcpip.FullAddress {
+	fa := tcpip.FullAddress{NIC: 1, Port: ap.Port()}
+	if ap.Addr().IsValid() && !ap.Addr().IsUnspecified() {
+		fa.Addr = tcpip.AddrFromSlice(ap.Addr().AsSlice())
+	}
+	return fa
+}
+
+// newSocketEndpoint creates a transport endpoint for st on the tunnel stack,
+// applying IPV6_V6ONLY before the endpoint is bound.
+func newSocketEndpoint(tnet *netstack.Net, st *SocketState, transport tcpip.TransportProtocolNumber) (tcpip.Endpoint, *waiter.Queue, error) {
+	s := GetTCPIPStack(tnet)
+	if s == nil {
+		return nil, nil, errors.New("netstack internals unavailable")
+	}
+
+	netProto := ipv4.ProtocolNumber
+	if st.AddressFamily == AF_INET6 {
+		netProto = ipv6.ProtocolNumber
+	}
+
+	wq := &waiter.Queue{}
+	ep, tcpipErr := s.NewEndpoint(transport, netProto, wq)
+	if tcpipErr != nil {
+		return nil, nil, errors.New(tcpipErr.String())
+	}
+	if st.AddressFamily == AF_INET6 {
+		ep.SocketOptions().SetV6Only(st.V6Only)
+	}
+	return ep, wq, nil
+}
+
+// listenTCP opens a TCP listener for st on laddr.
+func listenTCP(tnet *netstack.Net, st *SocketState, laddr netip.AddrPort) (net.Listener, error) {
+	ep, wq, err := newSocketEndpoint(tnet, st, tcp.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpipErr := ep.Bind(tcpipFullAddr(laddr)); tcpipErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "bind", Net: "tcp", Addr: net.TCPAddrFromAddrPort(laddr), Err: errors.New(tcpipErr.String())}
+	}
+	if tcpipErr := ep.Listen(listenBacklog); tcpipErr != nil {
+		ep.Close()
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: net.TCPAddrFromAddrPort(laddr), Err: errors.New(tcpipErr.String())}
+	}
+
+	return gonet.NewTCPListener(GetTCPIPStack(tnet), wq, ep), nil
+}
+
+// dialUDP opens a UDP endpoint for st, bound to laddr and connected to raddr
+// when those are valid. A dual-stack endpoint accepts v4-mapped peers.
+func dialUDP(tnet *netstack.Net, st *SocketState, laddr, raddr netip.AddrPort) (net.Conn, error) {
+	if err := checkDest(st, raddr); err != nil {
+		return nil, err
+	}
+
+	ep, wq, err := newSocketEndpoint(tnet, st, udp.ProtocolNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if laddr.IsValid() {
+		if tcpipErr := ep.Bind(tcpipFullAddr(laddr)); tcpipErr != nil {
+			ep.Close()
+			return nil, &net.OpError{Op: "bind", Net: "udp", Addr: net.UDPAddrFromAddrPort(laddr), Err: errors.New(tcpipErr.String())}
+		}
+	}
+
+	conn := gonet.NewUDPConn(wq, ep)
+
+	if raddr.IsValid() {
+		if tcpipErr := ep.Connect(tcpipFullAddr(raddr)); tcpipErr != nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "connect", Net: "udp", Addr: net.UDPAddrFromAddrPort(raddr), Err: errors.New(tcpipErr.String())}
+		}
+	}
+
+	return conn, nil
+}
+
+// dialTCP connects st to raddr. v4-mapped destinations on dual-stack sockets
+// are dialed over the tunnel's IPv4 path.
+func dialTCP(ctx context.Context, tnet *netstack.Net, st *SocketState, raddr netip.AddrPort) (net.Conn, error) {
+	if err := checkDest(st, raddr); err != nil {
+		return nil, err
+	}
+	dest := netip.AddrPortFrom(raddr.Addr().Unmap(), raddr.Port())
+
+	conn, err := tnet.DialContextTCPAddrPort(ctx, dest)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,369 @@
+// endpoint_resolver.go — Peer Endpoint resolution. Hostnames are resolved on the
+// host network into every A and AAAA address (IPv4 first, as wg-quick prefers).
+// A name that does not resolve when a tunnel starts does not fail the tunnel:
+// the peer is configured without an endpoint and a background resolver keeps
+// retrying with backoff. Once everything has resolved, the resolver re-checks
+// each hostname every KLINIKAL_RESOLVE_INTERVAL (default 2m, "0" or "off" to
+// disable) so a DynDNS peer that moves is followed. When the current endpoint
+// has no recent handshake and the name resolves to different addresses, or the
+// peer is not answering the traffic sent to it, each resolved address is tried
+// in turn with a forced handshake initiation and the first one that completes a
+// handshake is kept. Idle peers are not probed. Endpoint changes are applied
+// with update_only UAPI sets.
+package winsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	envResolveInterval     = "KLINIKAL_RESOLVE_INTERVAL"
+	defaultResolveInterval = 2 * time.Minute
+	resolveRetryMin        = 5 * time.Second
+	resolveTimeout         = 10 * time.Second
+	handshakeProbeTimeout  = device.RekeyTimeout + time.Second
+	handshakeFresh         = device.RejectAfterTime
+)
+
+// resolveInterval is how often resolved hostnames are checked again; zero
+// turns the periodic check off (unresolved names are still retried).
+var resolveInterval = parseResolveInterval(os.Getenv(envResolveInterval))
+
+func parseResolveInterval(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return defaultResolveInterval
+	case s == "0" || strings.EqualFold(s, "off"):
+		return 0
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	LogNotice("%s=%q is not a duration, using %v", envResolveInterval, s, defaultResolveInterval)
+	return defaultResolveInterval
+}
+
+// resolveEndpointAddrs resolves a peer Endpoint (host:port or [v6]:port) on
+// the host network into all of its addresses, IPv4 first.
+func resolveEndpointAddrs(ctx context.Context, endpoint string) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.AddrPort{netip.AddrPortFrom(ip.Unmap(), uint16(port))}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no IPs found for host")
+	}
+	addrs := make([]netip.AddrPort, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, netip.AddrPortFrom(ip.Unmap(), uint16(port)))
+	}
+	slices.SortStableFunc(addrs, func(a, b netip.AddrPort) int {
+		switch {
+		case a.Addr().Is4() == b.Addr().Is4():
+			return 0
+		case a.Addr().Is4():
+			return -1
+		}
+		return 1
+	})
+	return addrs, nil
+}
+
+// resolveEndpoint resolves endpoint to its preferred address.
+func resolveEndpoint(endpoint string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := resolveEndpointAddrs(ctx, endpoint)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0].String(), nil
+}
+
+// isHostnameEndpoint reports whether endpoint names a host rather than an IP.
+func isHostnameEndpoint(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false
+	}
+	_, err = netip.ParseAddr(host)
+	return err != nil
+}
+
+// startResolver runs the endpoint resolver of t until t is stopped.
+func (t *tunnel) startResolver() {
+	if t.Device == nil {
+		return
+	}
+	t.resolverStop = make(chan struct{})
+	t.resolverKick = make(chan struct{}, 1)
+	go t.resolveLoop(t.resolverStop, t.resolverKick)
+}
+
+// kickResolver makes the resolver look at the peers again right away, after
+// a reload may have changed their endpoints.
+func (t *tunnel) kickResolver() {
+	select {
+	case t.resolverKick <- struct{}{}:
+	default:
+	}
+}
+
+// resolveLoop refreshes the hostname endpoints of t: soon and with backoff
+// while some are unresolved or unreachable, then every resolveInterval (or
+// only when kicked if that is zero).
+func (t *tunnel) resolveLoop(stop, kick chan struct{}) {
+	retryMax := resolveInterval
+	if retryMax == 0 {
+		retryMax = defaultResolveInterval
+	}
+
+	pending := t.hasPendingEndpoints()
+	delay := resolveRetryMin
+	watches := make(map[wgKey]*endpointWatch)
+	for {
+		// A nil timer channel never fires: idle until kicked
+		var timer *time.Timer
+		var wait <-chan time.Time
+		switch {
+		case pending:
+			timer = time.NewTimer(delay)
+		case resolveInterval != 0:
+			timer = time.NewTimer(resolveInterval)
+		}
+		if timer != nil {
+			wait = timer.C
+		}
+
+		select {
+		case <-stop:
+		case <-kick:
+		case <-wait:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if stopped(stop) {
+			return
+		}
+
+		wasPending := pending
+		pending = t.refreshEndpoints(stop, watches)
+		if pending && wasPending {
+			delay = min(delay*2, retryMax)
+		} else {
+			delay = resolveRetryMin
+		}
+	}
+}
+
+// hostnamePeers returns the peers of t whose Endpoint is a hostname, or none
+// once stop is closed.
+func (t *tunnel) hostnamePeers(stop chan struct{}) map[wgKey]string {
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+
+	peers := make(map[wgKey]string)
+	if t.applied == nil || stopped(stop) {
+		return peers
+	}
+	for pub, p := range t.applied.Peers {
+		if isHostnameEndpoint(p.Endpoint) {
+			peers[pub] = p.Endpoint
+		}
+	}
+	return peers
+}
+
+// hasPendingEndpoints reports whether a hostname peer has no endpoint yet.
+func (t *tunnel) hasPendingEndpoints() bool {
+	for pub := range t.hostnamePeers(nil) {
+		if st, ok := peerStatsFor(t.Device, pub); !ok || st.Endpoint == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointWatch is what the resolver remembers of a hostname peer between
+// refreshes.
+type endpointWatch struct {
+	addrs  []netip.AddrPort // resolved at the last refresh; nil before the first
+	rx, tx uint64           // transfer counters after the last refresh
+}
+
+// refreshEndpoints resolves every hostname peer again and moves peers whose
+// current endpoint is stale or not handshaking. It reports whether a peer is
+// still unresolved or without a working address, so the caller retries soon.
+// watches carries the state of each peer from one refresh to the next.
+func (t *tunnel) refreshEndpoints(stop chan struct{}, watches map[wgKey]*endpointWatch) (pending bool) {
+	peers := t.hostnamePeers(stop)
+	for pub := range watches {
+		if _, ok := peers[pub]; !ok {
+			delete(watches, pub)
+		}
+	}
+	for pub, endpoint := range peers {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		addrs, err := resolveEndpointAddrs(ctx, endpoint)
+		cancel()
+		if err != nil {
+			LogNotice("tunnel %s: peer %s: cannot resolve Endpoint %q: %v (retrying)", t.Name, pub.Hex()[:8], endpoint, err)
+			pending = true
+			continue
+		}
+		w := watches[pub]
+		if w == nil {
+			w = &endpointWatch{}
+			watches[pub] = w
+		}
+		if !t.selectEndpoint(pub, endpoint, addrs, w, stop) {
+			pending = true
+		}
+		if st, ok := peerStatsFor(t.Device, pub); ok {
+			// Sampled after probing so the probes are not taken for traffic
+			w.addrs, w.rx, w.tx = addrs, st.RxBytes, st.TxBytes
+		}
+	}
+	return pending
+}
+
+// selectEndpoint probes addrs in order and moves the peer to the first that
+// completes a handshake, reporting whether one did. It only does so when the
+// peer has no endpoint yet, or has gone without a handshake for handshakeFresh
+// and either the name now resolves to a different set of addresses or the
+// peer was sent traffic it did not answer since the last refresh (w). A peer
+// that is merely idle is left alone.
+func (t *tunnel) selectEndpoint(pub wgKey, endpoint string, addrs []netip.AddrPort, w *endpointWatch, stop chan struct{}) bool {
+	st, ok := peerStatsFor(t.Device, pub)
+	if !ok {
+		return true // removed by a reload meanwhile
+	}
+	current, _ := netip.ParseAddrPort(st.Endpoint)
+	current = netip.AddrPortFrom(current.Addr().Unmap(), current.Port())
+	if time.Since(st.LastHandshake) < handshakeFresh {
+		return true
+	}
+	changed := w.addrs != nil && !sameAddrs(addrs, w.addrs)
+	stalled := w.addrs != nil && st.TxBytes > w.tx && st.RxBytes == w.rx
+	if current.IsValid() && !changed && !stalled {
+		return true
+	}
+
+	// Try the current address first, then the rest in preference order
+	candidates := addrs
+	if i := slices.Index(addrs, current); i > 0 {
+		candidates = append([]netip.AddrPort{current}, slices.Delete(slices.Clone(addrs), i, i+1)...)
+	}
+	for _, cand := range candidates {
+		if !t.setPeerEndpoint(pub, endpoint, cand, stop) {
+			return true
+		}
+		if t.probeHandshake(pub, stop) {
+			if cand != current {
+				LogNotice("tunnel %s: peer %s: Endpoint %q now at %s", t.Name, pub.Hex()[:8], endpoint, cand)
+			}
+			return true
+		}
+		if stopped(stop) {
+			return true
+		}
+	}
+
+	// Nothing answered; leave the preferred address in place and retry later
+	t.setPeerEndpoint(pub, endpoint, addrs[0], stop)
+	return false
+}
+
+// sameAddrs reports whether a and b hold the same addresses in any order.
+func sameAddrs(a, b []netip.AddrPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ap := range a {
+		if !slices.Contains(b, ap) {
+			return false
+		}
+	}
+	return true
+}
+
+// setPeerEndpoint points the peer at addr, unless the tunnel was stopped or a
+// reload changed its configured Endpoint in the meantime. It reports whether
+// it did.
+func (t *tunnel) setPeerEndpoint(pub wgKey, endpoint string, addr netip.AddrPort, stop chan struct{}) bool {
+	// stop is closed under the write lock, so it cannot close while held here
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	peer, ok := t.applied.Peers[pub]
+	if stopped(stop) || !ok || peer.Endpoint != endpoint {
+		return false
+	}
+	set := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", pub.Hex(), uapiEndpoint(peer.Transport, addr.String()))
+	if err := t.Device.IpcSet(set); err != nil {
+		LogNotice("tunnel %s: peer %s: cannot set endpoint %s: %v", t.Name, pub.Hex()[:8], addr, err)
+		return false
+	}
+	return true
+}
+
+// probeHandshake initiates a handshake with the peer and waits for it to
+// complete on the endpoint just set.
+func (t *tunnel) probeHandshake(pub wgKey, stop chan struct{}) bool {
+	peer := t.Device.LookupPeer(device.NoisePublicKey(pub))
+	if peer == nil {
+		return false
+	}
+	start := time.Now()
+	peer.SendHandshakeInitiation(false)
+
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	deadline := time.NewTimer(handshakeProbeTimeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-stop:
+			return false
+		case <-deadline.C:
+			return false
+		case <-tick.C:
+			if st, ok := peerStatsFor(t.Device, pub); ok && st.LastHandshake.After(start) {
+				return true
+			}
+		}
+	}
+}
+
+// stopped reports whether stop has been closed; a nil stop never is.
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
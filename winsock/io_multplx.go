@@ -1,11 +1,11 @@
 // io_multplx.go — I/O multiplexing and event-driven notification. Implements
 // select (iterates fd_sets, probes read/write readiness via short-deadline I/O,
-// modifies sets on return), WSAPoll (iterates WSAPOLLFD array and sets revents),
-// WSAEventSelect (associates an event handle and network event mask with a socket,
-// spawning a background monitor goroutine), WSAEnumNetworkEvents (returns and
-// atomically resets accumulated fired events), and WSAAsyncSelect (returns
-// WSAEOPNOTSUPP). Also stubs ProcessSocketNotifications and
-// SocketNotificationRetrieveEvents.
+// reports failed connects in exceptfds, modifies sets on return), WSAPoll
+// (iterates WSAPOLLFD array and sets revents), WSAEventSelect (associates an
+// event handle and network event mask with a socket, spawning a background
+// monitor goroutine), WSAEnumNetworkEvents (returns and atomically resets
+// accumulated fired events), and WSAAsyncSelect (returns WSAEOPNOTSUPP). Also
+// stubs ProcessSocketNotifications and SocketNotificationRetrieveEvents.
 package winsock
 
 import (
@@ -76,8 +76,8 @@ func (c channelNotifier) NotifyEvent(mask waiter.EventMask) {
 
 // checkReadReady probes whether a socket has data available for reading.
 func checkReadReady(st *SocketState) bool {
-	if st.Endpoint != nil {
-		mask := st.Endpoint.Readiness(waiter.EventIn | waiter.EventErr | waiter.EventHUp)
+	if ready, _, _ := st.pollView(); ready != nil {
+		mask := ready.Readiness(waiter.EventIn | waiter.EventErr | waiter.EventHUp)
 		return mask&(waiter.EventIn|waiter.EventErr|waiter.EventHUp) != 0
 	}
 	if st.Listener != nil {
@@ -88,12 +88,14 @@ func checkReadReady(st *SocketState) bool {
 
 // checkWriteReady checks if a socket can accept data for writing.
 func checkWriteReady(st *SocketState) bool {
-	if st.Endpoint != nil {
-		mask := st.Endpoint.Readiness(waiter.EventOut | waiter.EventErr | waiter.EventHUp)
+	ready, _, conn := st.pollView()
+	if ready != nil {
+		mask := ready.Readiness(waiter.EventOut | waiter.EventErr | waiter.EventHUp)
 		return mask&(waiter.EventOut|waiter.EventErr|waiter.EventHUp) != 0
 	}
-	if st.Conn == nil {
-		return false
+	if conn == nil {
+		// A sendto that hit an on-demand bring-up can be retried once it ends
+		return st.AwaitingStack.Load() && stackWakeDone()
 	}
 	return true
 }
@@ -120,10 +122,11 @@ func GoSelect(nfds int32, readfds unsafe.Pointer, writefds unsafe.Pointer, excep
 	}
 
 	// Helper to check readiness
-	checkReadiness := func() (int32, []uint32, []uint32) {
+	checkReadiness := func() (int32, []uint32, []uint32, []uint32) {
 		readyCount := int32(0)
 		var readRes []uint32
 		var writeRes []uint32
+		var exceptRes []uint32
 
 		if readfds != nil {
 			rs := (*fd_set)(readfds)
@@ -149,13 +152,33 @@ func GoSelect(nfds int32, readfds unsafe.Pointer, writefds unsafe.Pointer, excep
 			}
 		}
 
-		// exceptfds — we don't track OOB, just clear
+		// exceptfds — OOB is not tracked; only failed connects are reported
 		if exceptfds != nil {
 			es := (*fd_set)(exceptfds)
-			es.Count = 0
+			for i := uint32(0); i < es.Count; i++ {
+				if st, ok := registry.Get(uint64(es.Array[i])); ok && atomic.LoadInt32(&st.ConnectError) != 0 {
+					exceptRes = append(exceptRes, es.Array[i])
+					readyCount++
+				}
+			}
 		}
 
-		return readyCount, readRes, writeRes
+		return readyCount, readRes, writeRes, exceptRes
+	}
+
+	// Rewrite the fd_sets with the ready sockets
+	writeSets := func(readRes, writeRes, exceptRes []uint32) {
+		for _, set := range []struct {
+			fds unsafe.Pointer
+			res []uint32
+		}{{readfds, readRes}, {writefds, writeRes}, {exceptfds, exceptRes}} {
+			if set.fds == nil {
+				continue
+			}
+			fs := (*fd_set)(set.fds)
+			fs.Count = uint32(len(set.res))
+			copy(fs.Array[:], set.res)
+		}
 	}
 
 	// Register waiters
@@ -172,17 +195,27 @@ func GoSelect(nfds int32, readfds unsafe.Pointer, writefds unsafe.Pointer, excep
 		}
 		fs := (*fd_set)(fds)
 		for i := uint32(0); i < fs.Count; i++ {
-			if st, ok := registry.Get(uint64(fs.Array[i])); ok && st.WaiterQueue != nil {
+			st, ok := registry.Get(uint64(fs.Array[i]))
+			if !ok {
+				continue
+			}
+			// The state queue reports a background connect finishing
+			_, queue, _ := st.pollView()
+			for _, wq := range []*waiter.Queue{queue, &st.StateQueue} {
+				if wq == nil {
+					continue
+				}
 				entry := &waiter.Entry{}
 				entry.Init(ch, mask)
-				st.WaiterQueue.EventRegister(entry)
-				regs = append(regs, registration{wq: st.WaiterQueue, entry: entry})
+				wq.EventRegister(entry)
+				regs = append(regs, registration{wq: wq, entry: entry})
 			}
 		}
 	}
 
 	register(readfds, waiter.EventIn|waiter.EventErr|waiter.EventHUp)
 	register(writefds, waiter.EventOut|waiter.EventErr|waiter.EventHUp)
+	register(exceptfds, waiter.EventErr)
 
 	unregister := func() {
 		for _, reg := range regs {
@@ -192,22 +225,9 @@ func GoSelect(nfds int32, readfds unsafe.Pointer, writefds unsafe.Pointer, excep
 	defer unregister()
 
 	// First pass: check if any are already ready
-	readyCount, readRes, writeRes := checkReadiness()
+	readyCount, readRes, writeRes, exceptRes := checkReadiness()
 	if readyCount > 0 || (!infinite && waitTime == 0) {
-		if readfds != nil {
-			rs := (*fd_set)(readfds)
-			rs.Count = uint32(len(readRes))
-			for i := 0; i < len(readRes); i++ {
-				rs.Array[i] = readRes[i]
-			}
-		}
-		if writefds != nil {
-			ws := (*fd_set)(writefds)
-			ws.Count = uint32(len(writeRes))
-			for i := 0; i < len(writeRes); i++ {
-				ws.Array[i] = writeRes[i]
-			}
-		}
+		writeSets(readRes, writeRes, exceptRes)
 		return readyCount
 	}
 
@@ -222,29 +242,16 @@ func GoSelect(nfds int32, readfds unsafe.Pointer, writefds unsafe.Pointer, excep
 	}
 
 	// Final pass: check readiness again
-	readyCount, readRes, writeRes = checkReadiness()
-	if readfds != nil {
-		rs := (*fd_set)(readfds)
-		rs.Count = uint32(len(readRes))
-		for i := 0; i < len(readRes); i++ {
-			rs.Array[i] = readRes[i]
-		}
-	}
-	if writefds != nil {
-		ws := (*fd_set)(writefds)
-		ws.Count = uint32(len(writeRes))
-		for i := 0; i < len(writeRes); i++ {
-			ws.Array[i] = writeRes[i]
-		}
-	}
+	readyCount, readRes, writeRes, exceptRes = checkReadiness()
+	writeSets(readRes, writeRes, exceptRes)
 	return readyCount
 }
 
 // goWSAPoll determines the status of one or more sockets.
-func GoWSAPoll(fdArray unsafe.Pointer, fds uint32, timeout int32) int32 {
+func GoWSAPoll(t Thread, fdArray unsafe.Pointer, fds uint32, timeout int32) int32 {
 	LogCall("WSAPoll", fdArray, fds, timeout)
 	if fdArray == nil || fds == 0 {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
 
@@ -273,8 +280,12 @@ func GoWSAPoll(fdArray unsafe.Pointer, fds uint32, timeout int32) int32 {
 				continue
 			}
 
-			if st.Endpoint != nil {
-				mask := st.Endpoint.Readiness(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
+			if atomic.LoadInt32(&st.ConnectError) != 0 {
+				entry.Revents |= POLLERR
+			}
+
+			if ready, _, _ := st.pollView(); ready != nil {
+				mask := ready.Readiness(waiter.EventIn | waiter.EventOut | waiter.EventErr | waiter.EventHUp)
 				if mask&waiter.EventErr != 0 {
 					entry.Revents |= POLLERR
 				}
@@ -320,7 +331,7 @@ func GoWSAPoll(fdArray unsafe.Pointer, fds uint32, timeout int32) int32 {
 		fdSocket := uint64(pe.FD)
 		events := pe.Events
 
-		if st, ok := registry.Get(fdSocket); ok && st.WaiterQueue != nil {
+		if st, ok := registry.Get(fdSocket); ok {
 			mask := waiter.EventErr | waiter.EventHUp
 			if events&(POLLIN|POLLRDNORM) != 0 {
 				mask |= waiter.EventIn
@@ -328,11 +339,16 @@ func GoWSAPoll(fdArray unsafe.Pointer, fds uint32, timeout int32) int32 {
 			if events&(POLLOUT|POLLWRNORM) != 0 {
 				mask |= waiter.EventOut
 			}
-			if mask != 0 {
+			// The state queue reports a background connect finishing
+			_, queue, _ := st.pollView()
+			for _, wq := range []*waiter.Queue{queue, &st.StateQueue} {
+				if wq == nil {
+					continue
+				}
 				wEntry := &waiter.Entry{}
 				wEntry.Init(ch, mask)
-				st.WaiterQueue.EventRegister(wEntry)
-				regs = append(regs, registration{wq: st.WaiterQueue, entry: wEntry})
+				wq.EventRegister(wEntry)
+				regs = append(regs, registration{wq: wq, entry: wEntry})
 			}
 		}
 	}
@@ -366,19 +382,19 @@ func GoWSAPoll(fdArray unsafe.Pointer, fds uint32, timeout int32) int32 {
 
 // goWSAAsyncSelect requests Windows message-based notification of network events for a socket.
 // Not supported in non-Windows bridge — returns WSAEOPNOTSUPP.
-func GoWSAAsyncSelect(s uint64, hWnd unsafe.Pointer, wMsg uint32, lEvent int32) int32 {
+func GoWSAAsyncSelect(t Thread, s uint64, hWnd unsafe.Pointer, wMsg uint32, lEvent int32) int32 {
 	LogCall("WSAAsyncSelect", s, hWnd, wMsg, lEvent)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return -1
 }
 
 // goWSAEventSelect associates network events with an event object.
-func GoWSAEventSelect(s uint64, hEventObject unsafe.Pointer, lNetworkEvents int32) int32 {
+func GoWSAEventSelect(t Thread, s uint64, hEventObject unsafe.Pointer, lNetworkEvents int32) int32 {
 	LogCall("WSAEventSelect", s, hEventObject, lNetworkEvents)
 
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
@@ -387,11 +403,15 @@ func GoWSAEventSelect(s uint64, hEventObject unsafe.Pointer, lNetworkEvents int3
 	// Verify the event handle exists
 	if hEventObject != nil {
 		if _, ok := registry.GetEvent(handle); !ok {
-			setLastError(WSAEINVAL)
+			t.setLastError(WSAEINVAL)
 			return -1
 		}
 	}
 
+	// The waiter fields change under stateMu, as in UpdateWaiterQueue
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+
 	// Unregister existing waiter if any
 	if st.WaiterEntry != nil && st.WaiterQueue != nil {
 		st.WaiterQueue.EventUnregister(st.WaiterEntry)
@@ -423,8 +443,8 @@ func GoWSAEventSelect(s uint64, hEventObject unsafe.Pointer, lNetworkEvents int3
 			st.WaiterQueue.EventRegister(st.WaiterEntry)
 
 			// Trigger an initial notification to catch already-ready events
-			if st.Endpoint != nil {
-				readyMask := st.Endpoint.Readiness(mask)
+			if st.Ready != nil {
+				readyMask := st.Ready.Readiness(mask)
 				if readyMask != 0 {
 					st.NotifyEvent(readyMask)
 				}
@@ -440,17 +460,17 @@ func GoWSAEventSelect(s uint64, hEventObject unsafe.Pointer, lNetworkEvents int3
 
 // goWSAEnumNetworkEvents discovers occurrences of network events for the specified socket.
 // Returns accumulated events and resets them. Optionally resets the event object.
-func GoWSAEnumNetworkEvents(s uint64, hEventObject unsafe.Pointer, lpNetworkEvents unsafe.Pointer) int32 {
+func GoWSAEnumNetworkEvents(t Thread, s uint64, hEventObject unsafe.Pointer, lpNetworkEvents unsafe.Pointer) int32 {
 	LogCall("WSAEnumNetworkEvents", s, hEventObject, lpNetworkEvents)
 
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
 	if lpNetworkEvents == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
@@ -466,9 +486,12 @@ func GoWSAEnumNetworkEvents(s uint64, hEventObject unsafe.Pointer, lpNetworkEven
 	fired := atomic.SwapInt32(&st.FiredEvents, 0)
 	result.NetworkEvents = fired
 
-	// Clear error codes (no errors tracked currently)
+	// Report the error codes of the fired events and reset them
 	for i := range result.ErrorCode {
 		result.ErrorCode[i] = 0
+		if fired&(1<<i) != 0 {
+			result.ErrorCode[i] = atomic.SwapInt32(&st.EventErrors[i], 0)
+		}
 	}
 
 	// Reset the event object if provided
@@ -486,15 +509,15 @@ func GoWSAEnumNetworkEvents(s uint64, hEventObject unsafe.Pointer, lpNetworkEven
 }
 
 // goProcessSocketNotifications — Windows completion port integration (not applicable).
-func GoProcessSocketNotifications(completionPort unsafe.Pointer, registrationCount uint32, registrationInfos unsafe.Pointer, timeout uint32, completionCount uint32, completionInfos unsafe.Pointer, receivedCount *uint32) int32 {
+func GoProcessSocketNotifications(t Thread, completionPort unsafe.Pointer, registrationCount uint32, registrationInfos unsafe.Pointer, timeout uint32, completionCount uint32, completionInfos unsafe.Pointer, receivedCount *uint32) int32 {
 	LogCall("ProcessSocketNotifications", completionPort, registrationCount, registrationInfos, timeout, completionCount, completionInfos, receivedCount)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return -1
 }
 
 // goSocketNotificationRetrieveEvents — Windows completion port integration (not applicable).
-func GoSocketNotificationRetrieveEvents(notificationRegistration unsafe.Pointer, notificationEvents unsafe.Pointer) int32 {
+func GoSocketNotificationRetrieveEvents(t Thread, notificationRegistration unsafe.Pointer, notificationEvents unsafe.Pointer) int32 {
 	LogCall("SocketNotificationRetrieveEvents", notificationRegistration, notificationEvents)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return -1
 }
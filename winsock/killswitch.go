@@ -0,0 +1,314 @@
+// killswitch.go — Behaviour while no tunnel is available. In fail-closed mode
+// (the default) every network call on a tunnel socket fails with WSAENETDOWN
+// and name lookups fail until a tunnel is up again, so nothing leaks onto the
+// host network; KLINIKAL_STRICT_STARTUP=1 additionally makes WSAStartup fail
+// with WSASYSNOTREADY when the stack cannot start. In fail-open mode
+// (KLINIKAL_FAILMODE=open) sockets that cannot get a tunnel fall back to the
+// direct host-network backend. Sockets the split rules already send direct are
+// not affected: they are routed before the kill switch is consulted.
+//
+// A tunnel is down when the stack cannot start, when its device has been
+// closed, or when it stops handshaking after it came up: every peer it
+// initiates to has gone RejectAfterTime without a handshake while being sent
+// traffic it did not answer. It is up again once a handshake completes, which
+// the health monitor keeps initiating meanwhile. The monitor checks the
+// tunnels every healthInterval and after each reload; socket calls only read
+// its cached verdict. Every change of state is logged with the reason.
+package winsock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	envFailMode      = "KLINIKAL_FAILMODE"
+	envStrictStartup = "KLINIKAL_STRICT_STARTUP"
+
+	healthInterval = 5 * time.Second // how often the monitor checks the tunnels
+	healthRetry    = 5 * time.Second // how long a failed stack start is reported before retrying
+)
+
+// failOpen selects the fail-open policy; fail-closed is the default.
+var (
+	failOpen      = strings.EqualFold(strings.TrimSpace(os.Getenv(envFailMode)), "open")
+	strictStartup = parseBoolDefault(os.Getenv(envStrictStartup), false)
+)
+
+// errNetDown is returned for tunnel traffic while the kill switch is engaged.
+var errNetDown = errors.New("network is down: no tunnel available")
+
+var (
+	healthMu   sync.Mutex
+	healthDown bool   // last reported state
+	healthWhy  string // reason last reported while down
+)
+
+// healthState is the kill switch's cached view of the tunnels. Socket calls
+// read it without locking; stack start and stop and the health monitor
+// replace it.
+type healthState struct {
+	err     error             // why no tunnel can carry traffic; nil if one can
+	down    map[Backend]error // tunnels that cannot carry traffic, and why
+	stopped bool              // the stack is not running
+	retry   time.Time         // while stopped: earliest next start attempt
+}
+
+var (
+	health     atomic.Pointer[healthState] // nil until the stack first starts
+	healthKick = make(chan struct{}, 1)    // wakes the monitor after a reload
+)
+
+// tunnelHealth reports why no tunnel can carry traffic, or nil if one can.
+// While the stack is not running it is started lazily like every socket call
+// does, retried at most every healthRetry after a failure; otherwise the
+// monitor's cached verdict is returned.
+func tunnelHealth() error {
+	h := health.Load()
+	if h != nil && (!h.stopped || time.Now().Before(h.retry)) {
+		return h.err
+	}
+	if err := ensureStack(); err != nil {
+		setHealth(nil, &healthState{err: err, stopped: true, retry: time.Now().Add(healthRetry)})
+		return err
+	}
+	if h = health.Load(); h != nil && !h.stopped {
+		return h.err
+	}
+	return nil
+}
+
+// backendHealth reports why the tunnel behind b cannot carry traffic, or nil.
+func backendHealth(b Backend) error {
+	if err := tunnelHealth(); err != nil {
+		return err
+	}
+	return health.Load().downErr(b)
+}
+
+// downErr reports why the tunnel behind b is down in h, or nil.
+func (h *healthState) downErr(b Backend) error {
+	if h == nil {
+		return nil
+	}
+	return h.down[b]
+}
+
+// setHealth publishes h and logs a change of state. A monitor passes its stop
+// channel so that it cannot overwrite the state of a stack stopped meanwhile.
+func setHealth(stop chan struct{}, h *healthState) {
+	healthMu.Lock()
+	if stop != nil && stopped(stop) {
+		healthMu.Unlock()
+		return
+	}
+	health.Store(h)
+	healthMu.Unlock()
+	reportHealth(h.err)
+}
+
+// healthStarted marks a freshly started stack as up and, if stop is non-nil,
+// starts its health monitor. Caller holds stackMu.
+func healthStarted(stop chan struct{}) {
+	setHealth(nil, &healthState{})
+	if stop != nil {
+		go healthMonitor(stop)
+	}
+}
+
+// healthStopped marks the stack as not running, so the next socket call
+// starts it again. Caller holds stackMu and has closed the monitor's stop
+// channel.
+func healthStopped() {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	health.Store(&healthState{err: errors.New("stack not running"), stopped: true})
+}
+
+// kickHealth has the monitor check the tunnels now rather than at its next
+// tick.
+func kickHealth() {
+	select {
+	case healthKick <- struct{}{}:
+	default:
+	}
+}
+
+// reportHealth logs a transition between tunnel up and down, with the reason
+// and what the active policy does about it.
+func reportHealth(err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	if err == nil {
+		if healthDown {
+			healthDown, healthWhy = false, ""
+			LogNotice("tunnel is up, kill switch released")
+		}
+		return
+	}
+	if healthDown && healthWhy == err.Error() {
+		return
+	}
+	healthDown, healthWhy = true, err.Error()
+	if failOpen {
+		LogNotice("tunnel unavailable (%v); fail-open: traffic goes directly over the host network", err)
+	} else {
+		LogNotice("tunnel unavailable (%v); fail-closed: network calls return WSAENETDOWN", err)
+	}
+}
+
+// healthMonitor checks the running tunnels every healthInterval, and when
+// kicked, until stop is closed.
+func healthMonitor(stop chan struct{}) {
+	tick := time.NewTicker(healthInterval)
+	defer tick.Stop()
+
+	watches := make(map[*tunnel]*tunnelWatch)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-healthKick:
+		case <-tick.C:
+		}
+
+		stackMu.RLock()
+		tunnels := globalTunnels
+		stackMu.RUnlock()
+
+		now := time.Now()
+		h := &healthState{}
+		seen := make(map[*tunnel]bool, len(tunnels))
+		var whys []string
+		for _, t := range tunnels {
+			seen[t] = true
+			w := watches[t]
+			if w == nil {
+				w = &tunnelWatch{}
+				watches[t] = w
+			}
+			if err := w.check(t, now); err != nil {
+				if h.down == nil {
+					h.down = make(map[Backend]error)
+				}
+				h.down[t.Backend] = err
+				whys = append(whys, err.Error())
+			}
+		}
+		for t := range watches {
+			if !seen[t] {
+				delete(watches, t)
+			}
+		}
+		if len(tunnels) == 0 {
+			h.err = errors.New("no tunnel is running")
+		} else if len(h.down) == len(tunnels) {
+			h.err = errors.New(strings.Join(whys, "; "))
+		}
+		setHealth(stop, h)
+	}
+}
+
+// peerSample is the transfer counters of a peer at the previous check.
+type peerSample struct {
+	rx, tx uint64
+}
+
+// tunnelWatch is what the monitor remembers of one tunnel between checks.
+type tunnelWatch struct {
+	peers     map[wgKey]peerSample
+	downSince time.Time // zero while up
+}
+
+// check reports why t cannot carry traffic, or nil. A tunnel still waiting for
+// its first handshake is left to the readiness gate (see tunnel_ready.go).
+func (w *tunnelWatch) check(t *tunnel, now time.Time) error {
+	if t.Device == nil {
+		return nil
+	}
+	select {
+	case <-t.Device.Wait():
+		return fmt.Errorf("tunnel %s: device closed", t.Name)
+	default:
+	}
+	if !t.ready.isReady() {
+		return nil
+	}
+	stats, err := readDeviceStats(t.Device)
+	if err != nil {
+		return fmt.Errorf("tunnel %s: %v", t.Name, err)
+	}
+
+	// Only peers the device has an endpoint for are initiated to; an idle
+	// peer is not failing, one sent traffic it does not answer is
+	var initiating []wgKey
+	var failing int
+	var lastHandshake time.Time
+	samples := make(map[wgKey]peerSample, len(stats.Peers))
+	for _, p := range stats.Peers {
+		samples[p.PublicKey] = peerSample{rx: p.RxBytes, tx: p.TxBytes}
+		if p.Endpoint == "" {
+			continue
+		}
+		initiating = append(initiating, p.PublicKey)
+		if p.LastHandshake.After(lastHandshake) {
+			lastHandshake = p.LastHandshake
+		}
+		prev, seen := w.peers[p.PublicKey]
+		if seen && now.Sub(p.LastHandshake) >= device.RejectAfterTime && p.TxBytes > prev.tx && p.RxBytes == prev.rx {
+			failing++
+		}
+	}
+	w.peers = samples
+
+	switch {
+	case w.downSince.IsZero() && (len(initiating) == 0 || failing < len(initiating)):
+		return nil
+	case w.downSince.IsZero():
+		w.downSince = now
+		LogNotice("tunnel %s: peers stopped answering, down until a handshake completes", t.Name)
+	case lastHandshake.After(w.downSince):
+		w.downSince = time.Time{}
+		LogNotice("tunnel %s: handshake completed, up again", t.Name)
+		return nil
+	}
+
+	t.initiateHandshakes(initiating)
+	if lastHandshake.IsZero() {
+		return fmt.Errorf("tunnel %s: no peer answers handshakes", t.Name)
+	}
+	return fmt.Errorf("tunnel %s: no handshake for %v", t.Name, now.Sub(lastHandshake).Round(time.Second))
+}
+
+// fallbackBackend returns the backend to use when no tunnel could be had for a
+// socket: the host network in fail-open mode, otherwise errNetDown.
+func fallbackBackend(cause error) (Backend, error) {
+	if failOpen {
+		return hostBackend, nil
+	}
+	return nil, fmt.Errorf("%w (%v)", errNetDown, cause)
+}
+
+// netDown reports whether a call on st must fail because the kill switch is
+// engaged for the tunnel st is on, setting WSAENETDOWN if so. Sockets not yet
+// on a backend are checked when they are routed (see socketBackend); sockets on
+// the host network and any socket in fail-open mode are never blocked.
+func netDown(t Thread, st *SocketState) bool {
+	b := st.backend()
+	if failOpen || b == nil || b == hostBackend {
+		return false
+	}
+	if backendHealth(b) != nil {
+		t.setLastError(WSAENETDOWN)
+		return true
+	}
+	return false
+}
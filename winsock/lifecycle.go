@@ -1,10 +1,13 @@
 // lifecycle.go — WSA lifecycle management. Implements WSAStartup (reference-counted
 // initialization that populates a WSADATA struct with version 2.2, description, and
-// system status) and WSACleanup (decrements the reference count and calls PurgeAll
+// system status; fails with WSASYSNOTREADY under KLINIKAL_STRICT_STARTUP when
+// the tunnel cannot start, and leaves the tunnel down in on-demand mode, see
+// on_demand.go) and WSACleanup (decrements the reference count and calls PurgeAll
 // to close all sockets when the last consumer cleans up).
 package winsock
 
 import (
+	"errors"
 	"sync"
 	"unsafe"
 )
@@ -42,9 +45,31 @@ func GoWSAStartup(wVersionRequested uint16, lpWSAData unsafe.Pointer) int32 {
 		data.iMaxUdpDg = 65467
 	}
 
-	// Phase 5: Initialize WireGuard stack during WSAStartup
-	// We ignore the error as the stack will try to auto-init on first GetStack call if possible
-	_ = InitializeStack("wg.conf")
+	// Phase 5: Initialize WireGuard stack during WSAStartup, unless it is
+	// brought up on demand by the first call that needs it. A failure is left
+	// to the kill switch (the stack is retried on the next socket call) unless
+	// strict startup asks WSAStartup itself to fail.
+	if onDemand {
+		LogCall("OnDemand", "stack deferred to first use")
+	} else if err := InitializeDefaultStack(); errors.Is(err, errNotReady) {
+		// Up but without a handshake yet; calls fail fast until one completes
+		if lpWSAData != nil {
+			data := (*wsaData)(lpWSAData)
+			data.szSystemStatus = [129]byte{}
+			copy(data.szSystemStatus[:], "Tunnel not ready")
+		}
+	} else if err != nil {
+		reportHealth(err)
+		if strictStartup && !failOpen {
+			wsaRefCount--
+			return WSASYSNOTREADY
+		}
+		if lpWSAData != nil {
+			data := (*wsaData)(lpWSAData)
+			data.szSystemStatus = [129]byte{}
+			copy(data.szSystemStatus[:], "Tunnel unavailable")
+		}
+	}
 
 	return 0
 }
@@ -22,3 +22,10 @@ func LogCall(funcName string, args ...interface{}) {
 	}
 	return
 }
+
+// LogNotice reports a state change the user should know about (tunnel down,
+// kill switch engaged). Unlike LogCall it is always printed, to stderr.
+func LogNotice(format string, args ...interface{}) {
+	timestamp := time.Now().Format("15:04:05.000")
+	fmt.Fprintf(os.Stderr, "[%s] KLINIKAL: %s\n", timestamp, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+// moddir_other.go — Non-Windows fallback for locating the KLINIKAL module
+// directory. Shared-object builds have no portable way to find their own path,
+// so the host executable's directory stands in for it.
+package winsock
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// moduleDir returns the directory of the host executable.
+func moduleDir() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(exe), nil
+}
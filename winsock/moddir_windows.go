@@ -0,0 +1,33 @@
+// moddir_windows.go — Locates the directory of the loaded KLINIKAL DLL by
+// asking the loader which module contains one of our own functions, since the
+// host process's working directory and executable path say nothing about where
+// the DLL was loaded from.
+package winsock
+
+import (
+	"path/filepath"
+	"reflect"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procGetModuleHandleExW = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetModuleHandleExW")
+
+// moduleDir returns the directory containing this DLL.
+func moduleDir() (string, error) {
+	var module windows.Handle
+	addr := reflect.ValueOf(moduleDir).Pointer()
+	flags := uintptr(windows.GET_MODULE_HANDLE_EX_FLAG_FROM_ADDRESS | windows.GET_MODULE_HANDLE_EX_FLAG_UNCHANGED_REFCOUNT)
+	// lpModuleName is an address inside the module when FROM_ADDRESS is set
+	if r, _, err := procGetModuleHandleExW.Call(flags, addr, uintptr(unsafe.Pointer(&module))); r == 0 {
+		return "", err
+	}
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	n, err := windows.GetModuleFileName(module, &buf[0], uint32(len(buf)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(windows.UTF16ToString(buf[:n])), nil
+}
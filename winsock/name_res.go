@@ -1,17 +1,20 @@
 // name_res.go — DNS name resolution and host lookup. Implements getaddrinfo
-// (resolves hostnames via netstack.LookupContextHost into a C-compatible addrinfo
-// linked list with sockaddr_in/sockaddr_in6, supporting AI_PASSIVE, AI_CANONNAME,
+// (resolves hostnames via the DNS servers of the tunnel matching the name, see
+// tunnel_route.go, into a C-compatible addrinfo linked list with
+// sockaddr_in/sockaddr_in6, supporting AI_PASSIVE, AI_CANONNAME,
 // AI_NUMERICHOST, and AI_NUMERICSERV), freeaddrinfo, getnameinfo (reverse DNS
 // simulation via numeric output as netstack lacks reverse lookup), gethostbyname
-// (netstack.LookupContextHost into a static hostent buffer), and gethostbyaddr
+// (Backend.LookupHost into a static hostent buffer), and gethostbyaddr
 // (unsupported). Also provides wide-char variants: GetAddrInfoW, FreeAddrInfoW,
 // and GetNameInfoW.
 package winsock
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,7 +33,9 @@ const (
 
 // Protocol constants
 const (
-	IPPROTO_UDP = 17
+	IPPROTO_ICMP   = 1
+	IPPROTO_UDP    = 17
+	IPPROTO_ICMPV6 = 58
 )
 
 // AI_* flags for getaddrinfo hints
@@ -129,14 +134,28 @@ func htons16(v uint16) uint16 {
 	return (v >> 8) | (v << 8)
 }
 
-// lookupPTR performs a reverse DNS lookup using the configured DNS servers over the WireGuard tunnel.
+// lookupPTR performs a reverse DNS lookup using the DNS servers of the tunnel routing ip.
 func lookupPTR(ip net.IP) (string, error) {
-	stack, err := GetStack()
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", fmt.Errorf("invalid IP")
+	}
+	if err := tunnelHealth(); err != nil {
+		if _, ferr := fallbackBackend(err); ferr != nil {
+			return "", ferr
+		}
+		names, err := net.DefaultResolver.LookupAddr(context.Background(), addr.String())
+		if err != nil || len(names) == 0 {
+			return "", fmt.Errorf("no PTR record for %s", addr)
+		}
+		return strings.TrimSuffix(names[0], "."), nil
+	}
+	t, err := tunnelForDest(addr)
 	if err != nil {
 		return "", err
 	}
-	dnsServers, err := GetDNS()
-	if err != nil || len(dnsServers) == 0 {
+	backend, dnsServers := t.Backend, t.DNS
+	if len(dnsServers) == 0 {
 		return "", fmt.Errorf("no DNS servers configured")
 	}
 
@@ -187,8 +206,11 @@ func lookupPTR(ip net.IP) (string, error) {
 
 	// Try each DNS server
 	for _, dns := range dnsServers {
-		addr := net.JoinHostPort(dns.String(), "53")
-		conn, err := stack.DialContext(context.Background(), "udp", addr)
+		family := int32(AF_INET)
+		if dns.Is6() {
+			family = AF_INET6
+		}
+		conn, err := backend.DialUDP(&SocketState{AddressFamily: family, V6Only: true}, netip.AddrPort{}, netip.AddrPortFrom(dns, 53))
 		if err != nil {
 			continue
 		}
@@ -293,11 +315,13 @@ func GoGetaddrinfo(node *byte, service *byte, hints unsafe.Pointer, res *unsafe.
 		} else if (hFlags & AI_NUMERICHOST) != 0 {
 			return EAI_NONAME
 		} else {
-			stack, err := GetStack()
-			if err != nil {
+			resolved, err := lookupHost(nodeName)
+			if errors.Is(err, errNetDown) {
 				return EAI_AGAIN
 			}
-			resolved, err := stack.LookupContextHost(context.Background(), nodeName)
+			if errors.Is(err, errNotReady) {
+				return WSASYSNOTREADY
+			}
 			if err != nil {
 				return EAI_NONAME
 			}
@@ -525,10 +549,10 @@ func GoGetnameinfo(sa unsafe.Pointer, salen int32, host *byte, hostlen uint32, s
 
 // --- gethostbyname ---
 
-func GoGethostbyname(name *byte) unsafe.Pointer {
+func GoGethostbyname(t Thread, name *byte) unsafe.Pointer {
 	LogCall("Gethostbyname", name)
 	if name == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return nil
 	}
 
@@ -542,14 +566,17 @@ func GoGethostbyname(name *byte) unsafe.Pointer {
 			addrs = []net.IP{ip}
 		}
 	} else {
-		stack, err := GetStack()
-		if err != nil {
-			setLastError(EAI_NONAME)
+		resolved, err := lookupHost(hostname)
+		if errors.Is(err, errNetDown) {
+			t.setLastError(EAI_AGAIN) // WSATRY_AGAIN
+			return nil
+		}
+		if errors.Is(err, errNotReady) {
+			t.setLastError(WSASYSNOTREADY)
 			return nil
 		}
-		resolved, err := stack.LookupContextHost(context.Background(), hostname)
 		if err != nil {
-			setLastError(EAI_NONAME) // WSAHOST_NOT_FOUND
+			t.setLastError(EAI_NONAME) // WSAHOST_NOT_FOUND
 			return nil
 		}
 		for _, r := range resolved {
@@ -560,7 +587,7 @@ func GoGethostbyname(name *byte) unsafe.Pointer {
 	}
 
 	if len(addrs) == 0 {
-		setLastError(EAI_NONAME)
+		t.setLastError(EAI_NONAME)
 		return nil
 	}
 
@@ -591,10 +618,10 @@ func GoGethostbyname(name *byte) unsafe.Pointer {
 
 // --- gethostbyaddr ---
 
-func GoGethostbyaddr(addr *byte, addrLen int32, addrType int32) unsafe.Pointer {
+func GoGethostbyaddr(t Thread, addr *byte, addrLen int32, addrType int32) unsafe.Pointer {
 	LogCall("Gethostbyaddr", addr, addrLen, addrType)
 	if addr == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return nil
 	}
 
@@ -610,13 +637,13 @@ func GoGethostbyaddr(addr *byte, addrLen int32, addrType int32) unsafe.Pointer {
 			ip[i] = *(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(addr)) + uintptr(i)))
 		}
 	} else {
-		setLastError(WSAEAFNOSUPPORT)
+		t.setLastError(WSAEAFNOSUPPORT)
 		return nil
 	}
 
 	hostname, err := lookupPTR(ip)
 	if err != nil || hostname == "" {
-		setLastError(EAI_NONAME)
+		t.setLastError(EAI_NONAME)
 		return nil
 	}
 
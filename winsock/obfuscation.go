@@ -0,0 +1,167 @@
+// obfuscation.go — AmneziaWG-style obfuscation of the outer WireGuard packets,
+// for networks whose DPI recognises the fixed WireGuard handshake. Set per
+// tunnel with the [Interface] keys Jc, Jmin, Jmax (junk packets of random size
+// sent ahead of every handshake initiation), S1 and S2 (random padding in front
+// of initiations and responses) and H1-H4 (message type values replacing 1-4
+// in the initiation, response, cookie reply and transport headers). The keys
+// and wire format match AmneziaWG, so a peer running amneziawg-go with the same
+// values interoperates; with none of them set packets are standard WireGuard.
+// transportBind applies the transform below the device, whatever the path.
+package winsock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	mrand "math/rand/v2"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const (
+	obfMaxJunkCount = 128
+	obfMaxJunkSize  = 1280
+	obfMaxS1        = obfMaxJunkSize - device.MessageInitiationSize
+	obfMaxS2        = obfMaxJunkSize - device.MessageResponseSize
+)
+
+// obfuscation is the obfuscation part of an [Interface] section.
+type obfuscation struct {
+	Jc, Jmin, Jmax int       // junk packet count and size range
+	S1, S2         int       // initiation and response padding
+	H              [4]uint32 // message types 1-4 on the wire; 0 = standard
+}
+
+// header returns the wire value for WireGuard message type typ.
+func (o *obfuscation) header(typ uint32) uint32 {
+	if h := o.H[typ-1]; h != 0 {
+		return h
+	}
+	return typ
+}
+
+// enabled reports whether o changes anything on the wire.
+func (o *obfuscation) enabled() bool {
+	if o.Jc != 0 || o.S1 != 0 || o.S2 != 0 {
+		return true
+	}
+	for typ := uint32(1); typ <= 4; typ++ {
+		if o.header(typ) != typ {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates the combination of keys, which are range-checked one by one
+// by the parser.
+func (o *obfuscation) check() error {
+	if o.Jmin > o.Jmax {
+		return errors.New("Jmin is larger than Jmax")
+	}
+	if o.Jc > 0 && o.Jmax == 0 {
+		return errors.New("Jc needs Jmax")
+	}
+	if o.S1 != 0 || o.S2 != 0 {
+		// Padded initiations and responses must differ in size
+		if device.MessageInitiationSize+o.S1 == device.MessageResponseSize+o.S2 {
+			return errors.New("S1 + 56 must not equal S2")
+		}
+	}
+	for i := uint32(1); i <= 4; i++ {
+		for j := i + 1; j <= 4; j++ {
+			if o.header(i) == o.header(j) {
+				return errors.New("H1-H4 must all be different")
+			}
+		}
+	}
+	return nil
+}
+
+// wrap returns bufs as they go on the wire: headers replaced, handshakes
+// padded and junk packets ahead of each initiation. bufs are not modified.
+func (o *obfuscation) wrap(bufs [][]byte) [][]byte {
+	out := make([][]byte, 0, len(bufs))
+	for _, buf := range bufs {
+		if len(buf) < 4 {
+			out = append(out, buf)
+			continue
+		}
+		typ := binary.LittleEndian.Uint32(buf)
+		pad := 0
+		switch typ {
+		case device.MessageInitiationType:
+			for range o.Jc {
+				junk := make([]byte, o.Jmin+mrand.IntN(o.Jmax-o.Jmin+1))
+				rand.Read(junk)
+				out = append(out, junk)
+			}
+			pad = o.S1
+		case device.MessageResponseType:
+			pad = o.S2
+		case device.MessageCookieReplyType, device.MessageTransportType:
+		default:
+			out = append(out, buf)
+			continue
+		}
+		pkt := make([]byte, pad+len(buf))
+		rand.Read(pkt[:pad])
+		copy(pkt[pad:], buf)
+		binary.LittleEndian.PutUint32(pkt[pad:], o.header(typ))
+		out = append(out, pkt)
+	}
+	return out
+}
+
+// unwrap turns pkt back into a WireGuard message in place, returning its new
+// length, or 0 for junk and anything else that does not match o.
+func (o *obfuscation) unwrap(pkt []byte) int {
+	match := func(pad int, typ uint32) bool {
+		return len(pkt) >= pad+4 && binary.LittleEndian.Uint32(pkt[pad:]) == o.header(typ)
+	}
+	var pad int
+	var typ uint32
+	switch n := len(pkt); {
+	case n == o.S1+device.MessageInitiationSize && match(o.S1, device.MessageInitiationType):
+		pad, typ = o.S1, device.MessageInitiationType
+	case n == o.S2+device.MessageResponseSize && match(o.S2, device.MessageResponseType):
+		pad, typ = o.S2, device.MessageResponseType
+	case n == device.MessageCookieReplySize && match(0, device.MessageCookieReplyType):
+		typ = device.MessageCookieReplyType
+	case n >= device.MessageTransportSize && match(0, device.MessageTransportType):
+		typ = device.MessageTransportType
+	default:
+		return 0
+	}
+	n := copy(pkt, pkt[pad:])
+	binary.LittleEndian.PutUint32(pkt, typ)
+	return n
+}
+
+// unwrapReceive wraps fn so that the device only sees unwrapped messages. The
+// obfuscation in effect is looked up for every batch, so a reload applies to
+// packets in flight.
+func unwrapReceive(fn conn.ReceiveFunc, current func() *obfuscation) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, err := fn(packets, sizes, eps)
+		o := current()
+		if o == nil || n == 0 {
+			return n, err
+		}
+		kept := 0
+		for i := range n {
+			size := o.unwrap(packets[i][:sizes[i]])
+			if size == 0 {
+				continue
+			}
+			if kept != i {
+				copy(packets[kept], packets[i][:size])
+				eps[kept] = eps[i]
+			}
+			sizes[kept] = size
+			kept++
+		}
+		return kept, err
+	}
+}
@@ -0,0 +1,177 @@
+// on_demand.go — On-demand tunnel (KLINIKAL_ON_DEMAND=1) for applications that
+// call WSAStartup at launch but use the network much later, or rarely.
+// WSAStartup then leaves the stack down, and the first call that needs a
+// tunnel (connect, sendto, a name lookup, a bind; everything that goes through
+// ensureStack) brings it up. Once no tunnel socket has been open for
+// KLINIKAL_IDLE_TIMEOUT (default 5m, "0" or "off" to keep it up) the stack is
+// torn down again, so an idle process holds no handshakes or keepalives; its
+// config source is kept for the next bring-up. While the stack is coming up,
+// blocking calls wait for it. A sendto on a non-blocking socket instead starts
+// the bring-up in the background and fails with WSAEWOULDBLOCK; the socket
+// reports writable (and FD_WRITE) once the bring-up has finished. A connect
+// on a non-blocking socket fails with WSAEWOULDBLOCK too and completes like
+// any non-blocking connect (see conn_async.go).
+package winsock
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	envOnDemand        = "KLINIKAL_ON_DEMAND"
+	envIdleTimeout     = "KLINIKAL_IDLE_TIMEOUT"
+	defaultIdleTimeout = 5 * time.Minute
+)
+
+var (
+	onDemand    = parseBoolDefault(os.Getenv(envOnDemand), false)
+	idleTimeout = parseIdleTimeout(os.Getenv(envIdleTimeout))
+)
+
+func parseIdleTimeout(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return defaultIdleTimeout
+	case s == "0" || strings.EqualFold(s, "off"):
+		return 0
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	LogNotice("%s=%q is not a duration, using %v", envIdleTimeout, s, defaultIdleTimeout)
+	return defaultIdleTimeout
+}
+
+var (
+	// suspendedLoader is the config source of a stack torn down while idle,
+	// used by the next bring-up. Guarded by stackMu.
+	suspendedLoader configLoader
+	globalIdleStop  chan struct{} // stops the idle monitor of the running stack
+
+	wakeMu     sync.Mutex
+	waking     bool // a background bring-up is running
+	wakeFailed bool // the last background bring-up failed
+)
+
+// stackStarted does the on-demand bookkeeping for a stack that just came up,
+// starting its idle monitor if idle stacks are torn down. Caller holds
+// stackMu.
+func stackStarted() {
+	suspendedLoader = nil
+	wakeMu.Lock()
+	wakeFailed = false
+	wakeMu.Unlock()
+
+	if !onDemand || idleTimeout == 0 {
+		return
+	}
+	globalIdleStop = make(chan struct{})
+	go idleMonitor(globalIdleStop)
+}
+
+// stopIdleMonitor stops the idle monitor. Caller holds stackMu.
+func stopIdleMonitor() {
+	if globalIdleStop != nil {
+		close(globalIdleStop)
+		globalIdleStop = nil
+	}
+}
+
+// idleMonitor suspends the stack once no tunnel socket has been open for
+// idleTimeout. It exits when stop is closed.
+func idleMonitor(stop chan struct{}) {
+	tick := time.NewTicker(max(idleTimeout/10, time.Second))
+	defer tick.Stop()
+
+	idleSince := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-tick.C:
+			if registry.TunnelSocketCount() > 0 {
+				idleSince = now
+				continue
+			}
+			if now.Sub(idleSince) >= idleTimeout && suspendStack(stop) {
+				return
+			}
+		}
+	}
+}
+
+// suspendStack tears the stack down for idleness unless it was replaced or a
+// socket appeared meanwhile. It reports whether it did.
+func suspendStack(stop chan struct{}) bool {
+	stackMu.Lock()
+	defer stackMu.Unlock()
+
+	if stopped(stop) || registry.TunnelSocketCount() > 0 {
+		return stopped(stop)
+	}
+	LogNotice("on-demand: no tunnel socket for %v, shutting the tunnel down until next use", idleTimeout)
+	load := globalLoader
+	closeStackLocked()
+	suspendedLoader = load
+	return true
+}
+
+// stackWaking handles a non-blocking sendto while the stack is down in
+// on-demand mode: it starts the bring-up in the background and sets
+// WSAEWOULDBLOCK. It reports false, leaving the call to proceed (and wait for
+// the stack if need be), when the stack is up or the last background bring-up
+// failed, so that failure is reported by the call itself.
+func stackWaking(t Thread, st *SocketState) bool {
+	st.AwaitingStack.Store(false)
+	if !st.IsNonBlocking || !stackAsleep(st) {
+		return false
+	}
+
+	wakeMu.Lock()
+	defer wakeMu.Unlock()
+	if !waking {
+		if wakeFailed {
+			return false
+		}
+		waking = true
+		go wakeStack()
+	}
+	st.AwaitingStack.Store(true)
+	t.setLastError(WSAEWOULDBLOCK)
+	return true
+}
+
+// stackAsleep reports whether st has no network yet and the stack is down in
+// on-demand mode, so that a non-blocking call would wait for the bring-up.
+func stackAsleep(st *SocketState) bool {
+	if !onDemand || st.backend() != nil {
+		return false
+	}
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	return !stackInitialized
+}
+
+// wakeStack brings the stack up for stackWaking and wakes the sockets waiting
+// for it.
+func wakeStack() {
+	err := ensureStack()
+	reportHealth(err)
+
+	wakeMu.Lock()
+	waking, wakeFailed = false, err != nil
+	wakeMu.Unlock()
+	registry.NotifyAwaitingStack()
+}
+
+// stackWakeDone reports whether no background bring-up is running, for the
+// write readiness of sockets that got WSAEWOULDBLOCK from stackWaking.
+func stackWakeDone() bool {
+	wakeMu.Lock()
+	defer wakeMu.Unlock()
+	return !waking
+}
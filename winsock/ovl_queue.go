@@ -0,0 +1,270 @@
+// ovl_queue.go — Ordered overlapped I/O. Every socket has one submission
+// queue for overlapped sends and one for overlapped receives. A queue runs its
+// operations one at a time in submission order on a fixed pool of workers
+// shared by every socket: a queue is handed to the pool when an operation is
+// submitted to it while idle, and handed back only after its previous
+// operation has completed (result stored for WSAGetOverlappedResult, hEvent
+// signaled), so back-to-back WSASends reach the connection, and complete, in
+// the order they were issued. An operation runs once the socket is ready for
+// it; until then its queue is parked on the socket's waiter queue and holds
+// no goroutine, however many receives are pending. PendingOverlapped lists
+// the operations not yet completed for diagnostics; GetStatus includes it.
+package winsock
+
+import (
+	"sync"
+	"time"
+	"unsafe"
+
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	ovlWorkers = 4                      // workers shared by every queue
+	ovlAttempt = 10 * time.Millisecond  // longest one attempt waits on the connection
+	ovlRetry   = 250 * time.Millisecond // re-check of a parked queue without a notification
+)
+
+// ovlDir selects a socket's send or receive queue.
+type ovlDir int
+
+const (
+	ovlSend ovlDir = iota
+	ovlRecv
+)
+
+// ovlOp is one queued overlapped operation. run is called once the socket is
+// ready for it and may return WSAEWOULDBLOCK to wait for readiness again.
+type ovlOp struct {
+	name       string // API that submitted it, e.g. "WSASend"
+	overlapped unsafe.Pointer
+	size       int // bytes offered or buffer capacity
+	queued     time.Time
+	started    bool // attempted at least once
+	run        func() (n uint32, errCode int32, flags uint32)
+}
+
+// ovlQueue runs the overlapped operations of one socket and direction in
+// FIFO order.
+type ovlQueue struct {
+	st   *SocketState
+	mask waiter.EventMask // readiness the operations wait for
+
+	mu      sync.Mutex
+	ops     []*ovlOp // not completed, oldest first
+	running bool     // handed to the pool or parked; false while empty
+
+	// While parked: the registration to undo when the queue is resumed
+	parked bool
+	wq     *waiter.Queue
+	entry  waiter.Entry
+	timer  *time.Timer
+}
+
+// ovlPool hands queues with a runnable operation to the workers.
+var ovlPool struct {
+	once  sync.Once
+	mu    sync.Mutex
+	cond  *sync.Cond
+	ready []*ovlQueue
+}
+
+// submitOverlapped queues run on st's send or receive queue for the overlapped
+// call name. A pending result is registered at once; when run completes, its
+// byte count, WSA error and flags are stored with SetOverlappedResult and
+// hEvent is signaled.
+func (st *SocketState) submitOverlapped(dir ovlDir, name string, lpOverlapped unsafe.Pointer, size int, run func() (uint32, int32, uint32)) {
+	registry.SetOverlappedResult(uintptr(lpOverlapped), &OverlappedResult{Complete: false})
+
+	q := &st.sendQueue
+	mask := waiter.EventOut
+	if dir == ovlRecv {
+		q = &st.recvQueue
+		mask = waiter.EventIn
+	}
+	q.submit(st, mask|waiter.EventErr|waiter.EventHUp, &ovlOp{name: name, overlapped: lpOverlapped, size: size, queued: time.Now(), run: run})
+}
+
+// submit appends op, handing the queue to the pool if it was idle.
+func (q *ovlQueue) submit(st *SocketState, mask waiter.EventMask, op *ovlOp) {
+	q.mu.Lock()
+	q.st, q.mask = st, mask
+	q.ops = append(q.ops, op)
+	start := !q.running
+	q.running = true
+	q.mu.Unlock()
+
+	if start {
+		handOvl(q)
+	}
+}
+
+// handOvl queues q for the next free worker.
+func handOvl(q *ovlQueue) {
+	ovlPool.once.Do(startOvlWorkers)
+	ovlPool.mu.Lock()
+	ovlPool.ready = append(ovlPool.ready, q)
+	ovlPool.mu.Unlock()
+	ovlPool.cond.Signal()
+}
+
+// startOvlWorkers starts the worker pool.
+func startOvlWorkers() {
+	ovlPool.cond = sync.NewCond(&ovlPool.mu)
+	for i := 0; i < ovlWorkers; i++ {
+		go func() {
+			for {
+				ovlPool.mu.Lock()
+				for len(ovlPool.ready) == 0 {
+					ovlPool.cond.Wait()
+				}
+				q := ovlPool.ready[0]
+				ovlPool.ready[0] = nil
+				ovlPool.ready = ovlPool.ready[1:]
+				ovlPool.mu.Unlock()
+
+				q.step()
+			}
+		}()
+	}
+}
+
+// step attempts the oldest operation of q. A completed operation is reported
+// before the queue is handed back for the next one; one that would block
+// parks the queue.
+func (q *ovlQueue) step() {
+	q.mu.Lock()
+	wq, timer := q.wq, q.timer
+	q.wq, q.timer = nil, nil
+	op := q.ops[0]
+	op.started = true
+	q.mu.Unlock()
+	if timer != nil {
+		timer.Stop()
+	}
+	if wq != nil {
+		wq.EventUnregister(&q.entry)
+	}
+
+	if ready, _, _ := q.st.pollView(); ready != nil && ready.Readiness(q.mask) == 0 {
+		q.park()
+		return
+	}
+	n, errCode, flags := op.run()
+	if errCode == WSAEWOULDBLOCK {
+		q.park()
+		return
+	}
+	op.complete(&OverlappedResult{
+		BytesTransferred: n,
+		Error:            errCode,
+		Complete:         true,
+		Flags:            flags,
+	})
+
+	q.mu.Lock()
+	q.ops[0] = nil
+	q.ops = q.ops[1:]
+	more := len(q.ops) > 0
+	q.running = more
+	q.mu.Unlock()
+	if more {
+		handOvl(q)
+	}
+}
+
+// park waits for the socket to become ready for q, or for ovlRetry to pass
+// (the connection may have been replaced), and then hands q back to the
+// pool.
+func (q *ovlQueue) park() {
+	_, wq, _ := q.st.pollView()
+	if wq != nil {
+		q.entry.Init(q, q.mask)
+		wq.EventRegister(&q.entry)
+	}
+
+	q.mu.Lock()
+	q.parked = true
+	q.wq = wq
+	q.timer = time.AfterFunc(ovlRetry, q.resume)
+	q.mu.Unlock()
+
+	// Readiness may have changed before the queue was parked
+	if ready, _, _ := q.st.pollView(); ready != nil && ready.Readiness(q.mask) != 0 {
+		q.resume()
+	}
+}
+
+// NotifyEvent implements waiter.EventListener for a parked queue.
+func (q *ovlQueue) NotifyEvent(waiter.EventMask) {
+	q.resume()
+}
+
+// resume hands a parked q back to the pool, once per park.
+func (q *ovlQueue) resume() {
+	q.mu.Lock()
+	parked := q.parked
+	q.parked = false
+	q.mu.Unlock()
+	if parked {
+		handOvl(q)
+	}
+}
+
+// complete stores the result of op and signals its event, if any.
+func (op *ovlOp) complete(result *OverlappedResult) {
+	registry.SetOverlappedResult(uintptr(op.overlapped), result)
+
+	ov := (*wsaOverlapped)(op.overlapped)
+	if ov.HEvent != nil {
+		GoWSASetEvent(ov.HEvent)
+	}
+}
+
+// OverlappedStatus describes an overlapped operation that has not completed.
+type OverlappedStatus struct {
+	Socket     uint64 `json:"socket"`
+	Op         string `json:"op"`         // API that submitted it
+	Overlapped uint64 `json:"overlapped"` // lpOverlapped address
+	Bytes      int    `json:"bytes"`      // bytes offered or buffer capacity
+	Running    bool   `json:"running"`    // false while queued behind another operation
+	AgeMs      int64  `json:"age_ms"`     // time since submission
+}
+
+// PendingOverlapped returns the overlapped operations of every socket that
+// have not completed, in queue order per socket and direction.
+func PendingOverlapped() []OverlappedStatus {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	now := time.Now()
+	var pending []OverlappedStatus
+	for handle, st := range registry.sockets {
+		for _, q := range []*ovlQueue{&st.sendQueue, &st.recvQueue} {
+			pending = append(pending, q.snapshot(handle, now)...)
+		}
+	}
+	return pending
+}
+
+// snapshot describes the operations in q for socket handle.
+func (q *ovlQueue) snapshot(handle uint64, now time.Time) []OverlappedStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var out []OverlappedStatus
+	describe := func(op *ovlOp, running bool) {
+		out = append(out, OverlappedStatus{
+			Socket:     handle,
+			Op:         op.name,
+			Overlapped: uint64(uintptr(op.overlapped)),
+			Bytes:      op.size,
+			Running:    running,
+			AgeMs:      now.Sub(op.queued).Milliseconds(),
+		})
+	}
+	for _, op := range q.ops {
+		describe(op, op.started)
+	}
+	return out
+}
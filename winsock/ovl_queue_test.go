@@ -0,0 +1,160 @@
+package winsock
+
+import (
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestOverlappedCompletesInOrder(t *testing.T) {
+	const ops = 16
+	st := &SocketState{}
+	ovs := make([]wsaOverlapped, ops)
+	key := func(i int) uintptr { return uintptr(unsafe.Pointer(&ovs[i])) }
+
+	done := make(chan struct{})
+	for i := range ovs {
+		st.submitOverlapped(ovlSend, "WSASend", unsafe.Pointer(&ovs[i]), i, func() (uint32, int32, uint32) {
+			// The previous operation has completed before this one runs
+			if i > 0 {
+				res, ok := registry.GetOverlappedResult(key(i - 1))
+				if !ok || !res.Complete || res.BytesTransferred != uint32(i-1) {
+					t.Errorf("op %d started before op %d completed", i, i-1)
+				}
+			}
+			// Earlier operations take longer, which must not reorder them
+			time.Sleep(time.Duration(ops-i) * 100 * time.Microsecond)
+			if i == ops-1 {
+				defer close(done)
+			}
+			return uint32(i), 0, 0
+		})
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("operations did not complete")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if res, ok := registry.GetOverlappedResult(key(ops - 1)); ok && res.Complete {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("last operation did not complete")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOverlappedWorkersBounded(t *testing.T) {
+	useLoopback(t)
+	const sockets = 200
+
+	type pending struct {
+		s   uint64
+		buf []byte
+		ov  wsaOverlapped
+	}
+	ps := make([]*pending, sockets)
+	addrs := make([]netip.AddrPort, sockets)
+	before := runtime.NumGoroutine()
+	for i := range ps {
+		p := &pending{s: newSocket(t, sockDgram), buf: make([]byte, 16)}
+		addrs[i] = nextAddr()
+		name, namelen := sockaddr4(addrs[i])
+		mustOK(t, "bind", GoBind(caller, p.s, name, namelen))
+
+		wb := wsaBuf{Len: uint32(len(p.buf)), Buf: &p.buf[0]}
+		var flags uint32
+		if GoWSARecvFrom(caller, p.s, unsafe.Pointer(&wb), 1, nil, &flags, nil, nil, unsafe.Pointer(&p.ov), nil) != -1 || GoWSAGetLastError(caller) != WSA_IO_PENDING {
+			t.Fatalf("WSARecvFrom %d: error %d, want WSA_IO_PENDING", i, GoWSAGetLastError(caller))
+		}
+		ps[i] = p
+	}
+
+	// Pending receives wait on their sockets, not on goroutines
+	time.Sleep(50 * time.Millisecond)
+	if grown := runtime.NumGoroutine() - before; grown > ovlWorkers+sockets/10 {
+		t.Fatalf("%d pending receives added %d goroutines", sockets, grown)
+	}
+
+	cli := newSocket(t, sockDgram)
+	for i := range ps {
+		msg := []byte{byte(i), byte(i >> 8)}
+		to, tolen := sockaddr4(addrs[i])
+		if n := GoSendto(caller, cli, unsafe.Pointer(&msg[0]), int32(len(msg)), 0, to, tolen); n != int32(len(msg)) {
+			t.Fatalf("sendto %d = %d, error %d", i, n, GoWSAGetLastError(caller))
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for i, p := range ps {
+		for {
+			res, ok := registry.GetOverlappedResult(uintptr(unsafe.Pointer(&p.ov)))
+			if ok && res.Complete {
+				if res.Error != 0 || res.BytesTransferred != 2 || p.buf[0] != byte(i) || p.buf[1] != byte(i>>8) {
+					t.Fatalf("receive %d completed with %d bytes %x, error %d", i, res.BytesTransferred, p.buf[:2], res.Error)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("receive %d did not complete", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestOverlappedRecvOnNonBlockingSocket(t *testing.T) {
+	useLoopback(t)
+	srvName, srvLen := sockaddr4(nextAddr())
+	srv := newSocket(t, sockDgram)
+	mustOK(t, "bind", GoBind(caller, srv, srvName, srvLen))
+	cli := newSocket(t, sockDgram)
+	mustOK(t, "connect", GoConnect(caller, cli, srvName, srvLen))
+	var cliName CSockaddrIn
+	cliLen := int32(SizeofSockaddrIn)
+	mustOK(t, "getsockname", GoGetsockname(caller, cli, unsafe.Pointer(&cliName), &cliLen))
+
+	// A non-blocking recv leaves its deadline behind on the connection
+	nonBlocking := uint32(1)
+	cmd := uint32(FIONBIO)
+	mustOK(t, "ioctlsocket", GoIoctlsocket(caller, cli, int32(cmd), &nonBlocking))
+	buf := make([]byte, 16)
+	if n := GoRecv(caller, cli, unsafe.Pointer(&buf[0]), int32(len(buf)), 0); n != -1 || GoWSAGetLastError(caller) != WSAEWOULDBLOCK {
+		t.Fatalf("recv = %d, error %d, want WSAEWOULDBLOCK", n, GoWSAGetLastError(caller))
+	}
+
+	var ov wsaOverlapped
+	wb := wsaBuf{Len: uint32(len(buf)), Buf: &buf[0]}
+	var flags uint32
+	if GoWSARecv(caller, cli, unsafe.Pointer(&wb), 1, nil, &flags, unsafe.Pointer(&ov), nil) != -1 || GoWSAGetLastError(caller) != WSA_IO_PENDING {
+		t.Fatalf("WSARecv: error %d, want WSA_IO_PENDING", GoWSAGetLastError(caller))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if res, ok := registry.GetOverlappedResult(uintptr(unsafe.Pointer(&ov))); ok && res.Complete {
+		t.Fatalf("WSARecv completed with no data: error %d", res.Error)
+	}
+
+	msg := []byte("late")
+	if n := GoSendto(caller, srv, unsafe.Pointer(&msg[0]), int32(len(msg)), 0, unsafe.Pointer(&cliName), cliLen); n != int32(len(msg)) {
+		t.Fatalf("sendto = %d, error %d", n, GoWSAGetLastError(caller))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, ok := registry.GetOverlappedResult(uintptr(unsafe.Pointer(&ov)))
+		if ok && res.Complete {
+			if res.Error != 0 || string(buf[:res.BytesTransferred]) != "late" {
+				t.Fatalf("WSARecv completed with %q, error %d", buf[:res.BytesTransferred], res.Error)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WSARecv did not complete")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+// peer_stats.go — Runtime state read back from a WireGuard device through the
+// UAPI get=1 dump (device.IpcGetOperation): the listen port, and per peer the
+// current endpoint, last handshake and transfer counters. The dump also carries
+// the private key, so it is parsed in place as the device writes it, without
+// copying the key anywhere.
+package winsock
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// peerStats is the runtime state of one peer.
+type peerStats struct {
+	PublicKey           wgKey
+	Endpoint            string    // ip:port currently used; empty if none
+	LastHandshake       time.Time // zero if no handshake has completed
+	RxBytes             uint64
+	TxBytes             uint64
+	PersistentKeepalive int
+	AllowedIPs          []string
+}
+
+// deviceStats is the runtime state of a device.
+type deviceStats struct {
+	ListenPort int
+	Peers      []peerStats
+}
+
+// readDeviceStats dumps the state of dev.
+func readDeviceStats(dev *device.Device) (deviceStats, error) {
+	var p statsParser
+	defer wipe(p.partial[:])
+	if err := dev.IpcGetOperation(&p); err != nil {
+		return deviceStats{}, err
+	}
+	if p.n > 0 {
+		p.parseLine(p.partial[:p.n])
+	}
+	p.finishPeer()
+	return p.stats, nil
+}
+
+// statsParser parses a UAPI get=1 dump as the device writes it, so the dump,
+// private key included, is never copied: secret lines are skipped, and only a
+// line split across writes is held, in a fixed buffer wiped afterwards.
+type statsParser struct {
+	stats         deviceStats
+	peer          *peerStats
+	hsSec, hsNsec int64
+
+	partial [128]byte // start of a line continued in the next write
+	n       int       // bytes used in partial
+	long    bool      // the carried line did not fit and is dropped
+}
+
+func (p *statsParser) Write(b []byte) (int, error) {
+	written := len(b)
+	if p.n > 0 || p.long {
+		// Complete the line carried over from the previous write
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.carry(b)
+			return written, nil
+		}
+		p.carry(b[:i])
+		if !p.long {
+			p.parseLine(p.partial[:p.n])
+		}
+		wipe(p.partial[:p.n])
+		p.n, p.long = 0, false
+		b = b[i+1:]
+	}
+	for {
+		line, rest, ok := bytes.Cut(b, []byte{'\n'})
+		if !ok {
+			p.carry(line)
+			return written, nil
+		}
+		p.parseLine(line)
+		b = rest
+	}
+}
+
+// carry appends b to the partial line, dropping a line too long to hold.
+func (p *statsParser) carry(b []byte) {
+	if p.long || p.n+len(b) > len(p.partial) {
+		wipe(p.partial[:p.n])
+		p.n, p.long = 0, true
+		return
+	}
+	p.n += copy(p.partial[p.n:], b)
+}
+
+// finishPeer completes the peer being parsed.
+func (p *statsParser) finishPeer() {
+	if p.peer != nil && (p.hsSec != 0 || p.hsNsec != 0) {
+		p.peer.LastHandshake = time.Unix(p.hsSec, p.hsNsec)
+	}
+}
+
+// parseLine applies one key=value line of the dump. Keys are compared without
+// converting them, and secret keys are never turned into strings.
+func (p *statsParser) parseLine(line []byte) {
+	key, value, ok := bytes.Cut(line, []byte{'='})
+	if !ok {
+		return
+	}
+	switch string(key) {
+	case "private_key", "preshared_key":
+		return
+	case "public_key":
+		p.finishPeer()
+		p.stats.Peers = append(p.stats.Peers, peerStats{})
+		p.peer = &p.stats.Peers[len(p.stats.Peers)-1]
+		p.hsSec, p.hsNsec = 0, 0
+		if hex.DecodedLen(len(value)) == len(p.peer.PublicKey) {
+			hex.Decode(p.peer.PublicKey[:], value)
+		}
+		return
+	}
+	if p.peer == nil {
+		if string(key) == "listen_port" {
+			p.stats.ListenPort, _ = strconv.Atoi(string(value))
+		}
+		return
+	}
+	peer := p.peer
+	switch string(key) {
+	case "endpoint":
+		peer.Endpoint = string(value)
+	case "last_handshake_time_sec":
+		p.hsSec, _ = strconv.ParseInt(string(value), 10, 64)
+	case "last_handshake_time_nsec":
+		p.hsNsec, _ = strconv.ParseInt(string(value), 10, 64)
+	case "rx_bytes":
+		peer.RxBytes, _ = strconv.ParseUint(string(value), 10, 64)
+	case "tx_bytes":
+		peer.TxBytes, _ = strconv.ParseUint(string(value), 10, 64)
+	case "persistent_keepalive_interval":
+		peer.PersistentKeepalive, _ = strconv.Atoi(string(value))
+	case "allowed_ip":
+		peer.AllowedIPs = append(peer.AllowedIPs, string(value))
+	}
+}
+
+// peerStatsFor returns the runtime state of the peer with public key pub.
+func peerStatsFor(dev *device.Device, pub wgKey) (peerStats, bool) {
+	stats, err := readDeviceStats(dev)
+	if err != nil {
+		return peerStats{}, false
+	}
+	for _, p := range stats.Peers {
+		if p.PublicKey == pub {
+			return p, true
+		}
+	}
+	return peerStats{}, false
+}
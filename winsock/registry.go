@@ -4,14 +4,17 @@
 // state) and the socketRegistry singleton that maps uint64 handles to SocketState,
 // manages event object channels, and tracks overlapped I/O completion results.
 // Provides Register/Get/Unregister for sockets, RegisterEvent/GetEvent/UnregisterEvent
-// for event objects, SetOverlappedResult/GetOverlappedResult for async I/O, and
-// PurgeAll for cleanup.
+// for event objects, SetOverlappedResult/GetOverlappedResult for async I/O,
+// DropConnections for stack restarts, and PurgeAll for cleanup.
 package winsock
 
 import (
+	"context"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/waiter"
@@ -35,20 +38,44 @@ type SocketState struct {
 	AddressFamily  int32 // AF_INET=2, AF_INET6=23
 	Protocol       int32 // IPPROTO_TCP=6, IPPROTO_UDP=17
 	IsNonBlocking  bool
-	LastErrorCode  int32
-	BoundAddr      string // Added for bind/listen decoupling
+	V6Only         bool // IPV6_V6ONLY (AF_INET6 only); false makes the socket dual-stack
+	LastErrorCode  int32 // pending socket error returned and cleared by SO_ERROR; atomic
+	BoundAddr      netip.AddrPort // Added for bind/listen decoupling
+	Backend        Backend        // network the socket lives on; nil until bound or connected
 	Options        map[int32][]byte // socket options storage (key = level<<16|optname)
 	PeekBuf        []byte // buffered data from MSG_PEEK or readiness probes
+	AwaitingStack  atomic.Bool // sendto got WSAEWOULDBLOCK during an on-demand bring-up
 
 	// Event-driven I/O (WSAEventSelect)
 	EventHandle    uintptr // associated event object (0 = none)
 	NetworkEvents  int32   // event mask from WSAEventSelect (FD_READ|FD_WRITE|...)
 	FiredEvents    int32   // accumulated events that have occurred
+	EventErrors    [FD_MAX_EVENTS]int32 // iErrorCode per FD_*_BIT for WSAEnumNetworkEvents; atomic
+	ConnectError   int32   // error of the last failed connect, 0 if none; atomic
+
+	// Lifecycle (see sock_state.go) and non-blocking connect (see conn_async.go)
+	State         ConnState          // created, bound, listening, connecting, ...
+	ShutRecv      bool               // shutdown(SD_RECEIVE or SD_BOTH) was called
+	ShutSend      bool               // shutdown(SD_SEND or SD_BOTH) was called
+	cancelConnect context.CancelFunc // aborts the background dial
+	stateMu       sync.Mutex         // guards the lifecycle fields, cancelConnect and changes to the connection, backend and waiter fields
+	StateQueue    waiter.Queue       // notified when a background connect finishes
+
+	// Overlapped I/O, run in submission order (see ovl_queue.go)
+	sendQueue  ovlQueue
+	recvQueue  ovlQueue
+	rxMu       sync.Mutex // guards the read deadline (see tx_extd.go)
+	txMu       sync.Mutex // guards the write deadline
+	rxDeadline time.Time  // read deadline last set by setsockopt or a synchronous call
+	txDeadline time.Time  // write deadline last set by setsockopt or a synchronous call
+	rxSync     int        // synchronous reads in progress
+	txSync     int        // synchronous writes in progress
 
 	// True I/O Multiplexing
 	WaiterQueue *waiter.Queue
 	WaiterEntry *waiter.Entry
 	Endpoint    tcpip.Endpoint
+	Ready       ReadinessSource // from the backend's readiness hook; Endpoint on netstack
 }
 
 // NotifyEvent implements waiter.EventListener for SocketState.
@@ -69,6 +96,12 @@ func (st *SocketState) NotifyEvent(mask waiter.EventMask) {
 		fired |= FD_CLOSE
 	}
 
+	st.fireEvents(fired)
+}
+
+// fireEvents accumulates the FD_* events in fired that the socket selected
+// with WSAEventSelect and signals its event object.
+func (st *SocketState) fireEvents(fired int32) {
 	// Only accumulate events that the user requested
 	fired &= st.NetworkEvents
 
@@ -164,6 +197,20 @@ func (r *socketRegistry) Get(handle uint64) (*SocketState, bool) {
 	return st, ok
 }
 
+// all returns the registered sockets. Per-socket state is read after the
+// registry lock is released, since a background connect takes stateMu before
+// it looks the socket up.
+func (r *socketRegistry) all() []*SocketState {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sockets := make([]*SocketState, 0, len(r.sockets))
+	for _, st := range r.sockets {
+		sockets = append(sockets, st)
+	}
+	return sockets
+}
+
 // Unregister removes a handle from the registry.
 func (r *socketRegistry) Unregister(handle uint64) {
 	r.mu.Lock()
@@ -198,17 +245,62 @@ func (r *socketRegistry) PurgeAll() {
 	}
 }
 
-// SetLastError updates the last error code for a socket handle.
+// DropConnections closes the network side of every socket on backend b while
+// keeping the handles registered, so blocked calls fail and closesocket still
+// works. Used when the stack underneath the sockets is replaced or removed.
+func (r *socketRegistry) DropConnections(b Backend) {
+	for _, st := range r.all() {
+		st.stateMu.Lock()
+		if st.Backend == b {
+			st.Backend = nil
+			if st.Conn != nil {
+				st.Conn.Close()
+			}
+			if st.Listener != nil {
+				st.Listener.Close()
+			}
+		}
+		st.stateMu.Unlock()
+	}
+}
+
+// NotifyAwaitingStack signals FD_WRITE to the sockets waiting for an
+// on-demand bring-up.
+func (r *socketRegistry) NotifyAwaitingStack() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, st := range r.sockets {
+		if st.AwaitingStack.Load() {
+			st.NotifyEvent(waiter.EventOut)
+		}
+	}
+}
+
+// TunnelSocketCount returns the number of sockets that are not pinned to the
+// host network, i.e. that use or may yet use a tunnel.
+func (r *socketRegistry) TunnelSocketCount() int {
+	n := 0
+	for _, st := range r.all() {
+		if st.backend() != hostBackend {
+			n++
+		}
+	}
+	return n
+}
+
+// SetLastError updates the pending socket error (SO_ERROR) for a socket handle.
+// It is independent of the per-thread WSAGetLastError value.
 func (r *socketRegistry) SetLastError(handle uint64, errCode int32) {
 	if st, ok := r.Get(handle); ok {
-		st.LastErrorCode = errCode
+		atomic.StoreInt32(&st.LastErrorCode, errCode)
 	}
 }
 
-// GetLastError retrieves the last error for a socket handle.
+// GetLastError retrieves the pending socket error for a socket handle.
 func (r *socketRegistry) GetLastError(handle uint64) int32 {
 	if st, ok := r.Get(handle); ok {
-		return st.LastErrorCode
+		return atomic.LoadInt32(&st.LastErrorCode)
 	}
 	return 0
 }
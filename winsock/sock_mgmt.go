@@ -16,6 +16,7 @@ func GoSocket(af int32, typ int32, protocol int32) uint64 {
 		Type:          TypeTCP,
 		AddressFamily: af,
 		Protocol:      protocol,
+		V6Only:        af == AF_INET6, // Windows defaults IPV6_V6ONLY to TRUE
 		Options:       make(map[int32][]byte),
 	}
 	if typ == 2 { // SOCK_DGRAM
@@ -50,27 +51,33 @@ func GoClosesocket(s uint64) int32 {
 		return -1 // WSAENOTSOCK
 	}
 	
+	// Unregister first so a background connect finishing meanwhile closes
+	// its own connection instead of installing it
+	st.abortConnect()
+	registry.Unregister(s)
+
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	st.State = StateClosed
 	if st.Conn != nil {
 		st.Conn.Close()
 	}
 	if st.Listener != nil {
 		st.Listener.Close()
 	}
-	
-	registry.Unregister(s)
 	return 0
 }
 
 // GoWSADuplicateSocketA — socket duplication is not supported in this bridge.
-func GoWSADuplicateSocketA(s uint64, dwProcessId uint32, lpProtocolInfo unsafe.Pointer) int32 {
+func GoWSADuplicateSocketA(t Thread, s uint64, dwProcessId uint32, lpProtocolInfo unsafe.Pointer) int32 {
 	LogCall("WSADuplicateSocketA", s, dwProcessId, lpProtocolInfo)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return -1
 }
 
 // GoWSADuplicateSocketW — socket duplication is not supported in this bridge.
-func GoWSADuplicateSocketW(s uint64, dwProcessId uint32, lpProtocolInfo unsafe.Pointer) int32 {
+func GoWSADuplicateSocketW(t Thread, s uint64, dwProcessId uint32, lpProtocolInfo unsafe.Pointer) int32 {
 	LogCall("WSADuplicateSocketW", s, dwProcessId, lpProtocolInfo)
-	setLastError(WSAEOPNOTSUPP)
+	t.setLastError(WSAEOPNOTSUPP)
 	return -1
 }
@@ -0,0 +1,200 @@
+// sock_state.go — Socket lifecycle state machine. A socket starts created and
+// moves to bound (bind, or the implicit bind of a first sendto), listening
+// (listen), connecting (a non-blocking connect in progress), connected
+// (connect or accept) and half-closed (shutdown), and is closed by
+// closesocket. The connection and transfer functions check the state first
+// and fail with the error real Winsock returns for the misuse: WSAEINVAL,
+// WSAEISCONN, WSAENOTCONN, WSAEALREADY, WSAESHUTDOWN or WSAEOPNOTSUPP.
+package winsock
+
+// ConnState is the lifecycle state of a socket.
+type ConnState int32
+
+const (
+	StateCreated ConnState = iota
+	StateBound
+	StateListening
+	StateConnecting
+	StateConnected
+	StateHalfClosed
+	StateClosed
+)
+
+// shutdown how values (winsock2.h)
+const (
+	SD_RECEIVE = 0
+	SD_SEND    = 1
+	SD_BOTH    = 2
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateBound:
+		return "bound"
+	case StateListening:
+		return "listening"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateHalfClosed:
+		return "half-closed"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// state returns the lifecycle state of st.
+func (st *SocketState) state() ConnState {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	return st.State
+}
+
+// setState moves st to state s.
+func (st *SocketState) setState(s ConnState) {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+	st.State = s
+}
+
+// streamConnected reports whether s is a state with an established stream.
+func (s ConnState) streamConnected() bool {
+	return s == StateConnected || s == StateHalfClosed
+}
+
+// bindError returns the WSA error bind fails with in st's state, or 0. Only
+// a socket that has no local address yet can be bound.
+func (st *SocketState) bindError() int32 {
+	switch st.state() {
+	case StateCreated:
+		return 0
+	case StateClosed:
+		return WSAENOTSOCK
+	}
+	return WSAEINVAL
+}
+
+// listenError returns the WSA error listen fails with in st's state, or 0.
+// Listening again is allowed and leaves the socket as it is.
+func (st *SocketState) listenError() int32 {
+	if st.Type != TypeTCP {
+		return WSAEOPNOTSUPP
+	}
+	switch st.state() {
+	case StateBound, StateListening:
+		return 0
+	case StateConnected, StateHalfClosed:
+		return WSAEISCONN
+	case StateClosed:
+		return WSAENOTSOCK
+	}
+	// Unbound, or a connect is in progress
+	return WSAEINVAL
+}
+
+// acceptError returns the WSA error accept fails with in st's state, or 0.
+func (st *SocketState) acceptError() int32 {
+	if st.Type != TypeTCP {
+		return WSAEOPNOTSUPP
+	}
+	switch st.state() {
+	case StateListening:
+		return 0
+	case StateClosed:
+		return WSAENOTSOCK
+	}
+	return WSAEINVAL
+}
+
+// connectError returns the WSA error connect fails with in st's state, or 0.
+// Datagram sockets may be connected again to change their peer.
+func (st *SocketState) connectError() int32 {
+	switch s := st.state(); {
+	case s == StateListening:
+		return WSAEINVAL
+	case s == StateConnecting:
+		return WSAEALREADY
+	case s.streamConnected() && st.Type == TypeTCP:
+		return WSAEISCONN
+	case s == StateClosed:
+		return WSAENOTSOCK
+	}
+	return 0
+}
+
+// sendError returns the WSA error a send with flags fails with in st's
+// state, or 0. Streams must be connected; datagram sockets are checked for a
+// destination by the caller.
+func (st *SocketState) sendError(flags int32) int32 {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+
+	switch {
+	case st.State == StateClosed:
+		return WSAENOTSOCK
+	case flags&MSG_OOB != 0 && st.Type != TypeTCP:
+		return WSAEOPNOTSUPP
+	case st.ShutSend:
+		return WSAESHUTDOWN
+	case st.Type == TypeTCP && !st.State.streamConnected():
+		return WSAENOTCONN
+	}
+	return 0
+}
+
+// recvError returns the WSA error a receive with flags fails with in st's
+// state, or 0. Streams must be connected and datagram sockets bound.
+func (st *SocketState) recvError(flags int32) int32 {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+
+	switch {
+	case st.State == StateClosed:
+		return WSAENOTSOCK
+	case flags&MSG_OOB != 0 && st.Type != TypeTCP:
+		return WSAEOPNOTSUPP
+	case st.ShutRecv:
+		return WSAESHUTDOWN
+	case st.Type == TypeTCP && !st.State.streamConnected():
+		return WSAENOTCONN
+	case st.Type != TypeTCP && st.State == StateCreated:
+		return WSAEINVAL
+	}
+	return 0
+}
+
+// shutdownError returns the WSA error shutdown with how fails with in st's
+// state, or 0. Only connected streams can be shut down; datagram sockets
+// just stop sending or receiving.
+func (st *SocketState) shutdownError(how int32) int32 {
+	if how < SD_RECEIVE || how > SD_BOTH {
+		return WSAEINVAL
+	}
+	switch s := st.state(); {
+	case s == StateClosed:
+		return WSAENOTSOCK
+	case st.Type == TypeTCP && !s.streamConnected():
+		return WSAENOTCONN
+	}
+	return 0
+}
+
+// markShutdown records a shutdown with how, making a connection half-closed.
+func (st *SocketState) markShutdown(how int32) {
+	st.stateMu.Lock()
+	defer st.stateMu.Unlock()
+
+	if how == SD_RECEIVE || how == SD_BOTH {
+		st.ShutRecv = true
+	}
+	if how == SD_SEND || how == SD_BOTH {
+		st.ShutSend = true
+	}
+	if st.State == StateConnected {
+		st.State = StateHalfClosed
+	}
+}
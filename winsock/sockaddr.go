@@ -0,0 +1,197 @@
+// sockaddr.go — Family-independent socket address marshalling. Converts C
+// sockaddr_in (16 bytes), sockaddr_in6 (28 bytes, with scope ID) and
+// SOCKADDR_STORAGE buffers to and from netip.AddrPort, and extracts endpoints
+// from the net.Addr types returned by netstack (TCPAddr, UDPAddr, PingAddr).
+// Every Go* entry point that reads or writes a socket address goes through
+// parseSockAddr / writeSockAddr so that AF_INET and AF_INET6 share one path.
+package winsock
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"unsafe"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// Sizes of the C address structures (ws2def.h / ws2ipdef.h)
+const (
+	SizeofSockaddrIn      = 16
+	SizeofSockaddrIn6     = 28
+	SizeofSockaddrStorage = 128
+)
+
+var (
+	// errSockAddrFault reports a NULL or undersized address buffer (WSAEFAULT).
+	errSockAddrFault = errors.New("sockaddr buffer too small")
+	// errSockAddrFamily reports an address family other than AF_INET/AF_INET6 (WSAEAFNOSUPPORT).
+	errSockAddrFamily = errors.New("address family not supported")
+)
+
+// sockAddrLen returns the sockaddr size used for the given address family.
+func sockAddrLen(family int32) int32 {
+	if family == AF_INET6 {
+		return SizeofSockaddrIn6
+	}
+	return SizeofSockaddrIn
+}
+
+// parseSockAddr reads a sockaddr_in or sockaddr_in6 into a netip.AddrPort.
+// A non-zero sin6_scope_id is carried as the address zone. namelen is the
+// caller-supplied buffer length; a negative value skips the length check for
+// internal callers that already validated the buffer.
+func parseSockAddr(name unsafe.Pointer, namelen int32) (netip.AddrPort, error) {
+	if name == nil {
+		return netip.AddrPort{}, errSockAddrFault
+	}
+
+	switch int32(*(*uint16)(name)) {
+	case AF_INET:
+		if namelen >= 0 && namelen < SizeofSockaddrIn {
+			return netip.AddrPort{}, errSockAddrFault
+		}
+		sa := (*CSockaddrIn)(name)
+		return netip.AddrPortFrom(netip.AddrFrom4(sa.Addr), htons16(sa.Port)), nil
+
+	case AF_INET6:
+		if namelen >= 0 && namelen < SizeofSockaddrIn6 {
+			return netip.AddrPort{}, errSockAddrFault
+		}
+		sa := (*CSockaddrIn6)(name)
+		ip := netip.AddrFrom16(sa.Addr)
+		if sa.ScopeID != 0 {
+			ip = ip.WithZone(strconv.FormatUint(uint64(sa.ScopeID), 10))
+		}
+		return netip.AddrPortFrom(ip, htons16(sa.Port)), nil
+	}
+
+	return netip.AddrPort{}, errSockAddrFamily
+}
+
+// writeSockAddr stores ap into a caller buffer using the layout of family.
+// IPv4 addresses written for an AF_INET6 socket are expressed as v4-mapped
+// (::ffff:a.b.c.d); IPv6 addresses are always written as sockaddr_in6. On
+// success *namelen is set to the number of bytes written.
+func writeSockAddr(name unsafe.Pointer, namelen *int32, ap netip.AddrPort, family int32) error {
+	if name == nil || namelen == nil {
+		return errSockAddrFault
+	}
+
+	ip := ap.Addr()
+	if ip.Is6() && !ip.Is4In6() {
+		family = AF_INET6
+	} else if ip.Is4In6() && family != AF_INET6 {
+		ip = ip.Unmap()
+	}
+
+	need := sockAddrLen(family)
+	if *namelen < need {
+		return errSockAddrFault
+	}
+
+	clear(unsafe.Slice((*byte)(name), need))
+
+	if family == AF_INET6 {
+		sa := (*CSockaddrIn6)(name)
+		sa.Family = uint16(AF_INET6)
+		sa.Port = htons16(ap.Port())
+		if ip.IsValid() {
+			sa.Addr = ip.As16()
+		}
+		if zone := ip.Zone(); zone != "" {
+			if id, err := strconv.ParseUint(zone, 10, 32); err == nil {
+				sa.ScopeID = uint32(id)
+			}
+		}
+	} else {
+		sa := (*CSockaddrIn)(name)
+		sa.Family = uint16(AF_INET)
+		sa.Port = htons16(ap.Port())
+		if ip.Is4() {
+			sa.Addr = ip.As4()
+		}
+	}
+
+	*namelen = need
+	return nil
+}
+
+// pingAddrOf extracts the address from a netstack PingAddr, which PingConn
+// hands out both by value (RemoteAddr/LocalAddr) and by pointer (ReadFrom).
+func pingAddrOf(a net.Addr) (netip.Addr, bool) {
+	switch p := a.(type) {
+	case *netstack.PingAddr:
+		if p == nil {
+			return netip.Addr{}, false
+		}
+		return p.Addr(), true
+	case netstack.PingAddr:
+		return p.Addr(), true
+	}
+	return netip.Addr{}, false
+}
+
+// netAddrToAddrPort converts a net.Addr from netstack into a netip.AddrPort.
+// IPv4 addresses held in 16-byte form are unmapped so callers can rely on Is4.
+func netAddrToAddrPort(a net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	switch v := a.(type) {
+	case nil:
+		return ap
+	case *net.TCPAddr:
+		if v == nil {
+			return ap
+		}
+		ap = v.AddrPort()
+	case *net.UDPAddr:
+		if v == nil {
+			return ap
+		}
+		ap = v.AddrPort()
+	default:
+		if ip, ok := pingAddrOf(a); ok {
+			ap = netip.AddrPortFrom(ip, 0)
+		} else if parsed, err := netip.ParseAddrPort(a.String()); err == nil {
+			ap = parsed
+		} else if ip, err := netip.ParseAddr(a.String()); err == nil {
+			ap = netip.AddrPortFrom(ip, 0)
+		}
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// unspecifiedAddr returns the wildcard address for an address family.
+func unspecifiedAddr(family int32) netip.Addr {
+	if family == AF_INET6 {
+		return netip.IPv6Unspecified()
+	}
+	return netip.IPv4Unspecified()
+}
+
+// formatSockAddr renders an address the way WSAAddressToString does: the
+// bare address when the port is zero, otherwise "a.b.c.d:port" or
+// "[v6%scope]:port".
+func formatSockAddr(ap netip.AddrPort) string {
+	if ap.Port() == 0 {
+		return ap.Addr().String()
+	}
+	return ap.String()
+}
+
+// parseSockAddrString is the inverse of formatSockAddr, accepting an
+// address with or without a port (and with or without IPv6 brackets).
+func parseSockAddrString(s string) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap, nil
+	}
+	if len(s) > 2 && s[0] == '[' && s[len(s)-1] == ']' {
+		s = s[1 : len(s)-1]
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, 0), nil
+}
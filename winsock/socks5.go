@@ -0,0 +1,423 @@
+// socks5.go — SOCKS5 client (RFC 1928, username/password auth per RFC 1929)
+// for carrying the outer WireGuard traffic through an upstream proxy set in
+// the [Proxy] section. UDP goes through a UDP ASSOCIATE relay: every datagram
+// to or from a peer is wrapped in the SOCKS UDP request header and exchanged
+// with the relay address the proxy hands out. The association lives as long as
+// its control TCP connection, so socksAssociation watches that connection and
+// negotiates a new association (with backoff) whenever it drops. TCP-transport
+// peers are reached with CONNECT through the same proxy.
+package winsock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion      = 5
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksCmdConnect   = 0x01
+	socksCmdAssociate = 0x03
+	socksAtypIPv4     = 0x01
+	socksAtypDomain   = 0x03
+	socksAtypIPv6     = 0x04
+	socksDialTimeout  = 10 * time.Second
+	socksRetryMin     = time.Second
+	socksRetryMax     = time.Minute
+	socksMaxUDPHeader = 3 + 1 + 16 + 2 // RSV, FRAG, ATYP, IPv6 address, port
+)
+
+// ProxyConfig is the parsed [Proxy] section.
+type ProxyConfig struct {
+	Address  string // host:port of the SOCKS5 server
+	Username string
+	Password []byte // wiped with the config
+}
+
+// Wipe zeroes the password.
+func (p *ProxyConfig) Wipe() {
+	if p != nil {
+		wipe(p.Password)
+	}
+}
+
+// clone returns a copy of p owning its own password, for use after the
+// config it came from has been wiped.
+func (p *ProxyConfig) clone() *ProxyConfig {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	c.Password = bytes.Clone(p.Password)
+	return &c
+}
+
+// equal reports whether p and q describe the same proxy.
+func (p *ProxyConfig) equal(q *ProxyConfig) bool {
+	if p == nil || q == nil {
+		return p == q
+	}
+	return p.Address == q.Address && p.Username == q.Username && bytes.Equal(p.Password, q.Password)
+}
+
+// socksDial opens a control connection to the proxy and authenticates.
+func (p *ProxyConfig) socksDial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 %s: %w", p.Address, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	if err := p.socksAuth(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("socks5 %s: %w", p.Address, err)
+	}
+	return c, nil
+}
+
+// socksAuth performs method negotiation and, if offered, password auth.
+func (p *ProxyConfig) socksAuth(c net.Conn) error {
+	methods := []byte{socksVersion, 1, socksAuthNone}
+	if p.Username != "" {
+		methods = []byte{socksVersion, 2, socksAuthNone, socksAuthPassword}
+	}
+	if _, err := c.Write(methods); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errors.New("not a SOCKS5 server")
+	}
+	switch reply[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPassword:
+		if p.Username == "" {
+			return errors.New("server requires a username and password")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return errors.New("username or password longer than 255 bytes")
+	}
+	req := make([]byte, 0, 3+len(p.Username)+len(p.Password))
+	req = append(req, 1, byte(len(p.Username)))
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	_, err := c.Write(req)
+	wipe(req)
+	if err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// socksRequest sends a command for addr and returns the bound address from
+// the server's reply.
+func socksRequest(c net.Conn, cmd byte, addr netip.AddrPort) (netip.AddrPort, error) {
+	req := append([]byte{socksVersion, cmd, 0}, socksAppendAddr(nil, addr)...)
+	if _, err := c.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var hdr [3]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[0] != socksVersion {
+		return netip.AddrPort{}, errors.New("malformed reply")
+	}
+	bound, err := socksReadAddr(c)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if hdr[1] != 0 {
+		return netip.AddrPort{}, fmt.Errorf("request failed: %s", socksReplyText(hdr[1]))
+	}
+	return bound, nil
+}
+
+func socksReplyText(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return "reply " + strconv.Itoa(int(code))
+}
+
+// socksAppendAddr appends ATYP, address and port.
+func socksAppendAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		a := ip.As4()
+		b = append(append(b, socksAtypIPv4), a[:]...)
+	} else {
+		a := ip.As16()
+		b = append(append(b, socksAtypIPv6), a[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+// socksReadAddr reads ATYP, address and port from a reply. Domain names are
+// resolved, as some servers report the relay by name.
+func socksReadAddr(r io.Reader) (netip.AddrPort, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+	var host []byte
+	switch atyp[0] {
+	case socksAtypIPv4:
+		host = make([]byte, 4)
+	case socksAtypIPv6:
+		host = make([]byte, 16)
+	case socksAtypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return netip.AddrPort{}, err
+		}
+		host = make([]byte, n[0])
+	default:
+		return netip.AddrPort{}, errors.New("unknown address type")
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, host); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ip, ok := netip.AddrFromSlice(host)
+	if atyp[0] == socksAtypDomain {
+		ips, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", string(host))
+		if err != nil || len(ips) == 0 {
+			return netip.AddrPort{}, fmt.Errorf("cannot resolve relay %q", host)
+		}
+		ip, ok = ips[0], true
+	}
+	if !ok {
+		return netip.AddrPort{}, errors.New("malformed address")
+	}
+	return netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(port[:])), nil
+}
+
+// socksConnect opens a TCP stream to dst through the proxy.
+func (p *ProxyConfig) socksConnect(ctx context.Context, dst netip.AddrPort) (net.Conn, error) {
+	c, err := p.socksDial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	if _, err := socksRequest(c, socksCmdConnect, dst); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("socks5 %s: CONNECT %s: %w", p.Address, dst, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// socksAssociation is a UDP ASSOCIATE session kept alive across drops of its
+// control connection. Datagrams go through one local UDP socket.
+type socksAssociation struct {
+	proxy *ProxyConfig
+	udp   *net.UDPConn
+
+	mu      sync.Mutex
+	control net.Conn       // nil while re-associating
+	relay   netip.AddrPort // where to send wrapped datagrams
+	closed  chan struct{}
+}
+
+// newSocksAssociation opens the local UDP socket on port and starts
+// associating in the background, so an unreachable proxy does not hold up
+// the device; datagrams sent before the relay is known are dropped.
+func newSocksAssociation(proxy *ProxyConfig, port uint16) (*socksAssociation, uint16, error) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+	a := &socksAssociation{proxy: proxy, udp: udp, closed: make(chan struct{})}
+	go a.maintain()
+	return a, uint16(udp.LocalAddr().(*net.UDPAddr).Port), nil
+}
+
+// associate negotiates a new relay on a fresh control connection.
+func (a *socksAssociation) associate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), socksDialTimeout)
+	defer cancel()
+	c, err := a.proxy.socksDial(ctx)
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Now().Add(socksDialTimeout))
+	relay, err := socksRequest(c, socksCmdAssociate, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("UDP ASSOCIATE: %w", err)
+	}
+	c.SetDeadline(time.Time{})
+	if relay.Addr().IsUnspecified() {
+		// The relay is on the proxy host itself
+		if raddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			relay = netip.AddrPortFrom(raddr.AddrPort().Addr().Unmap(), relay.Port())
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.closed:
+		c.Close()
+		return net.ErrClosed
+	default:
+	}
+	a.control, a.relay = c, relay
+	LogCall("SocksAssociated", a.proxy.Address, relay)
+	return nil
+}
+
+// maintain associates, waits for the control connection to drop and
+// associates again, backing off while the proxy refuses.
+func (a *socksAssociation) maintain() {
+	delay := socksRetryMin
+	failing := false
+	for {
+		err := a.associate()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			if !failing {
+				LogNotice("proxy %s: %v (retrying)", a.proxy.Address, err)
+			}
+			failing = true
+			timer := time.NewTimer(delay)
+			select {
+			case <-a.closed:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			delay = min(delay*2, socksRetryMax)
+			continue
+		}
+		if failing {
+			LogNotice("proxy %s: UDP association established", a.proxy.Address)
+		}
+		failing, delay = false, socksRetryMin
+
+		// The server sends nothing on the control connection; a read
+		// returns only when it is closed
+		a.mu.Lock()
+		c := a.control
+		a.mu.Unlock()
+		var b [1]byte
+		c.Read(b[:])
+		c.Close()
+		a.mu.Lock()
+		if a.control == c {
+			a.control, a.relay = nil, netip.AddrPort{}
+		}
+		a.mu.Unlock()
+		if stopped(a.closed) {
+			return
+		}
+		LogNotice("proxy %s: UDP association dropped, re-associating", a.proxy.Address)
+	}
+}
+
+// send wraps pkt for dst and hands it to the relay.
+func (a *socksAssociation) send(pkt []byte, dst netip.AddrPort) error {
+	a.mu.Lock()
+	relay := a.relay
+	a.mu.Unlock()
+	if !relay.IsValid() {
+		return errors.New("socks5 UDP association is down")
+	}
+	buf := make([]byte, 0, socksMaxUDPHeader+len(pkt))
+	buf = append(buf, 0, 0, 0) // RSV, FRAG
+	buf = socksAppendAddr(buf, dst)
+	buf = append(buf, pkt...)
+	_, err := a.udp.WriteToUDPAddrPort(buf, relay)
+	return err
+}
+
+// receive returns the next datagram from the relay, unwrapped into pkt.
+func (a *socksAssociation) receive(pkt []byte) (int, netip.AddrPort, error) {
+	buf := make([]byte, socksMaxUDPHeader+len(pkt))
+	for {
+		n, from, err := a.udp.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+		a.mu.Lock()
+		relay := a.relay
+		a.mu.Unlock()
+		if netip.AddrPortFrom(from.Addr().Unmap(), from.Port()) != relay {
+			continue // not from our relay
+		}
+		if n < 4 || buf[2] != 0 {
+			continue // fragments are not supported
+		}
+		r := bytes.NewReader(buf[3:n])
+		src, err := socksReadAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(pkt, buf[n-r.Len():n]), src, nil
+	}
+}
+
+// close ends the association and releases the UDP socket.
+func (a *socksAssociation) close() {
+	a.mu.Lock()
+	if !stopped(a.closed) {
+		close(a.closed)
+	}
+	if a.control != nil {
+		a.control.Close()
+	}
+	a.mu.Unlock()
+	a.udp.Close()
+}
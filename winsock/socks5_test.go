@@ -0,0 +1,259 @@
+package winsock
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// socksStandIn is a minimal in-process SOCKS5 server: method negotiation with
+// optional RFC 1929 auth, and UDP ASSOCIATE with a relay on 127.0.0.1 that
+// answers every datagram as if from the peer it was addressed to.
+type socksStandIn struct {
+	ln       net.Listener
+	relay    *net.UDPConn
+	user     string
+	pass     string
+	assocs   atomic.Int32
+	controls chan net.Conn // control connections of established associations
+	relayed  chan netip.AddrPort
+}
+
+func newSocksStandIn(t *testing.T, user, pass string) *socksStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		ln.Close()
+		t.Fatalf("listen relay: %v", err)
+	}
+	s := &socksStandIn{
+		ln: ln, relay: relay, user: user, pass: pass,
+		controls: make(chan net.Conn, 8),
+		relayed:  make(chan netip.AddrPort, 8),
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		relay.Close()
+		for len(s.controls) > 0 {
+			(<-s.controls).Close()
+		}
+	})
+	go s.serve()
+	go s.serveRelay()
+	return s
+}
+
+// proxy returns the client config for s with the given credentials.
+func (s *socksStandIn) proxy(user, pass string) *ProxyConfig {
+	return &ProxyConfig{Address: s.ln.Addr().String(), Username: user, Password: []byte(pass)}
+}
+
+func (s *socksStandIn) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if !s.handle(c) {
+				c.Close()
+			}
+		}()
+	}
+}
+
+// handle negotiates on control connection c and answers one request. It
+// reports whether c was kept open for an association.
+func (s *socksStandIn) handle(c net.Conn) bool {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil || hdr[0] != socksVersion {
+		return false
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return false
+	}
+	method := byte(socksAuthNone)
+	if s.user != "" {
+		method = socksAuthPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		c.Write([]byte{socksVersion, 0xFF})
+		return false
+	}
+	c.Write([]byte{socksVersion, method})
+
+	if method == socksAuthPassword {
+		var ver, n [1]byte
+		io.ReadFull(c, ver[:])
+		io.ReadFull(c, n[:])
+		user := make([]byte, n[0])
+		io.ReadFull(c, user)
+		io.ReadFull(c, n[:])
+		pass := make([]byte, n[0])
+		if _, err := io.ReadFull(c, pass); err != nil {
+			return false
+		}
+		if ver[0] != 1 || string(user) != s.user || string(pass) != s.pass {
+			c.Write([]byte{1, 1})
+			return false
+		}
+		c.Write([]byte{1, 0})
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return false
+	}
+	if _, err := socksReadAddr(c); err != nil {
+		return false
+	}
+	if req[1] != socksCmdAssociate {
+		c.Write(append([]byte{socksVersion, 7, 0}, socksAppendAddr(nil, netip.AddrPort{})...))
+		return false
+	}
+	bound := s.relay.LocalAddr().(*net.UDPAddr).AddrPort()
+	c.Write(append([]byte{socksVersion, 0, 0}, socksAppendAddr(nil, bound)...))
+	s.assocs.Add(1)
+	s.controls <- c
+	return true
+}
+
+// serveRelay unwraps each datagram, records its destination and sends the
+// payload back wrapped with that destination as the source.
+func (s *socksStandIn) serveRelay() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := s.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		dst, err := socksReadAddr(r)
+		if err != nil {
+			continue
+		}
+		s.relayed <- dst
+		reply := append([]byte{0, 0, 0}, socksAppendAddr(nil, dst)...)
+		reply = append(reply, buf[n-r.Len():n]...)
+		s.relay.WriteToUDPAddrPort(reply, from)
+	}
+}
+
+// awaitAssociated waits until a has a relay from association number want.
+func (s *socksStandIn) awaitAssociated(t *testing.T, a *socksAssociation, want int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		ok := a.relay.IsValid()
+		a.mu.Unlock()
+		if ok && s.assocs.Load() == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("association %d not established", want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// roundTrip sends pkt to dst through a and checks that the relay saw dst and
+// that the reply unwraps to pkt from dst.
+func (s *socksStandIn) roundTrip(t *testing.T, a *socksAssociation, pkt []byte, dst netip.AddrPort) {
+	t.Helper()
+	if err := a.send(pkt, dst); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case got := <-s.relayed:
+		if got != dst {
+			t.Fatalf("relay got datagram for %v, want %v", got, dst)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay got no datagram")
+	}
+
+	a.udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer a.udp.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	n, src, err := a.receive(buf)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if !bytes.Equal(buf[:n], pkt) || src != dst {
+		t.Fatalf("received %q from %v, want %q from %v", buf[:n], src, pkt, dst)
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	open := newSocksStandIn(t, "", "")
+	locked := newSocksStandIn(t, "wg", "s3cret")
+
+	tests := []struct {
+		name    string
+		proxy   *ProxyConfig
+		wantErr bool
+	}{
+		{"no auth", open.proxy("", ""), false},
+		{"no auth, credentials offered", open.proxy("wg", "s3cret"), false},
+		{"password", locked.proxy("wg", "s3cret"), false},
+		{"wrong password", locked.proxy("wg", "nope"), true},
+		{"password required", locked.proxy("", ""), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, err := tt.proxy.socksDial(ctx)
+			if c != nil {
+				c.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("socksDial error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSocksUDPAssociate(t *testing.T) {
+	s := newSocksStandIn(t, "wg", "s3cret")
+	a, _, err := newSocksAssociation(s.proxy("wg", "s3cret"), 0)
+	if err != nil {
+		t.Fatalf("associate: %v", err)
+	}
+	defer a.close()
+	s.awaitAssociated(t, a, 1)
+
+	s.roundTrip(t, a, []byte("v4 peer"), netip.MustParseAddrPort("203.0.113.7:51820"))
+	s.roundTrip(t, a, []byte("v6 peer"), netip.MustParseAddrPort("[2001:db8::7]:51820"))
+}
+
+func TestSocksReassociate(t *testing.T) {
+	s := newSocksStandIn(t, "", "")
+	a, _, err := newSocksAssociation(s.proxy("", ""), 0)
+	if err != nil {
+		t.Fatalf("associate: %v", err)
+	}
+	defer a.close()
+	s.awaitAssociated(t, a, 1)
+	dst := netip.MustParseAddrPort("203.0.113.7:51820")
+	s.roundTrip(t, a, []byte("before"), dst)
+
+	// The proxy ends the association by closing its control connection
+	(<-s.controls).Close()
+	s.awaitAssociated(t, a, 2)
+	s.roundTrip(t, a, []byte("after"), dst)
+}
@@ -2,253 +2,366 @@ package winsock
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"os"
-	"strings"
 	"sync"
 
-	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/device"
 	"golang.zx2c4.com/wireguard/tun/netstack"
-	"gopkg.in/ini.v1"
 )
 
+// tunnel is one running WireGuard interface with its own netstack, or a
+// custom backend installed with InitializeBackend.
+type tunnel struct {
+	Name      string
+	Backend   Backend
+	Net       *netstack.Net  // nil for a custom backend
+	Device    *device.Device // nil for a custom backend
+	bind      *transportBind // outer transport of Device
+	DNS       []netip.Addr
+	DNSSearch []string
+	Addrs     []netip.Prefix
+	Routes    []netip.Prefix // union of the peers' AllowedIPs
+	applied   *appliedConfig // what the device was last configured with
+
+	resolverStop chan struct{} // closed to stop the endpoint resolver
+	resolverKick chan struct{} // wakes the endpoint resolver after a reload
+	uapi         uapiSettings  // UAPI settings last applied
+	uapiListener net.Listener  // nil unless the UAPI endpoint is open
+	ready        *readiness    // nil unless gated on the first handshake
+}
+
 var (
-	globalStack      *netstack.Net
-	globalDevice     *device.Device
-	globalDNS        []netip.Addr
+	globalTunnels    []*tunnel    // in config order; [0] is the primary tunnel
+	globalSplit      SplitRules   // split tunneling routes of the running config
+	globalLoader     configLoader // source of the running config, for reloads
+	globalSource     string       // name of the running config file
+	globalWatchStop  chan struct{}
 	stackInitialized bool
 	stackMu          sync.RWMutex
 )
 
+// configLoader produces the configuration to load. The stack keeps the loader
+// it was started with so ReloadStack reads the same source again.
+type configLoader func() (*configSource, error)
+
+// fileLoader loads the config at a fixed path.
+func fileLoader(path string) configLoader {
+	return func() (*configSource, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load WG config: %w", err)
+		}
+		return &configSource{Name: path, Data: data}, nil
+	}
+}
+
 // InitializeStack initializes the userspace WireGuard stack with the given config file.
+// With handshake gating on it waits for the tunnels to become ready, returning
+// errNotReady for those that timed out; they stay up (see tunnel_ready.go).
 func InitializeStack(configPath string) error {
+	if err := initializeStack(fileLoader(configPath)); err != nil {
+		return err
+	}
+	return waitStackReady()
+}
+
+// InitializeDefaultStack initializes the stack from the first config found by
+// the discovery chain (see conf_discovery.go), waiting for readiness like
+// InitializeStack.
+func InitializeDefaultStack() error {
+	if err := initializeStack(discoverConfig); err != nil {
+		return err
+	}
+	return waitStackReady()
+}
+
+// initializeStack starts the stack from load unless it is already running.
+func initializeStack(load configLoader) error {
 	stackMu.Lock()
 	defer stackMu.Unlock()
 
 	if stackInitialized {
 		return nil
 	}
+	return initializeStackLocked(load)
+}
 
-	cfg, err := ini.Load(configPath)
-	if err != nil {
-		return fmt.Errorf("failed to load WG config: %w", err)
-	}
+// InitializeBackend installs b as the only tunnel, named name and owning the
+// interface addresses addrs, in place of a WireGuard config. It is how tests
+// run the bridge on NewLoopbackBackend; there is no config to watch or reload.
+func InitializeBackend(name string, b Backend, addrs []netip.Prefix) error {
+	stackMu.Lock()
+	defer stackMu.Unlock()
 
-	// Simplified parsing of [Interface] and [Peer]
-	interfaceSection := cfg.Section("Interface")
-	if interfaceSection == nil {
-		return errors.New("missing [Interface] section")
+	if stackInitialized {
+		return errors.New("stack already initialized")
 	}
+	globalTunnels = []*tunnel{{Name: name, Backend: b, Addrs: addrs}}
+	stackInitialized = true
+	healthStarted(nil)
+	return nil
+}
 
-	privateKeyBase64 := interfaceSection.Key("PrivateKey").String()
-	privateKeyHex, err := decodeBase64ToHex(privateKeyBase64)
+// initializeStackLocked brings up every tunnel in the config produced by load
+// and starts the config watcher. Caller holds stackMu.
+func initializeStackLocked(load configLoader) error {
+	src, err := load()
 	if err != nil {
-		return fmt.Errorf("invalid PrivateKey: %w", err)
+		return err
 	}
-
-	addressStr := interfaceSection.Key("Address").String()
-	ips, err := parseIPs(addressStr)
+	file, err := loadConfig(src)
 	if err != nil {
-		return fmt.Errorf("invalid Interface Address: %w", err)
+		return err
 	}
+	defer file.Wipe()
+	return startStackLocked(load, src.Name, file)
+}
 
-	dnsStr := interfaceSection.Key("DNS").String()
-	dns, _ := parseIPs(dnsStr)
+// startStackLocked brings up every tunnel in file, loaded by load from the
+// config named name, and starts the config watcher. Caller holds stackMu and
+// wipes file.
+func startStackLocked(load configLoader, name string, file *ConfigFile) error {
+	LogCall("ConfigSource", name)
 
-	mtu := 1420
-	if interfaceSection.HasKey("MTU") {
-		mtu, _ = interfaceSection.Key("MTU").Int()
-	}
-
-	// Setup tunnel and stack
-	tun, tnet, err := netstack.CreateNetTUN(ips, dns, mtu)
+	tunnels, err := startTunnels(file)
 	if err != nil {
-		return fmt.Errorf("failed to create netstack TUN: %w", err)
-	}
-
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(device.LogLevelError, "wg-winsock: "))
-
-	// Apply device configuration via IPC
-	var request bytes.Buffer
-	request.WriteString(fmt.Sprintf("private_key=%s\n", privateKeyHex))
-
-	if interfaceSection.HasKey("ListenPort") {
-		port, _ := interfaceSection.Key("ListenPort").Int()
-		request.WriteString(fmt.Sprintf("listen_port=%d\n", port))
+		return err
 	}
+	installStackLocked(load, name, file, tunnels)
+	return nil
+}
 
-	peers, _ := cfg.SectionsByName("Peer")
-	for _, peerSection := range peers {
-		publicKeyBase64 := peerSection.Key("PublicKey").String()
-		publicKeyHex, err := decodeBase64ToHex(publicKeyBase64)
+// startTunnels brings up every tunnel in file, stopping the ones already
+// started if any of them fails.
+func startTunnels(file *ConfigFile) ([]*tunnel, error) {
+	tunnels := make([]*tunnel, 0, len(file.Tunnels))
+	for _, cfg := range file.Tunnels {
+		t, err := startTunnel(cfg, file.Proxy)
 		if err != nil {
-			return fmt.Errorf("invalid Peer PublicKey: %w", err)
+			for _, started := range tunnels {
+				started.stop()
+			}
+			return nil, fmt.Errorf("tunnel %s: %w", cfg.Interface.Name, err)
 		}
+		tunnels = append(tunnels, t)
+	}
+	return tunnels, nil
+}
 
-		request.WriteString(fmt.Sprintf("public_key=%s\n", publicKeyHex))
+// installStackLocked makes tunnels, started from file, the running stack and
+// starts the config watcher. Caller holds stackMu.
+func installStackLocked(load configLoader, name string, file *ConfigFile, tunnels []*tunnel) {
+	globalTunnels = tunnels
+	globalSplit = file.Split
+	stackInitialized = true
+	globalLoader = load
+	globalSource = name
+	if globalWatchStop != nil {
+		// Re-initialized after a failed restart; replace the old watcher
+		close(globalWatchStop)
+	}
+	globalWatchStop = make(chan struct{})
+	startConfigWatcher(globalWatchStop)
+	healthStarted(globalWatchStop)
+	stackStarted()
+}
 
-		if peerSection.HasKey("Endpoint") {
-			endpoint := peerSection.Key("Endpoint").String()
-			// Resolve endpoint if needed
-			resolvedEndpoint, err := resolveEndpoint(endpoint)
-			if err == nil {
-				request.WriteString(fmt.Sprintf("endpoint=%s\n", resolvedEndpoint))
-			}
-		}
+// loadConfig decrypts src if it is an encrypted envelope and parses it. The
+// raw and decrypted config text are wiped before returning; the caller wipes
+// the returned file once the devices have been configured.
+func loadConfig(src *configSource) (*ConfigFile, error) {
+	defer wipe(src.Data)
+	plaintext, err := openConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
 
-		if peerSection.HasKey("AllowedIPs") {
-			allowedIPs := peerSection.Key("AllowedIPs").String()
-			for _, cidr := range strings.Split(allowedIPs, ",") {
-				cidr = strings.TrimSpace(cidr)
-				if cidr != "" {
-					request.WriteString(fmt.Sprintf("allowed_ip=%s\n", cidr))
-				}
-			}
-		} else {
-			request.WriteString("allowed_ip=0.0.0.0/0\n")
-			request.WriteString("allowed_ip=::0/0\n")
-		}
+	file, err := ParseConfig(src.Name, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WG config: %w", err)
+	}
+	return file, nil
+}
 
-		if peerSection.HasKey("PersistentKeepalive") {
-			keepalive, _ := peerSection.Key("PersistentKeepalive").Int()
-			request.WriteString(fmt.Sprintf("persistent_keepalive_interval=%d\n", keepalive))
-		}
+// startTunnel creates the netstack and WireGuard device for cfg, sending its
+// outer traffic through proxy when that is non-nil.
+func startTunnel(cfg *WGConfig, proxy *ProxyConfig) (*tunnel, error) {
+	// Resolve endpoints before creating the device so a bad Endpoint does not
+	// leave a half-configured tunnel behind
+	request, err := cfg.IpcRequest()
+	if err != nil {
+		return nil, fmt.Errorf("invalid WG config: %w", err)
 	}
+	defer wipe(request)
 
-	if err := dev.IpcSet(request.String()); err != nil {
-		return fmt.Errorf("failed to set device IPC: %w", err)
+	// Setup tunnel and stack
+	tun, tnet, err := netstack.CreateNetTUN(cfg.LocalAddrs(), cfg.Interface.DNS, cfg.Interface.MTU)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netstack TUN: %w", err)
+	}
+
+	logPrefix := "wg-winsock: "
+	if cfg.Interface.Name != "wg0" {
+		logPrefix = "wg-winsock(" + cfg.Interface.Name + "): "
+	}
+	bind := newTransportBind()
+	bind.setProxy(proxy)
+	bind.setObfuscation(cfg.Interface.Obfuscation)
+	dev := device.NewDevice(tun, bind, device.NewLogger(device.LogLevelError, logPrefix))
+
+	if err := dev.IpcSetOperation(bytes.NewReader(request)); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to set device IPC: %w", err)
 	}
 
 	if err := dev.Up(); err != nil {
-		return fmt.Errorf("failed to bring device up: %w", err)
+		dev.Close()
+		return nil, fmt.Errorf("failed to bring device up: %w", err)
 	}
 
-	globalStack = tnet
-	globalDevice = dev
-	globalDNS = dns
-	stackInitialized = true
+	t := &tunnel{Name: cfg.Interface.Name, Backend: &netstackBackend{Net: tnet}, Net: tnet, Device: dev, bind: bind}
+	t.setConfig(cfg)
+	t.startResolver()
+	t.startReadiness()
+	t.startUAPI(&cfg.Interface)
+	return t, nil
+}
 
-	return nil
+// setConfig records the non-secret parts of cfg on t.
+func (t *tunnel) setConfig(cfg *WGConfig) {
+	t.DNS = cfg.Interface.DNS
+	t.DNSSearch = cfg.Interface.DNSSearch
+	t.Addrs = cfg.Interface.Addresses
+	t.Routes = cfg.Routes()
+	t.applied = newAppliedConfig(cfg)
 }
 
-// GetStack returns the initialized userspace stack.
-func GetStack() (*netstack.Net, error) {
-	stackMu.RLock()
-	if stackInitialized {
-		defer stackMu.RUnlock()
-		return globalStack, nil
+// stop closes the tunnel's device, or a custom backend that can be closed.
+func (t *tunnel) stop() {
+	t.stopUAPI()
+	if t.resolverStop != nil {
+		close(t.resolverStop)
+		t.resolverStop = nil
 	}
-	stackMu.RUnlock()
-
-	// Not initialized — try to init (InitializeStack acquires its own write lock)
-	if _, err := os.Stat("wg.conf"); err == nil {
-		if err := InitializeStack("wg.conf"); err != nil {
-			return nil, err
-		}
-	} else {
-		return nil, errors.New("stack not initialized and wg.conf not found")
+	if t.Device != nil {
+		t.Device.Close()
+	}
+	if c, ok := t.Backend.(io.Closer); ok {
+		c.Close()
 	}
-
-	stackMu.RLock()
-	defer stackMu.RUnlock()
-	return globalStack, nil
 }
 
-// GetDNS returns the configured DNS servers.
-func GetDNS() ([]netip.Addr, error) {
-	stackMu.RLock()
-	if stackInitialized {
-		defer stackMu.RUnlock()
-		return globalDNS, nil
+// pause takes t's device down and closes its UAPI listener, releasing the
+// listen port and listener path for a tunnel started in its place. The
+// netstack and its sockets are left alone.
+func (t *tunnel) pause() {
+	t.stopUAPI()
+	if t.Device != nil {
+		t.Device.Down()
 	}
-	stackMu.RUnlock()
+}
 
-	// Not initialized — try to init (InitializeStack acquires its own write lock)
-	if _, err := os.Stat("wg.conf"); err == nil {
-		if err := InitializeStack("wg.conf"); err != nil {
-			return nil, err
-		}
-	} else {
-		return nil, errors.New("stack not initialized and wg.conf not found")
+// resume brings a paused tunnel back up.
+func (t *tunnel) resume() {
+	if t.Device == nil {
+		return
+	}
+	if err := t.Device.Up(); err != nil {
+		LogNotice("tunnel %s: cannot bring device back up: %v", t.Name, err)
 	}
+	t.startUAPI(&WGInterface{UAPI: t.uapi})
+}
 
+// ensureStack lazily initializes the stack from the discovery chain, or from
+// the config source of a stack suspended while idle (see on_demand.go).
+func ensureStack() error {
 	stackMu.RLock()
-	defer stackMu.RUnlock()
-	return globalDNS, nil
-}
+	initialized := stackInitialized
+	stackMu.RUnlock()
+	if initialized {
+		return nil
+	}
 
-// CloseStack shuts down the userspace stack.
-func CloseStack() {
 	stackMu.Lock()
 	defer stackMu.Unlock()
-
-	if !stackInitialized {
-		return
+	if stackInitialized {
+		return nil
 	}
-
-	if globalDevice != nil {
-		globalDevice.Close()
+	load := suspendedLoader
+	if load == nil {
+		load = discoverConfig
 	}
-	globalStack = nil
-	globalDevice = nil
-	stackInitialized = false
+	return initializeStackLocked(load)
 }
 
-// helpers to parse config
-
-func decodeBase64ToHex(key string) (string, error) {
-	decoded, err := base64.StdEncoding.DecodeString(key)
+// GetBackend returns the primary tunnel's backend.
+func GetBackend() (Backend, error) {
+	t, err := primaryTunnel()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if len(decoded) != 32 {
-		return "", errors.New("key should be 32 bytes")
+	return t.Backend, nil
+}
+
+// GetDNS returns the primary tunnel's DNS servers.
+func GetDNS() ([]netip.Addr, error) {
+	t, err := primaryTunnel()
+	if err != nil {
+		return nil, err
 	}
-	return hex.EncodeToString(decoded), nil
+	return t.DNS, nil
 }
 
-func parseIPs(s string) ([]netip.Addr, error) {
-	if s == "" {
-		return nil, nil
+// primaryTunnel returns the first tunnel in the config, initializing the
+// stack if needed.
+func primaryTunnel() (*tunnel, error) {
+	if err := ensureStack(); err != nil {
+		return nil, err
 	}
-	parts := strings.Split(s, ",")
-	var ips []netip.Addr
-	for _, p := range parts {
-		p = strings.TrimSpace(p)
-		if p == "" {
-			continue
-		}
-		// Try parsing as CIDR first to get the IP
-		if cidrIP, _, err := net.ParseCIDR(p); err == nil {
-			if ip, ok := netip.AddrFromSlice(cidrIP); ok {
-				ips = append(ips, ip.Unmap())
-			}
-		} else if ip, err := netip.ParseAddr(p); err == nil {
-			ips = append(ips, ip.Unmap())
-		} else {
-			return nil, fmt.Errorf("invalid IP/CIDR: %s", p)
-		}
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	if len(globalTunnels) == 0 {
+		return nil, errors.New("stack not initialized")
 	}
-	return ips, nil
+	return globalTunnels[0], nil
 }
 
-func resolveEndpoint(endpoint string) (string, error) {
-	host, port, err := net.SplitHostPort(endpoint)
-	if err != nil {
-		return "", err
+// CloseStack shuts down the userspace stack.
+func CloseStack() {
+	stackMu.Lock()
+	defer stackMu.Unlock()
+
+	closeStackLocked()
+	suspendedLoader = nil
+	wipe(globalMemConfig)
+	globalMemConfig = nil
+}
+
+// closeStackLocked stops every tunnel and the config watcher. Caller holds
+// stackMu.
+func closeStackLocked() {
+	if !stackInitialized {
+		return
 	}
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		return "", err
+
+	if globalWatchStop != nil {
+		close(globalWatchStop)
+		globalWatchStop = nil
 	}
-	if len(ips) == 0 {
-		return "", errors.New("no IPs found for host")
+	healthStopped()
+	stopIdleMonitor()
+	globalLoader = nil
+	globalSource = ""
+	for _, t := range globalTunnels {
+		t.stop()
 	}
-	return net.JoinHostPort(ips[0].String(), port), nil
+	globalTunnels = nil
+	globalSplit = SplitRules{}
+	stackInitialized = false
 }
@@ -1,5 +1,6 @@
 // status_error.go — Error handling, address queries, and overlapped result retrieval.
-// Maintains a global lastError (atomic int32) with WSAGetLastError/WSASetLastError.
+// Keeps the WSAGetLastError/WSASetLastError value per calling OS thread, as
+// Windows does, keyed by the thread ID each export captures and passes down.
 // Provides mapError to translate Go net.Error to WSA error codes. Implements
 // getsockname (returns local address from Conn or Listener), getpeername (returns
 // remote address from Conn), and WSAGetOverlappedResult (retrieves completion state
@@ -9,31 +10,55 @@ package winsock
 import (
 	"errors"
 	"net"
-	"strconv"
+	"net/netip"
 	"strings"
-	"sync/atomic"
+	"sync"
 	"unsafe"
 )
 
-var lastError int32
+// Thread is the Win32 ID of the application thread an export runs on. Each
+// export captures it once, at the cgo boundary, and passes it down to the
+// calls that set or read that thread's last error; 0 is a caller with no
+// thread, such as a test.
+type Thread uint32
+
+// ThreadExited reports whether thread t has exited. It is set by the cgo
+// exports; while nil, entries are only dropped when cleared.
+var ThreadExited func(t Thread) bool
+
+var (
+	lastErrorMu sync.RWMutex
+	lastErrors  = make(map[Thread]int32) // thread → WSAGetLastError value
+	sweepAt     = lastErrorSweep         // entries that trigger the next sweep
+)
+
+// lastErrorSweep is the number of entries kept before the entries of exited
+// threads are dropped.
+const lastErrorSweep = 64
 
 const (
 	WSAEFAULT          = 10014
 	WSAEINVAL          = 10022
 	WSAEWOULDBLOCK     = 10035
 	WSAEINPROGRESS     = 10036
+	WSAEALREADY        = 10037
 	WSAENOTSOCK        = 10038
 	WSAEDESTADDRREQ    = 10039
 	WSAEMSGSIZE        = 10040
 	WSAEOPNOTSUPP      = 10045
 	WSAEPROTONOSUPPORT = 10043
 	WSAEAFNOSUPPORT    = 10047
+	WSAENETDOWN        = 10050
+	WSAENETUNREACH     = 10051
 	WSAECONNRESET      = 10054
 	WSAENOBUFS         = 10055
+	WSAEISCONN         = 10056
 	WSAENOTCONN        = 10057
+	WSAESHUTDOWN       = 10058
 	WSAETIMEDOUT       = 10060
 	WSAECONNREFUSED    = 10061
 	WSAEHOSTUNREACH    = 10065
+	WSASYSNOTREADY     = 10091
 	WSA_IO_PENDING     = 997
 	WSA_IO_INCOMPLETE  = 996
 
@@ -42,20 +67,39 @@ const (
 	INVALID_SOCKET = ^uint64(0)
 )
 
-func setLastError(errCode int32) {
-	atomic.StoreInt32(&lastError, errCode)
+// setLastError sets thread t's last error. Clearing it drops the thread's
+// entry; entries of threads that exited with an error set are swept once the
+// map has grown by lastErrorSweep since the last sweep.
+func (t Thread) setLastError(errCode int32) {
+	lastErrorMu.Lock()
+	defer lastErrorMu.Unlock()
+	if errCode == 0 {
+		delete(lastErrors, t)
+		return
+	}
+	lastErrors[t] = errCode
+	if len(lastErrors) >= sweepAt && ThreadExited != nil {
+		for tid := range lastErrors {
+			if tid != t && ThreadExited(tid) {
+				delete(lastErrors, tid)
+			}
+		}
+		sweepAt = len(lastErrors) + lastErrorSweep
+	}
 }
 
-// goWSAGetLastError returns the error status for the last operation.
-func GoWSAGetLastError() int32 {
+// goWSAGetLastError returns the error status for the last operation on the calling thread.
+func GoWSAGetLastError(t Thread) int32 {
 	LogCall("WSAGetLastError")
-	return atomic.LoadInt32(&lastError)
+	lastErrorMu.RLock()
+	defer lastErrorMu.RUnlock()
+	return lastErrors[t]
 }
 
-// goWSASetLastError sets the error code that can be retrieved by WSAGetLastError.
-func GoWSASetLastError(iError int32) {
+// goWSASetLastError sets the error code the calling thread's WSAGetLastError returns.
+func GoWSASetLastError(t Thread, iError int32) {
 	LogCall("WSASetLastError", iError)
-	setLastError(iError)
+	t.setLastError(iError)
 }
 
 // helper to map net.Error to WSA codes
@@ -76,6 +120,24 @@ func mapError(err error) int32 {
 	case errors.Is(err, net.ErrClosed):
 		return WSAENOTSOCK
 
+	case errors.Is(err, errSockAddrFault):
+		return WSAEFAULT
+
+	case errors.Is(err, errSockAddrFamily):
+		return WSAEAFNOSUPPORT
+
+	case errors.Is(err, errV6OnlyMapped):
+		return WSAENETUNREACH
+
+	case errors.Is(err, errNoRoute):
+		return WSAENETUNREACH
+
+	case errors.Is(err, errNetDown):
+		return WSAENETDOWN
+
+	case errors.Is(err, errNotReady):
+		return WSASYSNOTREADY
+
 	case strings.Contains(errStr, "connection refused"):
 		return WSAECONNREFUSED
 
@@ -118,156 +180,78 @@ func mapError(err error) int32 {
 }
 
 // goGetsockname retrieves the local name for a socket.
-func GoGetsockname(s uint64, name unsafe.Pointer, namelen *int32) int32 {
+func GoGetsockname(t Thread, s uint64, name unsafe.Pointer, namelen *int32) int32 {
 	LogCall("Getsockname", s, name, namelen)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
-	if name == nil || namelen == nil || *namelen < 16 {
-		setLastError(WSAEFAULT)
+	if name == nil || namelen == nil {
+		t.setLastError(WSAEFAULT)
 		return -1
 	}
 
-	var addr net.Addr
+	var local netip.AddrPort
 	if st.Conn != nil {
-		addr = st.Conn.LocalAddr()
+		local = netAddrToAddrPort(st.Conn.LocalAddr())
 	} else if st.Listener != nil {
-		addr = st.Listener.Addr()
-	} else if st.BoundAddr != "" {
+		local = netAddrToAddrPort(st.Listener.Addr())
+	} else if st.BoundAddr.IsValid() {
 		// Socket is bound but not yet listening/connected
-		host, portStr, err := net.SplitHostPort(st.BoundAddr)
-		if err == nil {
-			sa := (*struct {
-				Family uint16
-				Port   uint16
-				Addr   [4]byte
-				Zero   [8]byte
-			})(name)
-			sa.Family = 2
-			ip := net.ParseIP(host)
-			if ip != nil {
-				if ip4 := ip.To4(); ip4 != nil {
-					copy(sa.Addr[:], ip4)
-				}
-			}
-			p, _ := strconv.Atoi(portStr)
-			sa.Port = uint16(p>>8) | uint16(p&0xFF)<<8
-			*namelen = 16
-		}
-		return 0
+		local = st.BoundAddr
 	} else {
-		return 0
+		t.setLastError(WSAEINVAL)
+		return -1
 	}
 
-	sa := (*struct {
-		Family uint16
-		Port   uint16
-		Addr   [4]byte
-		Zero   [8]byte
-	})(name)
-	sa.Family = 2
-
-	switch a := addr.(type) {
-	case *net.TCPAddr:
-		sa.Port = uint16(a.Port>>8) | uint16(a.Port&0xFF)<<8
-		if ip4 := a.IP.To4(); ip4 != nil {
-			copy(sa.Addr[:], ip4)
-		}
-	case *net.UDPAddr:
-		sa.Port = uint16(a.Port>>8) | uint16(a.Port&0xFF)<<8
-		if ip4 := a.IP.To4(); ip4 != nil {
-			copy(sa.Addr[:], ip4)
-		}
-	default:
-		host, portStr, _ := net.SplitHostPort(addr.String())
-		ip := net.ParseIP(host)
-		if ip != nil {
-			if ip4 := ip.To4(); ip4 != nil {
-				copy(sa.Addr[:], ip4)
-			}
-		}
-		if portStr != "" {
-			p, _ := strconv.Atoi(portStr)
-			sa.Port = uint16(p>>8) | uint16(p&0xFF)<<8
-		}
+	if err := writeSockAddr(name, namelen, local, st.AddressFamily); err != nil {
+		t.setLastError(mapError(err))
+		return -1
 	}
-
-	*namelen = 16
 	return 0
 }
 
 // goGetpeername retrieves the address of the peer to which a socket is connected.
-func GoGetpeername(s uint64, name unsafe.Pointer, namelen *int32) int32 {
+func GoGetpeername(t Thread, s uint64, name unsafe.Pointer, namelen *int32) int32 {
 	LogCall("Getpeername", s, name, namelen)
 	st, ok := registry.Get(s)
-	if !ok || st.Conn == nil {
-		setLastError(WSAENOTSOCK)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
 
-	if name == nil || namelen == nil || *namelen < 16 {
-		setLastError(WSAEFAULT)
+	if name == nil || namelen == nil {
+		t.setLastError(WSAEFAULT)
+		return -1
+	}
+
+	if st.Conn == nil {
+		t.setLastError(WSAENOTCONN)
 		return -1
 	}
 
 	raddr := st.Conn.RemoteAddr()
 	if raddr == nil {
-		setLastError(WSAENOTCONN)
+		t.setLastError(WSAENOTCONN)
 		return -1
 	}
 
-	sa := (*struct {
-		Family uint16
-		Port   uint16
-		Addr   [4]byte
-		Zero   [8]byte
-	})(name)
-	sa.Family = 2
-
-	switch a := raddr.(type) {
-	case *net.TCPAddr:
-		sa.Port = uint16(a.Port>>8) | uint16(a.Port&0xFF)<<8
-		if ip4 := a.IP.To4(); ip4 != nil {
-			copy(sa.Addr[:], ip4)
-		}
-	case *net.UDPAddr:
-		sa.Port = uint16(a.Port>>8) | uint16(a.Port&0xFF)<<8
-		if ip4 := a.IP.To4(); ip4 != nil {
-			copy(sa.Addr[:], ip4)
-		}
-	default:
-		// For PingAddr or unknown types, try to extract from String()
-		host, portStr, err := net.SplitHostPort(raddr.String())
-		if err != nil {
-			// PingAddr has no port
-			host = raddr.String()
-		}
-		ip := net.ParseIP(host)
-		if ip != nil {
-			if ip4 := ip.To4(); ip4 != nil {
-				copy(sa.Addr[:], ip4)
-			}
-		}
-		if portStr != "" {
-			p, _ := strconv.Atoi(portStr)
-			sa.Port = uint16(p>>8) | uint16(p&0xFF)<<8
-		}
+	if err := writeSockAddr(name, namelen, netAddrToAddrPort(raddr), st.AddressFamily); err != nil {
+		t.setLastError(mapError(err))
+		return -1
 	}
-
-	*namelen = 16
 	return 0
 }
 
 // GoWSAGetOverlappedResult retrieves the results of an overlapped operation.
 // Returns TRUE (1) if the operation completed successfully, FALSE (0) otherwise.
-func GoWSAGetOverlappedResult(s uint64, lpOverlapped unsafe.Pointer, lpcbTransfer *uint32, fWait int32, lpdwFlags *uint32) int32 {
+func GoWSAGetOverlappedResult(t Thread, s uint64, lpOverlapped unsafe.Pointer, lpcbTransfer *uint32, fWait int32, lpdwFlags *uint32) int32 {
 	LogCall("WSAGetOverlappedResult", s, lpOverlapped, lpcbTransfer, fWait, lpdwFlags)
 
 	if lpOverlapped == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return 0
 	}
 
@@ -307,12 +291,12 @@ func GoWSAGetOverlappedResult(s uint64, lpOverlapped unsafe.Pointer, lpcbTransfe
 	}
 
 	if !result.Complete {
-		setLastError(WSA_IO_INCOMPLETE)
+		t.setLastError(WSA_IO_INCOMPLETE)
 		return 0
 	}
 
 	if result.Error != 0 {
-		setLastError(result.Error)
+		t.setLastError(result.Error)
 		return 0
 	}
 
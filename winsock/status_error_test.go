@@ -0,0 +1,68 @@
+package winsock
+
+import "testing"
+
+func TestLastErrorPerThread(t *testing.T) {
+	const a, b Thread = 101, 102
+	t.Cleanup(func() {
+		a.setLastError(0)
+		b.setLastError(0)
+	})
+
+	GoWSASetLastError(a, WSAEWOULDBLOCK)
+	GoWSASetLastError(b, WSAECONNRESET)
+	if got := GoWSAGetLastError(a); got != WSAEWOULDBLOCK {
+		t.Fatalf("thread a: WSAGetLastError = %d, want %d", got, WSAEWOULDBLOCK)
+	}
+
+	// A failed call on b leaves a's error alone, and so does clearing b's
+	mustFail := GoGetsockname(b, 0xDEAD, nil, nil)
+	if mustFail != -1 || GoWSAGetLastError(b) != WSAENOTSOCK {
+		t.Fatalf("thread b: getsockname = %d, error %d, want WSAENOTSOCK", mustFail, GoWSAGetLastError(b))
+	}
+	GoWSASetLastError(b, 0)
+	if got := GoWSAGetLastError(a); got != WSAEWOULDBLOCK {
+		t.Fatalf("thread a after b's calls: WSAGetLastError = %d, want %d", got, WSAEWOULDBLOCK)
+	}
+	if got := GoWSAGetLastError(b); got != 0 {
+		t.Fatalf("thread b: WSAGetLastError = %d, want 0", got)
+	}
+}
+
+func TestLastErrorSweepsExitedThreads(t *testing.T) {
+	exited := map[Thread]bool{}
+	ThreadExited = func(t Thread) bool { return exited[t] }
+	t.Cleanup(func() {
+		ThreadExited = nil
+		lastErrorMu.Lock()
+		for tid := range lastErrors {
+			if tid >= 1000 {
+				delete(lastErrors, tid)
+			}
+		}
+		lastErrorMu.Unlock()
+	})
+
+	// Threads that exit with an error set are dropped by later sweeps, while
+	// live threads keep theirs
+	for tid := Thread(1000); tid < 1000+4*lastErrorSweep; tid++ {
+		exited[tid] = tid%2 == 0
+		tid.setLastError(WSAETIMEDOUT)
+	}
+
+	lastErrorMu.RLock()
+	defer lastErrorMu.RUnlock()
+	left := 0
+	for tid := Thread(1000); tid < 1000+4*lastErrorSweep; tid++ {
+		_, ok := lastErrors[tid]
+		if !exited[tid] && !ok {
+			t.Fatalf("live thread %d lost its error", tid)
+		}
+		if exited[tid] && ok {
+			left++
+		}
+	}
+	if left > lastErrorSweep {
+		t.Fatalf("%d of %d exited threads still have entries", left, 2*lastErrorSweep)
+	}
+}
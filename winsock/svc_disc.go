@@ -30,16 +30,16 @@ func GoWSALookupServiceBeginW(lpqsRestrictions unsafe.Pointer, dwControlFlags ui
 }
 
 // goWSALookupServiceNextA retrieves results from a previous service lookup. (ANSI)
-func GoWSALookupServiceNextA(hLookup unsafe.Pointer, dwControlFlags uint32, lpdwBufferLength *uint32, lpqsResults unsafe.Pointer) int32 {
+func GoWSALookupServiceNextA(t Thread, hLookup unsafe.Pointer, dwControlFlags uint32, lpdwBufferLength *uint32, lpqsResults unsafe.Pointer) int32 {
 	LogCall("WSALookupServiceNextA", hLookup, dwControlFlags, lpdwBufferLength, lpqsResults)
-	setLastError(10110) // WSA_E_NO_MORE
+	t.setLastError(10110) // WSA_E_NO_MORE
 	return -1
 }
 
 // goWSALookupServiceNextW retrieves results from a previous service lookup. (Unicode)
-func GoWSALookupServiceNextW(hLookup unsafe.Pointer, dwControlFlags uint32, lpdwBufferLength *uint32, lpqsResults unsafe.Pointer) int32 {
+func GoWSALookupServiceNextW(t Thread, hLookup unsafe.Pointer, dwControlFlags uint32, lpdwBufferLength *uint32, lpqsResults unsafe.Pointer) int32 {
 	LogCall("WSALookupServiceNextW", hLookup, dwControlFlags, lpdwBufferLength, lpqsResults)
-	setLastError(10110) // WSA_E_NO_MORE
+	t.setLastError(10110) // WSA_E_NO_MORE
 	return -1
 }
 
@@ -0,0 +1,390 @@
+// tcp_bind.go — Outer transport for the WireGuard devices. transportBind wraps
+// wireguard-go's default UDP bind, or a SOCKS5 UDP association when a [Proxy]
+// is configured (socks5.go), and adds WireGuard-over-TCP for peers with
+// Transport = tcp, for networks that drop UDP. Each TCP peer endpoint gets one
+// host-network stream, dialed on first send and redialed after it breaks, that
+// carries every packet behind a 2-byte big-endian length prefix; this is the
+// framing of udp-over-tcp relays such as mullvad/udp-over-tcp, which unwrap it
+// and forward the datagrams to the real WireGuard server; behind a proxy the
+// streams are opened with SOCKS5 CONNECT. Packet obfuscation (obfuscation.go)
+// is applied to every path. TCP endpoints travel through UAPI as
+// "tcp://ip:port" so the device hands them back to this bind.
+package winsock
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+const (
+	tcpEndpointScheme = "tcp://"
+	tcpDialTimeout    = 5 * time.Second
+	tcpMaxFrame       = 0xFFFF
+)
+
+// uapiEndpoint formats addr as the UAPI endpoint value for transport.
+func uapiEndpoint(transport, addr string) string {
+	if transport == "tcp" {
+		return tcpEndpointScheme + addr
+	}
+	return addr
+}
+
+// tcpPacket is one datagram unwrapped from a stream.
+type tcpPacket struct {
+	data []byte
+	ep   *tcpEndpoint
+}
+
+// transportBind sends to UDP endpoints through udp, or the proxy's association
+// while one is configured, and to TCP endpoints through its own streams.
+type transportBind struct {
+	udp conn.Bind
+
+	mu      sync.Mutex
+	proxy   *ProxyConfig      // nil = direct
+	assoc   *socksAssociation // open while proxied
+	obf     *obfuscation      // nil = standard WireGuard packets
+	streams map[netip.AddrPort]*tcpStream
+	rx      chan tcpPacket
+	closed  chan struct{} // closed by Close; nil while not open
+}
+
+// newTransportBind returns the bind used for every tunnel device.
+func newTransportBind() *transportBind {
+	return &transportBind{udp: conn.NewDefaultBind(), streams: make(map[netip.AddrPort]*tcpStream)}
+}
+
+// setProxy switches the bind to proxy (nil for direct), taking its own copy.
+// It reports whether anything changed; the device must then reopen the bind.
+func (b *transportBind) setProxy(proxy *ProxyConfig) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.proxy.equal(proxy) {
+		return false
+	}
+	b.proxy.Wipe()
+	b.proxy = proxy.clone()
+	return true
+}
+
+// setObfuscation makes o the packet obfuscation of the bind from the next
+// packet on.
+func (b *transportBind) setObfuscation(o obfuscation) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if o.enabled() {
+		b.obf = &o
+	} else {
+		b.obf = nil
+	}
+}
+
+// obfuscation returns the obfuscation in effect, nil if none.
+func (b *transportBind) obfuscation() *obfuscation {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.obf
+}
+
+func (b *transportBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var fns []conn.ReceiveFunc
+	var actual uint16
+	var err error
+	if b.proxy != nil {
+		b.assoc, actual, err = newSocksAssociation(b.proxy, port)
+		if err == nil {
+			fns = []conn.ReceiveFunc{receiveSocks(b.assoc)}
+		}
+	} else {
+		fns, actual, err = b.udp.Open(port)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.rx = make(chan tcpPacket, 256)
+	b.closed = make(chan struct{})
+	fns = append(fns, b.receiveTCP(b.rx, b.closed))
+	for i, fn := range fns {
+		fns[i] = unwrapReceive(fn, b.obfuscation)
+	}
+	return fns, actual, nil
+}
+
+func (b *transportBind) Close() error {
+	b.mu.Lock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	for addr, s := range b.streams {
+		s.close()
+		delete(b.streams, addr)
+	}
+	assoc := b.assoc
+	b.assoc = nil
+	b.mu.Unlock()
+	if assoc != nil {
+		assoc.close()
+	}
+	return b.udp.Close()
+}
+
+func (b *transportBind) SetMark(mark uint32) error {
+	return b.udp.SetMark(mark)
+}
+
+func (b *transportBind) BatchSize() int {
+	return b.udp.BatchSize()
+}
+
+func (b *transportBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if rest, ok := strings.CutPrefix(s, tcpEndpointScheme); ok {
+		addr, err := netip.ParseAddrPort(rest)
+		if err != nil {
+			return nil, err
+		}
+		return &tcpEndpoint{dst: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, nil
+	}
+	return b.udp.ParseEndpoint(s)
+}
+
+func (b *transportBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	o := b.obfuscation()
+	if o == nil {
+		return b.send(bufs, ep)
+	}
+	// Junk packets can take a batch past what the UDP bind accepts at once
+	bufs = o.wrap(bufs)
+	for len(bufs) > 0 {
+		n := min(len(bufs), b.BatchSize())
+		if err := b.send(bufs[:n], ep); err != nil {
+			return err
+		}
+		bufs = bufs[n:]
+	}
+	return nil
+}
+
+// send sends bufs to ep on the path for its transport.
+func (b *transportBind) send(bufs [][]byte, ep conn.Endpoint) error {
+	tep, ok := ep.(*tcpEndpoint)
+	if !ok {
+		b.mu.Lock()
+		assoc := b.assoc
+		b.mu.Unlock()
+		if assoc == nil {
+			return b.udp.Send(bufs, ep)
+		}
+		return sendSocks(assoc, bufs, ep)
+	}
+	s, err := b.stream(tep)
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if err := s.write(buf); err != nil {
+			b.drop(tep.dst, s)
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveTCP returns the ReceiveFunc delivering packets from every stream
+// opened while the bind stays open.
+func (b *transportBind) receiveTCP(rx chan tcpPacket, closed chan struct{}) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		var pkt tcpPacket
+		select {
+		case <-closed:
+			return 0, net.ErrClosed
+		case pkt = <-rx:
+		}
+		n := 0
+		for {
+			sizes[n] = copy(packets[n], pkt.data)
+			eps[n] = pkt.ep
+			n++
+			if n == len(packets) {
+				return n, nil
+			}
+			select {
+			case pkt = <-rx:
+			default:
+				return n, nil
+			}
+		}
+	}
+}
+
+// stream returns the open stream to ep, dialing it if there is none.
+func (b *transportBind) stream(ep *tcpEndpoint) (*tcpStream, error) {
+	b.mu.Lock()
+	if s, ok := b.streams[ep.dst]; ok {
+		b.mu.Unlock()
+		return s, nil
+	}
+	closed, rx, proxy := b.closed, b.rx, b.proxy
+	b.mu.Unlock()
+	if closed == nil {
+		return nil, net.ErrClosed
+	}
+
+	// Dial outside the lock: a slow relay must not hold up other peers
+	ctx, cancel := context.WithTimeout(context.Background(), tcpDialTimeout)
+	defer cancel()
+	var c net.Conn
+	var err error
+	if proxy != nil {
+		c, err = proxy.socksConnect(ctx, ep.dst)
+	} else {
+		var d net.Dialer
+		c, err = d.DialContext(ctx, "tcp", ep.dst.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(true)
+	}
+	s := &tcpStream{conn: c}
+
+	b.mu.Lock()
+	if b.closed != closed {
+		b.mu.Unlock()
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	if other, ok := b.streams[ep.dst]; ok {
+		// Lost a race with another sender; use the stream that won
+		b.mu.Unlock()
+		c.Close()
+		return other, nil
+	}
+	b.streams[ep.dst] = s
+	b.mu.Unlock()
+
+	LogCall("TCPTransportConnected", ep.dst)
+	go b.readStream(s, ep, rx, closed)
+	return s, nil
+}
+
+// receiveSocks returns the ReceiveFunc for datagrams from the proxy relay.
+func receiveSocks(assoc *socksAssociation) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, src, err := assoc.receive(packets[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		eps[0] = &conn.StdNetEndpoint{AddrPort: src}
+		return 1, nil
+	}
+}
+
+// sendSocks sends bufs to ep through the proxy relay.
+func sendSocks(assoc *socksAssociation, bufs [][]byte, ep conn.Endpoint) error {
+	var dst netip.AddrPort
+	if std, ok := ep.(*conn.StdNetEndpoint); ok {
+		dst = std.AddrPort
+	} else {
+		var err error
+		if dst, err = netip.ParseAddrPort(ep.DstToString()); err != nil {
+			return err
+		}
+	}
+	for _, buf := range bufs {
+		if err := assoc.send(buf, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop forgets s if it is still the stream to dst, so the next send redials.
+func (b *transportBind) drop(dst netip.AddrPort, s *tcpStream) {
+	b.mu.Lock()
+	if b.streams[dst] == s {
+		delete(b.streams, dst)
+	}
+	b.mu.Unlock()
+	s.close()
+}
+
+// readStream unwraps frames from s until it fails.
+func (b *transportBind) readStream(s *tcpStream, ep *tcpEndpoint, rx chan tcpPacket, closed chan struct{}) {
+	defer b.drop(ep.dst, s)
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			LogCall("TCPTransportClosed", ep.dst, err)
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			LogCall("TCPTransportClosed", ep.dst, err)
+			return
+		}
+		select {
+		case rx <- tcpPacket{data: data, ep: ep}:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// tcpStream is one framed connection to a relay.
+type tcpStream struct {
+	conn net.Conn
+	wmu  sync.Mutex
+	once sync.Once
+}
+
+// write sends pkt as one frame.
+func (s *tcpStream) write(pkt []byte) error {
+	if len(pkt) > tcpMaxFrame {
+		return errors.New("packet too large for TCP framing")
+	}
+	frame := make([]byte, 2+len(pkt))
+	binary.BigEndian.PutUint16(frame, uint16(len(pkt)))
+	copy(frame[2:], pkt)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+func (s *tcpStream) close() {
+	s.once.Do(func() { s.conn.Close() })
+}
+
+// tcpEndpoint is a peer reached over a framed TCP stream.
+type tcpEndpoint struct {
+	dst netip.AddrPort
+}
+
+func (e *tcpEndpoint) ClearSrc()           {}
+func (e *tcpEndpoint) SrcToString() string { return "" }
+func (e *tcpEndpoint) DstToString() string { return e.dst.String() }
+func (e *tcpEndpoint) DstIP() netip.Addr   { return e.dst.Addr() }
+func (e *tcpEndpoint) SrcIP() netip.Addr   { return netip.Addr{} }
+
+func (e *tcpEndpoint) DstToBytes() []byte {
+	b, _ := e.dst.MarshalBinary()
+	return b
+}
@@ -0,0 +1,203 @@
+package winsock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// relayStandIn is a local stand-in for a udp-over-tcp relay: it accepts
+// streams on 127.0.0.1 and hands them to the test, which reads and writes the
+// 2-byte length frames itself.
+type relayStandIn struct {
+	ln    net.Listener
+	conns chan net.Conn
+}
+
+func newRelayStandIn(t *testing.T) *relayStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	r := &relayStandIn{ln: ln, conns: make(chan net.Conn, 4)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.conns <- c
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		close(r.conns)
+		for c := range r.conns {
+			c.Close()
+		}
+	})
+	return r
+}
+
+// accept waits for the bind to open a stream to the relay.
+func (r *relayStandIn) accept(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case c := <-r.conns:
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("bind did not connect to the relay")
+		return nil
+	}
+}
+
+// readFrame unwraps one length-prefixed datagram from c.
+func readFrame(t *testing.T, c net.Conn) []byte {
+	t.Helper()
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		t.Fatalf("read frame header: %v", err)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(c, data); err != nil {
+		t.Fatalf("read frame body: %v", err)
+	}
+	return data
+}
+
+// writeFrame wraps pkt in a length prefix and writes it to c.
+func writeFrame(t *testing.T, c net.Conn, pkt []byte) {
+	t.Helper()
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(pkt)))
+	if _, err := c.Write(append(frame, pkt...)); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+}
+
+// receiveOne calls fn for a single packet, failing the test if none arrives.
+func receiveOne(t *testing.T, fn conn.ReceiveFunc) ([]byte, conn.Endpoint) {
+	t.Helper()
+	type result struct {
+		data []byte
+		ep   conn.Endpoint
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		packets := [][]byte{make([]byte, tcpMaxFrame)}
+		sizes := make([]int, 1)
+		eps := make([]conn.Endpoint, 1)
+		n, err := fn(packets, sizes, eps)
+		if n == 0 && err == nil {
+			err = io.ErrNoProgress
+		}
+		done <- result{packets[0][:sizes[0]], eps[0], err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatalf("receive: %v", r.err)
+		}
+		return r.data, r.ep
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet received")
+		return nil, nil
+	}
+}
+
+func TestTCPTransportFraming(t *testing.T) {
+	relay := newRelayStandIn(t)
+	b := newTransportBind()
+	fns, _, err := b.Open(0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer b.Close()
+	receiveTCP := fns[len(fns)-1]
+
+	ep, err := b.ParseEndpoint(uapiEndpoint("tcp", relay.ln.Addr().String()))
+	if err != nil {
+		t.Fatalf("parse endpoint: %v", err)
+	}
+
+	// Several datagrams in one batch arrive as separate frames, in order
+	out := [][]byte{[]byte("handshake initiation"), {}, bytes.Repeat([]byte{0xA5}, 1400)}
+	if err := b.Send(out, ep); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	c := relay.accept(t)
+	for i, want := range out {
+		if got := readFrame(t, c); !bytes.Equal(got, want) {
+			t.Fatalf("frame %d = %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+
+	// Frames from the relay come back as datagrams from the TCP endpoint
+	reply := []byte("handshake response")
+	writeFrame(t, c, reply)
+	data, from := receiveOne(t, receiveTCP)
+	if !bytes.Equal(data, reply) {
+		t.Fatalf("received %q, want %q", data, reply)
+	}
+	if from.DstToString() != relay.ln.Addr().String() {
+		t.Fatalf("received from %s, want %s", from.DstToString(), relay.ln.Addr())
+	}
+}
+
+func TestTCPTransportRedial(t *testing.T) {
+	relay := newRelayStandIn(t)
+	b := newTransportBind()
+	if _, _, err := b.Open(0); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer b.Close()
+
+	ep, err := b.ParseEndpoint(uapiEndpoint("tcp", relay.ln.Addr().String()))
+	if err != nil {
+		t.Fatalf("parse endpoint: %v", err)
+	}
+	if err := b.Send([][]byte{[]byte("first")}, ep); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	c := relay.accept(t)
+	if got := readFrame(t, c); string(got) != "first" {
+		t.Fatalf("frame = %q, want %q", got, "first")
+	}
+
+	// The relay drops the stream; the bind forgets it once its reader sees
+	// EOF, and the next send dials a new one
+	c.Close()
+	dst := ep.(*tcpEndpoint).dst
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		_, open := b.streams[dst]
+		b.mu.Unlock()
+		if !open {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed stream was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := b.Send([][]byte{[]byte("second")}, ep); err != nil {
+		t.Fatalf("send after close: %v", err)
+	}
+	c = relay.accept(t)
+	if got := readFrame(t, c); string(got) != "second" {
+		t.Fatalf("frame after redial = %q, want %q", got, "second")
+	}
+}
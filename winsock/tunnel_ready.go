@@ -0,0 +1,220 @@
+// tunnel_ready.go — Handshake-gated startup. With KLINIKAL_READY_TIMEOUT set
+// (e.g. 10s; unset or "0" turns it off) a WireGuard tunnel whose peers have
+// endpoints is not considered ready until one of them has completed a
+// handshake: the tunnel initiates one as soon as it starts and polls the
+// devices' last_handshake_time until it succeeds. InitializeStack waits for
+// every tunnel to become ready or time out, and connect, sendto and name
+// lookups on a tunnel still handshaking wait the same way. Once the timeout
+// has passed without a handshake they fail fast with WSASYSNOTREADY, which no
+// socket call or lookup returns otherwise, instead of stalling on netstack
+// retries; the tunnel keeps trying and is ready as soon as a handshake
+// completes.
+package winsock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+const envReadyTimeout = "KLINIKAL_READY_TIMEOUT"
+
+// readyTimeout bounds the wait for a tunnel's first handshake; zero disables
+// handshake gating.
+var readyTimeout = parseReadyTimeout(os.Getenv(envReadyTimeout))
+
+func parseReadyTimeout(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" || strings.EqualFold(s, "off") {
+		return 0
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d
+	}
+	LogNotice("%s=%q is not a duration, handshake gating is off", envReadyTimeout, s)
+	return 0
+}
+
+// errNotReady is returned for traffic on a tunnel that timed out waiting for
+// its first handshake.
+var errNotReady = errors.New("tunnel not ready: no peer handshake completed")
+
+// readiness tracks a tunnel's first handshake. A nil readiness is always
+// ready.
+type readiness struct {
+	mu      sync.Mutex
+	settled chan struct{} // closed once ready, timed out or stopped
+	ready   bool
+}
+
+// settle records the outcome, waking the waiters the first time.
+func (r *readiness) settle(ready bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = r.ready || ready
+	select {
+	case <-r.settled:
+	default:
+		close(r.settled)
+	}
+}
+
+// wait blocks until the tunnel is ready or has timed out, returning
+// errNotReady in the latter case.
+func (r *readiness) wait() error {
+	if r == nil {
+		return nil
+	}
+	<-r.settled
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.ready {
+		return errNotReady
+	}
+	return nil
+}
+
+// isReady reports whether the tunnel has completed its first handshake.
+func (r *readiness) isReady() bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
+
+// state describes r for the status report: "ready", "handshaking" while
+// waiting, or "timed_out".
+func (r *readiness) state() string {
+	if r == nil {
+		return "ready"
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.ready:
+		return "ready"
+	case stopped(r.settled):
+		return "timed_out"
+	}
+	return "handshaking"
+}
+
+// startReadiness starts gating t on its first handshake, unless gating is
+// off or no peer of t has an endpoint to initiate to.
+func (t *tunnel) startReadiness() {
+	if readyTimeout == 0 || t.Device == nil {
+		return
+	}
+	initiating := false
+	for _, p := range t.applied.Peers {
+		initiating = initiating || p.Endpoint != ""
+	}
+	if !initiating {
+		return
+	}
+	t.ready = &readiness{settled: make(chan struct{})}
+	go t.awaitHandshake(t.ready, t.resolverStop)
+}
+
+// awaitHandshake initiates handshakes with the peers of t and settles r when
+// the first one completes, or as not ready after readyTimeout; it then keeps
+// polling slowly until a handshake completes or stop is closed.
+func (t *tunnel) awaitHandshake(r *readiness, stop chan struct{}) {
+	defer r.settle(false) // release waiters if stopped before settling
+
+	t.initiateHandshakes(t.peerKeys())
+
+	start := time.Now()
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	deadline := time.NewTimer(readyTimeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-deadline.C:
+			LogNotice("tunnel %s: no handshake within %v; connections fail with WSASYSNOTREADY until one completes", t.Name, readyTimeout)
+			r.settle(false)
+			tick.Reset(time.Second)
+		case <-tick.C:
+			if t.handshaken() {
+				LogCall("TunnelReady", t.Name, time.Since(start))
+				r.settle(true)
+				return
+			}
+		}
+	}
+}
+
+// peerKeys returns the public keys of the peers of t.
+func (t *tunnel) peerKeys() []wgKey {
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	keys := make([]wgKey, 0, len(t.applied.Peers))
+	for pub := range t.applied.Peers {
+		keys = append(keys, pub)
+	}
+	return keys
+}
+
+// initiateHandshakes starts a handshake with each of the peers of t in keys.
+func (t *tunnel) initiateHandshakes(keys []wgKey) {
+	for _, pub := range keys {
+		if peer := t.Device.LookupPeer(device.NoisePublicKey(pub)); peer != nil {
+			peer.SendHandshakeInitiation(false)
+		}
+	}
+}
+
+// handshaken reports whether any peer of t has completed a handshake.
+func (t *tunnel) handshaken() bool {
+	stats, err := readDeviceStats(t.Device)
+	if err != nil {
+		return false
+	}
+	for _, p := range stats.Peers {
+		if !p.LastHandshake.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// backendReady waits for the tunnel behind b to settle, returning errNotReady
+// if it timed out without a handshake. Other backends are always ready.
+func backendReady(b Backend) error {
+	var r *readiness
+	stackMu.RLock()
+	for _, t := range globalTunnels {
+		if t.Backend == b {
+			r = t.ready
+			break
+		}
+	}
+	stackMu.RUnlock()
+	return r.wait()
+}
+
+// waitStackReady waits for every tunnel to settle and reports the ones that
+// did not become ready.
+func waitStackReady() error {
+	stackMu.RLock()
+	tunnels := globalTunnels
+	stackMu.RUnlock()
+
+	var errs []error
+	for _, t := range tunnels {
+		if err := t.ready.wait(); err != nil {
+			errs = append(errs, fmt.Errorf("tunnel %s: %w", t.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
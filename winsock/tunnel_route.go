@@ -0,0 +1,306 @@
+// tunnel_route.go — Backend selection across multiple tunnels. Each tunnel owns
+// a separate backend (normally its netstack); a destination is carried by the
+// tunnel whose peers' AllowedIPs contain it with the longest prefix, falling
+// back to the primary (first) tunnel. Sockets are pinned to the backend they
+// were first bound or connected on (SocketState.Backend); binds to a specific
+// address use the tunnel that owns that address. Names are resolved with the
+// DNS servers of the tunnel whose search domains match them.
+//
+// Destinations outside every peer's AllowedIPs are refused up front with
+// errNoRoute (WSAENETUNREACH) instead of vanishing inside WireGuard.
+//
+// Split tunneling: the [Split] section's Exclude and Include routes pick the
+// destinations that bypass the tunnels and go through the direct host-network
+// backend (hostBackend). The longest matching prefix across both lists decides,
+// Include winning a tie; when Include routes are given, anything they do not
+// cover is direct. Loopback is always direct unless explicitly included. A
+// socket bound to a host address no tunnel owns also lives on the host network.
+package winsock
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// tunnelForDest returns the tunnel routing dst by longest-prefix match.
+func tunnelForDest(dst netip.Addr) (*tunnel, error) {
+	if err := ensureStack(); err != nil {
+		return nil, err
+	}
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	if len(globalTunnels) == 0 {
+		return nil, errors.New("stack not initialized")
+	}
+
+	dst = dst.Unmap().WithZone("")
+	best, bestBits := globalTunnels[0], -1
+	for _, t := range globalTunnels {
+		for _, route := range t.Routes {
+			if route.Bits() > bestBits && route.Contains(dst) {
+				best, bestBits = t, route.Bits()
+			}
+		}
+	}
+	return best, nil
+}
+
+// errNoRoute reports a destination that no peer's AllowedIPs contain.
+var errNoRoute = errors.New("network is unreachable: destination outside every peer's AllowedIPs")
+
+// checkRoute returns errNoRoute if b is a WireGuard tunnel that cannot carry
+// traffic to dst: none of its peers' AllowedIPs contain dst and dst is not one
+// of the tunnel's own addresses. The host network and custom backends route
+// everything.
+func checkRoute(b Backend, dst netip.Addr) error {
+	if b == nil || b == hostBackend || !dst.IsValid() || dst.IsUnspecified() {
+		return nil
+	}
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+
+	dst = dst.Unmap().WithZone("")
+	for _, t := range globalTunnels {
+		if t.Backend != b {
+			continue
+		}
+		if t.Device == nil || t.ownsAddr(dst) {
+			return nil
+		}
+		for _, route := range t.Routes {
+			if route.Contains(dst) {
+				return nil
+			}
+		}
+		return errNoRoute
+	}
+	return nil
+}
+
+// tunnelForLocal returns the tunnel owning local address ip, or the primary
+// tunnel for the wildcard or an address no tunnel has.
+func tunnelForLocal(ip netip.Addr) (*tunnel, error) {
+	if err := ensureStack(); err != nil {
+		return nil, err
+	}
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	if len(globalTunnels) == 0 {
+		return nil, errors.New("stack not initialized")
+	}
+
+	for _, t := range globalTunnels {
+		if t.ownsAddr(ip) {
+			return t, nil
+		}
+	}
+	return globalTunnels[0], nil
+}
+
+// loopbackPrefixes are routed direct unless an Include route covers them.
+var loopbackPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// direct reports whether dst bypasses the tunnels under rules.
+func (rules *SplitRules) direct(dst netip.Addr) bool {
+	dst = dst.Unmap().WithZone("")
+	include, exclude := -1, -1
+	for _, p := range rules.Include {
+		if p.Bits() > include && p.Contains(dst) {
+			include = p.Bits()
+		}
+	}
+	for _, p := range rules.Exclude {
+		if p.Bits() > exclude && p.Contains(dst) {
+			exclude = p.Bits()
+		}
+	}
+	switch {
+	case include >= 0 || exclude >= 0:
+		return exclude > include
+	case len(rules.Include) > 0:
+		return true
+	}
+	for _, p := range loopbackPrefixes {
+		if p.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeDirect reports whether dst goes through the direct backend.
+func routeDirect(dst netip.Addr) bool {
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	return globalSplit.direct(dst)
+}
+
+// localBackend returns the backend for a socket bound to ip: the tunnel owning
+// it, the primary tunnel for the wildcard, or the host network for a host
+// address.
+func localBackend(ip netip.Addr) (Backend, error) {
+	if ip.IsLoopback() {
+		// Never a tunnel address, whatever state the tunnels are in
+		return hostBackend, nil
+	}
+	if err := tunnelHealth(); err != nil {
+		return fallbackBackend(err)
+	}
+	t, err := tunnelForLocal(ip)
+	if err != nil {
+		return fallbackBackend(err)
+	}
+	if ip.IsValid() && !ip.IsUnspecified() && !t.ownsAddr(ip) {
+		return hostBackend, nil
+	}
+	if err := backendHealth(t.Backend); err != nil {
+		return fallbackBackend(err)
+	}
+	return t.Backend, nil
+}
+
+// ownsAddr reports whether ip is one of the tunnel's interface addresses.
+func (t *tunnel) ownsAddr(ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	for _, p := range t.Addrs {
+		if p.Addr() == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// socketBackend returns the backend st should use to reach dst: the one it is
+// already pinned to, the one for its bound address, the host network for a
+// destination the split rules send direct, or the tunnel routing dst. An
+// invalid dst selects by bound address or the primary tunnel. Without a
+// tunnel the kill switch policy picks the host network or errNetDown; routes
+// that do not need a tunnel are decided first.
+func socketBackend(st *SocketState, dst netip.Addr) (Backend, error) {
+	if st.Backend != nil {
+		return st.Backend, nil
+	}
+	if bound := st.BoundAddr.Addr(); (bound.IsValid() && !bound.IsUnspecified()) || !dst.IsValid() {
+		return localBackend(bound)
+	}
+	// Starts the stack if need be, which loads the split rules
+	healthErr := tunnelHealth()
+	if routeDirect(dst) {
+		return hostBackend, nil
+	}
+	if healthErr != nil {
+		return fallbackBackend(healthErr)
+	}
+	t, err := tunnelForDest(dst)
+	if err != nil {
+		return fallbackBackend(err)
+	}
+	if err := backendHealth(t.Backend); err != nil {
+		return fallbackBackend(err)
+	}
+	return t.Backend, nil
+}
+
+// tunnelForName returns the tunnel whose DNS search domain is the longest
+// suffix of name, or the primary tunnel.
+func tunnelForName(name string) (*tunnel, error) {
+	if err := ensureStack(); err != nil {
+		return nil, err
+	}
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	if len(globalTunnels) == 0 {
+		return nil, errors.New("stack not initialized")
+	}
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	best, bestLen := globalTunnels[0], -1
+	for _, t := range globalTunnels {
+		for _, domain := range t.DNSSearch {
+			domain = strings.ToLower(domain)
+			if (name == domain || strings.HasSuffix(name, "."+domain)) && len(domain) > bestLen {
+				best, bestLen = t, len(domain)
+			}
+		}
+	}
+	return best, nil
+}
+
+// lookupHost resolves name over the tunnel whose search domains match it.
+// Single-label names are first tried against each tunnel's search domains,
+// querying that tunnel's DNS servers. localhost is answered locally, and with
+// split tunneling a name the tunnel cannot resolve falls back to the host
+// resolver for addresses that route direct. With no tunnel up the kill switch
+// policy decides (see killswitch.go).
+func lookupHost(name string) ([]string, error) {
+	if lower := strings.ToLower(strings.TrimSuffix(name, ".")); lower == "localhost" || strings.HasSuffix(lower, ".localhost") {
+		return []string{"127.0.0.1", "::1"}, nil
+	}
+	if err := tunnelHealth(); err != nil {
+		b, ferr := fallbackBackend(err)
+		if ferr != nil {
+			return nil, ferr
+		}
+		return b.LookupHost(context.Background(), name)
+	}
+	if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		if err := ensureStack(); err != nil {
+			return nil, err
+		}
+		stackMu.RLock()
+		tunnels := globalTunnels
+		stackMu.RUnlock()
+
+		for _, t := range tunnels {
+			if t.ready.wait() != nil {
+				continue
+			}
+			for _, domain := range t.DNSSearch {
+				if resolved, err := t.Backend.LookupHost(context.Background(), name+"."+domain); err == nil && len(resolved) > 0 {
+					return resolved, nil
+				}
+			}
+		}
+	}
+
+	t, err := tunnelForName(name)
+	if err == nil {
+		err = t.ready.wait()
+	}
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := t.Backend.LookupHost(context.Background(), name)
+	if err == nil || !splitConfigured() {
+		return resolved, err
+	}
+
+	// Names the tunnel DNS does not know (LAN hosts) may still resolve on the
+	// host, but only answers that route direct are useful
+	hostResolved, herr := hostBackend.LookupHost(context.Background(), name)
+	if herr != nil {
+		return nil, err
+	}
+	var direct []string
+	for _, h := range hostResolved {
+		if ip, perr := netip.ParseAddr(h); perr == nil && routeDirect(ip) {
+			direct = append(direct, h)
+		}
+	}
+	if len(direct) == 0 {
+		return nil, err
+	}
+	return direct, nil
+}
+
+// splitConfigured reports whether the running config has a [Split] section.
+func splitConfigured() bool {
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+	return len(globalSplit.Exclude) > 0 || len(globalSplit.Include) > 0
+}
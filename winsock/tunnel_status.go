@@ -0,0 +1,147 @@
+// tunnel_status.go — Status and statistics snapshot for host applications.
+// GetStatus reports whether a tunnel is up (and why not), the active fail mode
+// and config source, and for every tunnel its handshake readiness (see
+// tunnel_ready.go), whether the kill switch considers it down, addresses,
+// listen port and peers with their configured and current endpoint, last
+// handshake and rx/tx byte counters as read from the device, plus the
+// overlapped operations still pending on any socket (see ovl_queue.go).
+// GoKlinikalGetStatus renders the snapshot as JSON into a caller buffer for the
+// KlinikalGetStatus DLL export. Reading the status never starts the stack.
+package winsock
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"unsafe"
+)
+
+// Status is a point-in-time view of the bridge.
+type Status struct {
+	Up       bool           `json:"up"`
+	Reason   string         `json:"reason,omitempty"` // why no tunnel is up
+	FailMode string         `json:"fail_mode"`        // "closed" or "open"
+	Source   string         `json:"source,omitempty"` // config the stack was loaded from
+	Tunnels  []TunnelStatus `json:"tunnels"`
+
+	Overlapped []OverlappedStatus `json:"overlapped,omitempty"` // pending overlapped I/O
+}
+
+// TunnelStatus describes one running tunnel.
+type TunnelStatus struct {
+	Name       string       `json:"name"`
+	Readiness  string       `json:"readiness"`      // "ready", "handshaking" or "timed_out"
+	Down       string       `json:"down,omitempty"` // why the kill switch considers it down
+	Addresses  []string     `json:"addresses"`
+	ListenPort int          `json:"listen_port,omitempty"`
+	Peers      []PeerStatus `json:"peers"`
+}
+
+// PeerStatus describes one peer of a tunnel.
+type PeerStatus struct {
+	PublicKey           string   `json:"public_key"`                    // base64, as in wg.conf
+	ConfiguredEndpoint  string   `json:"configured_endpoint,omitempty"` // Endpoint as written
+	Endpoint            string   `json:"endpoint,omitempty"`            // ip:port in use
+	LastHandshake       int64    `json:"last_handshake"`                // unix seconds; 0 = never
+	RxBytes             uint64   `json:"rx_bytes"`
+	TxBytes             uint64   `json:"tx_bytes"`
+	PersistentKeepalive int      `json:"persistent_keepalive,omitempty"`
+	AllowedIPs          []string `json:"allowed_ips"`
+}
+
+// GetStatus returns a snapshot of the stack and every tunnel.
+func GetStatus() Status {
+	st := Status{FailMode: "closed", Tunnels: []TunnelStatus{}}
+	if failOpen {
+		st.FailMode = "open"
+	}
+
+	st.Overlapped = PendingOverlapped()
+
+	stackMu.RLock()
+	defer stackMu.RUnlock()
+
+	st.Source = globalSource
+	h := health.Load()
+	st.Up = stackInitialized && len(globalTunnels) > 0 && (h == nil || h.err == nil)
+	if !st.Up {
+		healthMu.Lock()
+		st.Reason = healthWhy
+		healthMu.Unlock()
+		switch {
+		case st.Reason != "":
+		case suspendedLoader != nil:
+			st.Reason = "on-demand: suspended while idle"
+		case onDemand:
+			st.Reason = "on-demand: not used yet"
+		default:
+			st.Reason = "stack not initialized"
+		}
+	}
+
+	for _, t := range globalTunnels {
+		ts := t.status()
+		if err := h.downErr(t.Backend); err != nil {
+			ts.Down = err.Error()
+		}
+		st.Tunnels = append(st.Tunnels, ts)
+	}
+	return st
+}
+
+// status describes t. Caller holds stackMu.
+func (t *tunnel) status() TunnelStatus {
+	ts := TunnelStatus{Name: t.Name, Readiness: t.ready.state(), Addresses: []string{}, Peers: []PeerStatus{}}
+	for _, p := range t.Addrs {
+		ts.Addresses = append(ts.Addresses, p.String())
+	}
+	if t.Device == nil {
+		return ts // custom backend: no WireGuard state
+	}
+
+	stats, err := readDeviceStats(t.Device)
+	if err != nil {
+		LogCall("Status", t.Name, err)
+		return ts
+	}
+	ts.ListenPort = stats.ListenPort
+	for _, p := range stats.Peers {
+		ps := PeerStatus{
+			PublicKey:           base64.StdEncoding.EncodeToString(p.PublicKey[:]),
+			Endpoint:            p.Endpoint,
+			RxBytes:             p.RxBytes,
+			TxBytes:             p.TxBytes,
+			PersistentKeepalive: p.PersistentKeepalive,
+			AllowedIPs:          p.AllowedIPs,
+		}
+		if ps.AllowedIPs == nil {
+			ps.AllowedIPs = []string{}
+		}
+		if !p.LastHandshake.IsZero() {
+			ps.LastHandshake = p.LastHandshake.Unix()
+		}
+		if t.applied != nil {
+			ps.ConfiguredEndpoint = t.applied.Peers[p.PublicKey].Endpoint
+		}
+		ts.Peers = append(ts.Peers, ps)
+	}
+	return ts
+}
+
+// GoKlinikalGetStatus writes the status as NUL-terminated JSON into buf. Like
+// GetEnvironmentVariableA it returns the length written (without the NUL), or
+// the buffer size needed (with the NUL) when buf is NULL or too small.
+func GoKlinikalGetStatus(buf *byte, bufLen int32) int32 {
+	LogCall("KlinikalGetStatus", buf, bufLen)
+	data, err := json.Marshal(GetStatus())
+	if err != nil {
+		return 0
+	}
+	need := int32(len(data) + 1)
+	if buf == nil || bufLen < need {
+		return need
+	}
+	dest := unsafe.Slice(buf, bufLen)
+	copy(dest, data)
+	dest[len(data)] = 0
+	return need - 1
+}
@@ -1,14 +1,23 @@
-// tx_extd.go — Extended data transfer APIs. Implements WSASend and WSARecv with
-// multi-buffer (scatter/gather) support and true async overlapped dispatch (when
-// lpOverlapped is non-nil, I/O runs in a goroutine that stores the result in the
-// overlapped tracking map and signals hEvent). Implements WSASendTo and WSARecvFrom
-// (single-buffer delegation to sendto/recvfrom). Implements WSASendMsg and
-// WSARecvMsg (parse WSAMSG struct, route to sendto/recvfrom or WSASend/WSARecv;
-// ancillary data is not supported). Implements WSASendDisconnect and
-// WSARecvDisconnect (map to shutdown SD_SEND/SD_RECEIVE).
+// tx_extd.go — Extended data transfer APIs. Implements WSASend and WSARecv
+// with multi-buffer (scatter/gather) support and true async overlapped
+// dispatch (when lpOverlapped is non-nil, the I/O is queued on the socket's
+// send or receive queue, which runs it in submission order, stores the result
+// in the overlapped tracking map and signals hEvent; see ovl_queue.go). Each
+// overlapped attempt applies its own short deadline and then restores the one
+// set by setsockopt or the last synchronous call. Implements WSASendTo and
+// WSARecvFrom (single-buffer delegation to sendto/recvfrom, or the same
+// asynchronous completion for overlapped calls, with the source address
+// written back when the datagram arrives). Implements WSASendMsg and
+// WSARecvMsg for datagram and raw sockets (parse WSAMSG struct, route to
+// sendto/recvfrom or WSASend/WSARecv, overlapped in either case; ancillary
+// data is not supported). Implements WSASendDisconnect and WSARecvDisconnect
+// (map to shutdown SD_SEND/SD_RECEIVE). The socket's lifecycle state is
+// checked first (see sock_state.go).
 package winsock
 
 import (
+	"net"
+	"time"
 	"unsafe"
 )
 
@@ -63,49 +72,58 @@ func scatterBuffers(lpBuffers unsafe.Pointer, count uint32, data []byte) uint32
 	return uint32(off)
 }
 
+// snapshotBuffers copies the WSABUF descriptors of an overlapped receive.
+// Per Winsock spec, caller MUST keep the buffers themselves valid until the
+// overlapped operation completes, but not the array describing them.
+func snapshotBuffers(lpBuffers unsafe.Pointer, count uint32) unsafe.Pointer {
+	bufsCopy := make([]wsaBuf, count)
+	copy(bufsCopy, unsafe.Slice((*wsaBuf)(lpBuffers), int(count)))
+	return unsafe.Pointer(&bufsCopy[0])
+}
+
 // GoWSASend sends data on a connected socket, supports multi-buffer and overlapped.
-func GoWSASend(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesSent *uint32, dwFlags uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSASend(t Thread, s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesSent *uint32, dwFlags uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSASend", s, lpBuffers, dwBufferCount, lpNumberOfBytesSent, dwFlags, lpOverlapped, lpCompletionRoutine)
 
 	st, ok := registry.Get(s)
-	if !ok || st.Conn == nil {
-		setLastError(WSAENOTSOCK)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.sendError(int32(dwFlags)); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	if !isConnected(st) {
+		t.setLastError(WSAENOTCONN)
 		return -1
 	}
 
 	if dwBufferCount == 0 || lpBuffers == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
 
 	// Async overlapped dispatch
 	if lpOverlapped != nil {
-		ov := (*wsaOverlapped)(lpOverlapped)
-		ovKey := uintptr(lpOverlapped)
-		registry.SetOverlappedResult(ovKey, &OverlappedResult{Complete: false})
-
 		// CRITICAL: Gather buffer data BEFORE launching goroutine.
 		// The caller may free lpBuffers after we return WSA_IO_PENDING.
 		data := gatherBuffers(lpBuffers, dwBufferCount)
 
-		go func() {
-			n, err := st.Conn.Write(data)
-
-			result := &OverlappedResult{
-				BytesTransferred: uint32(n),
-				Complete:         true,
-			}
-			if err != nil {
-				result.Error = mapError(err)
-			}
-			registry.SetOverlappedResult(ovKey, result)
-
-			if ov.HEvent != nil {
-				GoWSASetEvent(ov.HEvent)
-			}
-		}()
-
-		setLastError(WSA_IO_PENDING)
+		sent := 0
+		st.submitOverlapped(ovlSend, "WSASend", lpOverlapped, len(data), func() (uint32, int32, uint32) {
+			code := st.tryWrite(func(conn net.Conn) error {
+				n, err := conn.Write(data[sent:])
+				sent += n
+				return err
+			})
+			return uint32(sent), code, 0
+		})
+
+		t.setLastError(WSA_IO_PENDING)
 		return -1 // SOCKET_ERROR with WSA_IO_PENDING
 	}
 
@@ -113,7 +131,7 @@ func GoWSASend(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumbe
 	data := gatherBuffers(lpBuffers, dwBufferCount)
 	n, err := st.Conn.Write(data)
 	if err != nil {
-		setLastError(mapError(err))
+		t.setLastError(mapError(err))
 		return -1
 	}
 	if lpNumberOfBytesSent != nil {
@@ -123,17 +141,32 @@ func GoWSASend(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumbe
 }
 
 // GoWSARecv receives data from a connected socket, supports multi-buffer and overlapped.
-func GoWSARecv(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesRecvd *uint32, lpFlags *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSARecv(t Thread, s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesRecvd *uint32, lpFlags *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSARecv", s, lpBuffers, dwBufferCount, lpNumberOfBytesRecvd, lpFlags, lpOverlapped, lpCompletionRoutine)
 
 	st, ok := registry.Get(s)
-	if !ok || st.Conn == nil {
-		setLastError(WSAENOTSOCK)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	var flags int32
+	if lpFlags != nil {
+		flags = int32(*lpFlags)
+	}
+	if code := st.recvError(flags); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	if st.Conn == nil {
+		t.setLastError(WSAENOTCONN)
 		return -1
 	}
 
 	if dwBufferCount == 0 || lpBuffers == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
 
@@ -146,38 +179,23 @@ func GoWSARecv(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumbe
 
 	// Async overlapped dispatch
 	if lpOverlapped != nil {
-		ov := (*wsaOverlapped)(lpOverlapped)
-		ovKey := uintptr(lpOverlapped)
-		registry.SetOverlappedResult(ovKey, &OverlappedResult{Complete: false})
-
-		// Snapshot buffer descriptors before launching goroutine.
-		// Per Winsock spec, caller MUST keep buffers valid until overlapped completes.
-		bufsCopy := make([]wsaBuf, dwBufferCount)
-		copy(bufsCopy, unsafe.Slice((*wsaBuf)(lpBuffers), int(dwBufferCount)))
-		scatterTarget := unsafe.Pointer(&bufsCopy[0])
+		scatterTarget := snapshotBuffers(lpBuffers, dwBufferCount)
 
-		go func() {
+		st.submitOverlapped(ovlRecv, "WSARecv", lpOverlapped, totalCap, func() (uint32, int32, uint32) {
 			tmp := make([]byte, totalCap)
-			n, err := st.Conn.Read(tmp)
-
-			result := &OverlappedResult{
-				BytesTransferred: uint32(n),
-				Complete:         true,
-			}
-			if err != nil {
-				result.Error = mapError(err)
-			}
+			var n int
+			code := st.tryRead(func(conn net.Conn) (err error) {
+				n, err = conn.Read(tmp)
+				return err
+			})
 			if n > 0 {
 				scatterBuffers(scatterTarget, dwBufferCount, tmp[:n])
+				code = 0
 			}
-			registry.SetOverlappedResult(ovKey, result)
+			return uint32(n), code, 0
+		})
 
-			if ov.HEvent != nil {
-				GoWSASetEvent(ov.HEvent)
-			}
-		}()
-
-		setLastError(WSA_IO_PENDING)
+		t.setLastError(WSA_IO_PENDING)
 		return -1
 	}
 
@@ -185,7 +203,7 @@ func GoWSARecv(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumbe
 	tmp := make([]byte, totalCap)
 	n, err := st.Conn.Read(tmp)
 	if err != nil && n == 0 {
-		setLastError(mapError(err))
+		t.setLastError(mapError(err))
 		return -1
 	}
 	if n > 0 {
@@ -198,16 +216,20 @@ func GoWSARecv(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumbe
 }
 
 // GoWSASendTo sends data to a specific destination (overlapped).
-func GoWSASendTo(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesSent *uint32, dwFlags uint32, lpTo unsafe.Pointer, iTolen int32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSASendTo(t Thread, s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesSent *uint32, dwFlags uint32, lpTo unsafe.Pointer, iTolen int32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSASendTo", s, lpBuffers, dwBufferCount, lpNumberOfBytesSent, dwFlags, lpTo, iTolen, lpOverlapped, lpCompletionRoutine)
 
 	if dwBufferCount == 0 || lpBuffers == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
 
 	if lpOverlapped != nil {
-		LogCall("WARNING: WSASendTo overlapped I/O not implemented, running synchronously")
+		if st, ok := registry.Get(s); ok && st.Type == TypeTCP {
+			// A connected stream ignores the destination
+			return GoWSASend(t, s, lpBuffers, dwBufferCount, lpNumberOfBytesSent, dwFlags, lpOverlapped, lpCompletionRoutine)
+		}
+		return sendtoOverlapped(t, s, gatherBuffers(lpBuffers, dwBufferCount), int32(dwFlags), lpTo, iTolen, lpOverlapped)
 	}
 
 	// Gather all buffers into a single byte slice
@@ -215,7 +237,7 @@ func GoWSASendTo(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNum
 
 	// Simplified: delegate via a temporary single WSABUF
 	tmpBuf := wsaBuf{Len: uint32(len(data)), Buf: &data[0]}
-	n := GoSendto(s, unsafe.Pointer(tmpBuf.Buf), int32(tmpBuf.Len), int32(dwFlags), lpTo, iTolen)
+	n := GoSendto(t, s, unsafe.Pointer(tmpBuf.Buf), int32(tmpBuf.Len), int32(dwFlags), lpTo, iTolen)
 	if n != -1 {
 		if lpNumberOfBytesSent != nil {
 			*lpNumberOfBytesSent = uint32(n)
@@ -225,17 +247,61 @@ func GoWSASendTo(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNum
 	return -1
 }
 
+// sendtoOverlapped validates a datagram send like sendto, then sends data in
+// the background and completes lpOverlapped.
+func sendtoOverlapped(t Thread, s uint64, data []byte, flags int32, to unsafe.Pointer, tolen int32, lpOverlapped unsafe.Pointer) int32 {
+	st, ok := registry.Get(s)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.sendError(flags); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	dest, code := prepareSendto(st, to, tolen)
+	if code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+
+	st.submitOverlapped(ovlSend, "WSASendTo", lpOverlapped, len(data), func() (uint32, int32, uint32) {
+		var n int
+		code := st.tryWrite(func(conn net.Conn) (err error) {
+			n, err = writeDatagram(st, conn, data, dest)
+			return err
+		})
+		return uint32(n), code, 0
+	})
+
+	t.setLastError(WSA_IO_PENDING)
+	return -1
+}
+
 // GoWSARecvFrom receives a datagram and stores the source address (overlapped).
-func GoWSARecvFrom(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesRecvd *uint32, lpFlags *uint32, lpFrom unsafe.Pointer, lpFromlen *int32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSARecvFrom(t Thread, s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpNumberOfBytesRecvd *uint32, lpFlags *uint32, lpFrom unsafe.Pointer, lpFromlen *int32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSARecvFrom", s, lpBuffers, dwBufferCount, lpNumberOfBytesRecvd, lpFlags, lpFrom, lpFromlen, lpOverlapped, lpCompletionRoutine)
 
 	if dwBufferCount == 0 || lpBuffers == nil {
-		setLastError(WSAEINVAL)
+		t.setLastError(WSAEINVAL)
 		return -1
 	}
 
+	// Read flags
+	var flags int32
+	if lpFlags != nil {
+		flags = int32(*lpFlags)
+	}
+
 	if lpOverlapped != nil {
-		LogCall("WARNING: WSARecvFrom overlapped I/O not implemented, running synchronously")
+		if st, ok := registry.Get(s); ok && st.Type == TypeTCP {
+			// A stream has no per-datagram source to report
+			return GoWSARecv(t, s, lpBuffers, dwBufferCount, lpNumberOfBytesRecvd, lpFlags, lpOverlapped, lpCompletionRoutine)
+		}
+		return recvfromOverlapped(t, s, lpBuffers, dwBufferCount, flags, lpFrom, lpFromlen, lpOverlapped)
 	}
 
 	// Calculate total buffer capacity
@@ -245,16 +311,10 @@ func GoWSARecvFrom(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpN
 		totalCap += int(bufs[i].Len)
 	}
 
-	// Read flags
-	var flags int32
-	if lpFlags != nil {
-		flags = int32(*lpFlags)
-	}
-
 	// Use first buffer for the underlying recvfrom call (it needs a contiguous buffer)
 	tmp := make([]byte, totalCap)
 	tmpPtr := unsafe.Pointer(&tmp[0])
-	n := GoRecvfrom(s, tmpPtr, int32(totalCap), flags, lpFrom, lpFromlen)
+	n := GoRecvfrom(t, s, tmpPtr, int32(totalCap), flags, lpFrom, lpFromlen)
 	if n == -1 {
 		return -1
 	}
@@ -269,24 +329,126 @@ func GoWSARecvFrom(s uint64, lpBuffers unsafe.Pointer, dwBufferCount uint32, lpN
 	return 0
 }
 
+// recvfromOverlapped validates a datagram receive like recvfrom, then
+// receives in the background. The data is scattered into the buffers and the
+// source address and its length are written to from and fromlen, which the
+// caller keeps valid until completion, before lpOverlapped completes.
+func recvfromOverlapped(t Thread, s uint64, lpBuffers unsafe.Pointer, count uint32, flags int32, from unsafe.Pointer, fromlen *int32, lpOverlapped unsafe.Pointer) int32 {
+	st, ok := registry.Get(s)
+	if !ok {
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.recvError(flags); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	if code := prepareRecvfrom(st, from, fromlen); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+
+	bufs := unsafe.Slice((*wsaBuf)(lpBuffers), int(count))
+	totalCap := 0
+	for i := range bufs {
+		totalCap += int(bufs[i].Len)
+	}
+	scatterTarget := snapshotBuffers(lpBuffers, count)
+
+	st.submitOverlapped(ovlRecv, "WSARecvFrom", lpOverlapped, totalCap, func() (uint32, int32, uint32) {
+		tmp := make([]byte, totalCap)
+		var n int
+		var raddr net.Addr
+		code := st.tryRead(func(conn net.Conn) (err error) {
+			n, raddr, err = readDatagram(st, conn, tmp)
+			return err
+		})
+		if code != 0 {
+			return 0, code, 0
+		}
+		scatterBuffers(scatterTarget, count, tmp[:n])
+		if from != nil {
+			writeSockAddr(from, fromlen, netAddrToAddrPort(raddr), st.AddressFamily)
+		}
+		return uint32(n), 0, 0
+	})
+
+	t.setLastError(WSA_IO_PENDING)
+	return -1
+}
+
+// tryRead makes one overlapped receive attempt: read runs on the socket's
+// current connection with a deadline of ovlAttempt, and the deadline recorded
+// for synchronous reads is restored afterwards. It returns WSAENOTCONN while
+// the socket has no connection, and WSAEWOULDBLOCK when the attempt timed out
+// or a synchronous read is in progress, for the queue to wait for readiness
+// again.
+func (st *SocketState) tryRead(read func(conn net.Conn) error) int32 {
+	_, _, conn := st.pollView()
+	if conn == nil {
+		return WSAENOTCONN
+	}
+	st.rxMu.Lock()
+	defer st.rxMu.Unlock()
+	if st.rxSync > 0 {
+		return WSAEWOULDBLOCK
+	}
+	conn.SetReadDeadline(time.Now().Add(ovlAttempt))
+	err := read(conn)
+	conn.SetReadDeadline(st.rxDeadline)
+	if isTimeout(err) {
+		return WSAEWOULDBLOCK
+	}
+	return mapError(err)
+}
+
+// tryWrite is tryRead for an overlapped send.
+func (st *SocketState) tryWrite(write func(conn net.Conn) error) int32 {
+	_, _, conn := st.pollView()
+	if conn == nil {
+		return WSAENOTCONN
+	}
+	st.txMu.Lock()
+	defer st.txMu.Unlock()
+	if st.txSync > 0 {
+		return WSAEWOULDBLOCK
+	}
+	conn.SetWriteDeadline(time.Now().Add(ovlAttempt))
+	err := write(conn)
+	conn.SetWriteDeadline(st.txDeadline)
+	if isTimeout(err) {
+		return WSAEWOULDBLOCK
+	}
+	return mapError(err)
+}
+
 // GoWSARecvDisconnect terminates reception on a socket, maps to shutdown(SD_RECEIVE).
-func GoWSARecvDisconnect(s uint64, lpInboundDisconnectData unsafe.Pointer) int32 {
+func GoWSARecvDisconnect(t Thread, s uint64, lpInboundDisconnectData unsafe.Pointer) int32 {
 	LogCall("WSARecvDisconnect", s, lpInboundDisconnectData)
-	return GoShutdown(s, 0) // SD_RECEIVE
+	return GoShutdown(t, s, SD_RECEIVE)
 }
 
 // GoWSASendDisconnect initiates termination of sending on a socket, maps to shutdown(SD_SEND).
-func GoWSASendDisconnect(s uint64, lpOutboundDisconnectData unsafe.Pointer) int32 {
+func GoWSASendDisconnect(t Thread, s uint64, lpOutboundDisconnectData unsafe.Pointer) int32 {
 	LogCall("WSASendDisconnect", s, lpOutboundDisconnectData)
-	return GoShutdown(s, 1) // SD_SEND
+	return GoShutdown(t, s, SD_SEND)
 }
 
 // GoWSASendMsg sends a message via WSAMSG. Ancillary data (cmsg) is ignored.
-func GoWSASendMsg(s uint64, lpMsg unsafe.Pointer, dwFlags uint32, lpdwBytesSent *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSASendMsg(t Thread, s uint64, lpMsg unsafe.Pointer, dwFlags uint32, lpdwBytesSent *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSASendMsg", s, lpMsg, dwFlags, lpdwBytesSent, lpOverlapped, lpCompletionRoutine)
 
 	if lpMsg == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
+		return -1
+	}
+
+	// Like Winsock, message I/O is for datagram and raw sockets only
+	if st, ok := registry.Get(s); ok && st.Type == TypeTCP {
+		t.setLastError(WSAEOPNOTSUPP)
 		return -1
 	}
 
@@ -295,8 +457,11 @@ func GoWSASendMsg(s uint64, lpMsg unsafe.Pointer, dwFlags uint32, lpdwBytesSent
 	// If a destination name is provided, use sendto path
 	if msg.Name != nil && msg.Namelen > 0 && msg.Buffers != nil && msg.BufferCnt > 0 {
 		data := gatherBuffers(unsafe.Pointer(msg.Buffers), msg.BufferCnt)
+		if lpOverlapped != nil {
+			return sendtoOverlapped(t, s, data, int32(dwFlags), msg.Name, msg.Namelen, lpOverlapped)
+		}
 		tmpBuf := wsaBuf{Len: uint32(len(data)), Buf: &data[0]}
-		n := GoSendto(s, unsafe.Pointer(tmpBuf.Buf), int32(tmpBuf.Len), int32(dwFlags), msg.Name, msg.Namelen)
+		n := GoSendto(t, s, unsafe.Pointer(tmpBuf.Buf), int32(tmpBuf.Len), int32(dwFlags), msg.Name, msg.Namelen)
 		if n != -1 {
 			if lpdwBytesSent != nil {
 				*lpdwBytesSent = uint32(n)
@@ -308,19 +473,25 @@ func GoWSASendMsg(s uint64, lpMsg unsafe.Pointer, dwFlags uint32, lpdwBytesSent
 
 	// No destination — use connected send via WSASend
 	if msg.Buffers != nil && msg.BufferCnt > 0 {
-		return GoWSASend(s, unsafe.Pointer(msg.Buffers), msg.BufferCnt, lpdwBytesSent, dwFlags, lpOverlapped, lpCompletionRoutine)
+		return GoWSASend(t, s, unsafe.Pointer(msg.Buffers), msg.BufferCnt, lpdwBytesSent, dwFlags, lpOverlapped, lpCompletionRoutine)
 	}
 
-	setLastError(WSAEINVAL)
+	t.setLastError(WSAEINVAL)
 	return -1
 }
 
 // GoWSARecvMsg receives a message via WSAMSG. Ancillary data (cmsg) is ignored.
-func GoWSARecvMsg(s uint64, lpMsg unsafe.Pointer, lpdwBytesReceived *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
+func GoWSARecvMsg(t Thread, s uint64, lpMsg unsafe.Pointer, lpdwBytesReceived *uint32, lpOverlapped unsafe.Pointer, lpCompletionRoutine unsafe.Pointer) int32 {
 	LogCall("WSARecvMsg", s, lpMsg, lpdwBytesReceived, lpOverlapped, lpCompletionRoutine)
 
 	if lpMsg == nil {
-		setLastError(WSAEFAULT)
+		t.setLastError(WSAEFAULT)
+		return -1
+	}
+
+	// Like Winsock, message I/O is for datagram and raw sockets only
+	if st, ok := registry.Get(s); ok && st.Type == TypeTCP {
+		t.setLastError(WSAEOPNOTSUPP)
 		return -1
 	}
 
@@ -328,6 +499,14 @@ func GoWSARecvMsg(s uint64, lpMsg unsafe.Pointer, lpdwBytesReceived *uint32, lpO
 
 	// If a source address buffer is provided, use recvfrom path
 	if msg.Name != nil && msg.Buffers != nil && msg.BufferCnt > 0 {
+		if lpOverlapped != nil {
+			// No control data or flags are produced (no cmsg support); the
+			// source address and its length are written on completion
+			msg.Control.Len = 0
+			msg.Flags = 0
+			return recvfromOverlapped(t, s, unsafe.Pointer(msg.Buffers), msg.BufferCnt, 0, msg.Name, &msg.Namelen, lpOverlapped)
+		}
+
 		namelen := msg.Namelen
 
 		bufs := unsafe.Slice(msg.Buffers, int(msg.BufferCnt))
@@ -337,7 +516,7 @@ func GoWSARecvMsg(s uint64, lpMsg unsafe.Pointer, lpdwBytesReceived *uint32, lpO
 		}
 
 		tmp := make([]byte, totalCap)
-		n := GoRecvfrom(s, unsafe.Pointer(&tmp[0]), int32(totalCap), 0, msg.Name, &namelen)
+		n := GoRecvfrom(t, s, unsafe.Pointer(&tmp[0]), int32(totalCap), 0, msg.Name, &namelen)
 		if n != -1 {
 			msg.Namelen = namelen
 			scatterBuffers(unsafe.Pointer(msg.Buffers), msg.BufferCnt, tmp[:n])
@@ -354,12 +533,12 @@ func GoWSARecvMsg(s uint64, lpMsg unsafe.Pointer, lpdwBytesReceived *uint32, lpO
 	// No source address — use connected recv via WSARecv
 	if msg.Buffers != nil && msg.BufferCnt > 0 {
 		var flags uint32
-		ret := GoWSARecv(s, unsafe.Pointer(msg.Buffers), msg.BufferCnt, lpdwBytesReceived, &flags, lpOverlapped, lpCompletionRoutine)
+		ret := GoWSARecv(t, s, unsafe.Pointer(msg.Buffers), msg.BufferCnt, lpdwBytesReceived, &flags, lpOverlapped, lpCompletionRoutine)
 		msg.Flags = flags
 		msg.Control.Len = 0
 		return ret
 	}
 
-	setLastError(WSAEINVAL)
+	t.setLastError(WSAEINVAL)
 	return -1
 }
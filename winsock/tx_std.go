@@ -1,8 +1,11 @@
 // tx_std.go — Standard synchronous data transfer. Implements send (Conn.Write with
 // non-blocking deadline support and Go-to-WSA error mapping), recv (Conn.Read with
 // MSG_PEEK support via a per-socket peek buffer, non-blocking mode, and error
-// mapping), sendto (PacketConn.WriteTo for UDP datagrams), and recvfrom
-// (PacketConn.ReadFrom with source address output into a sockaddr_in struct).
+// mapping), sendto (PacketConn.WriteTo for UDP datagrams and ICMP echoes,
+// refusing destinations outside the tunnel's AllowedIPs), and recvfrom
+// (PacketConn.ReadFrom with source address output into a sockaddr_in or
+// sockaddr_in6 struct, depending on the socket's address family). Each checks
+// the socket's lifecycle state first (see sock_state.go).
 package winsock
 
 import (
@@ -14,8 +17,11 @@ import (
 	"golang.zx2c4.com/wireguard/tun/netstack"
 )
 
-// MSG_PEEK flag value (winsock2.h)
-const MSG_PEEK = 0x2
+// MSG_OOB and MSG_PEEK flag values (winsock2.h)
+const (
+	MSG_OOB  = 0x1
+	MSG_PEEK = 0x2
+)
 
 // synthesizeIPv4Header creates a basic 20-byte IPv4 header for raw sockets.
 func synthesizeIPv4Header(src, dst netip.Addr, payloadLen int) []byte {
@@ -52,33 +58,54 @@ func synthesizeIPv4Header(src, dst netip.Addr, payloadLen int) []byte {
 	return hdr
 }
 
+// frameRawICMP copies a received ICMP message into a raw socket buffer. IPv4
+// raw sockets on Windows deliver the IP header too, so one is synthesized;
+// ICMPv6 raw sockets receive the bare message. Returns the bytes written.
+func frameRawICMP(st *SocketState, dst []byte, src netip.Addr, icmp []byte) int {
+	if st.AddressFamily == AF_INET6 {
+		return copy(dst, icmp)
+	}
+	hdr := synthesizeIPv4Header(src, netip.IPv4Unspecified(), len(icmp))
+	copied := copy(dst, hdr)
+	copied += copy(dst[copied:], icmp)
+	return copied
+}
+
 // goSend sends data on a connected socket.
-func GoSend(s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
+func GoSend(t Thread, s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
 	LogCall("Send", s, buf, len, flags)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.sendError(flags); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 	if !isConnected(st) {
-		setLastError(WSAENOTCONN)
+		t.setLastError(WSAENOTCONN)
 		return -1
 	}
 
 	data := unsafe.Slice((*byte)(buf), int(len))
 
 	if st.IsNonBlocking {
-		st.Conn.SetWriteDeadline(time.Now().Add(time.Nanosecond))
+		st.beginWrite(st.Conn, time.Now().Add(time.Nanosecond))
 	} else {
-		st.Conn.SetWriteDeadline(time.Time{})
+		st.beginWrite(st.Conn, time.Time{})
 	}
+	defer st.endWrite()
 
 	n, err := st.Conn.Write(data)
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && st.IsNonBlocking {
-			setLastError(WSAEWOULDBLOCK)
+			t.setLastError(WSAEWOULDBLOCK)
 		} else {
-			setLastError(mapError(err))
+			t.setLastError(mapError(err))
 		}
 		return -1
 	}
@@ -88,15 +115,22 @@ func GoSend(s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
 
 // goRecv receives data from a connected socket.
 // Supports MSG_PEEK: data is returned but not removed from the receive buffer.
-func GoRecv(s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
+func GoRecv(t Thread, s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
 	LogCall("Recv", s, buf, len, flags)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.recvError(flags); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 	if !isConnected(st) {
-		setLastError(WSAENOTCONN)
+		t.setLastError(WSAENOTCONN)
 		return -1
 	}
 
@@ -126,10 +160,11 @@ func GoRecv(s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
 	}
 
 	if st.IsNonBlocking {
-		st.Conn.SetReadDeadline(time.Now().Add(time.Nanosecond))
+		st.beginRead(st.Conn, time.Now().Add(time.Nanosecond))
 	} else {
-		st.Conn.SetReadDeadline(time.Time{})
+		st.beginRead(st.Conn, time.Time{})
 	}
+	defer st.endRead()
 
 	var rn int
 	var err error
@@ -137,16 +172,8 @@ func GoRecv(s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
 		icmpData := make([]byte, int(len))
 		rn, err = st.Conn.Read(icmpData)
 		if err == nil && rn > 0 {
-			var srcIP netip.Addr
-			if raddr := st.Conn.RemoteAddr(); raddr != nil {
-				if pingAddr, ok := raddr.(*netstack.PingAddr); ok {
-					srcIP = pingAddr.Addr()
-				}
-			}
-			hdr := synthesizeIPv4Header(srcIP, netip.MustParseAddr("0.0.0.0"), rn)
-			copied := copy(data, hdr)
-			copied += copy(data[copied:], icmpData[:rn])
-			rn = copied
+			srcIP, _ := pingAddrOf(st.Conn.RemoteAddr())
+			rn = frameRawICMP(st, data, srcIP, icmpData[:rn])
 		}
 	} else {
 		rn, err = st.Conn.Read(data)
@@ -162,9 +189,9 @@ func GoRecv(s uint64, buf unsafe.Pointer, len int32, flags int32) int32 {
 
 	if err != nil && n == 0 {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && st.IsNonBlocking {
-			setLastError(WSAEWOULDBLOCK)
+			t.setLastError(WSAEWOULDBLOCK)
 		} else {
-			setLastError(mapError(err))
+			t.setLastError(mapError(err))
 		}
 		return -1
 	}
@@ -177,219 +204,292 @@ func builtins_len(b []byte) int { return len(b) }
 
 // isConnected checks if the socket is connected to a remote address.
 func isConnected(st *SocketState) bool {
-	if st.Conn == nil {
+	return hasPeer(st.Conn)
+}
+
+// hasPeer reports whether conn is connected to a remote address.
+func hasPeer(conn net.Conn) bool {
+	if conn == nil {
 		return false
 	}
-	raddr := st.Conn.RemoteAddr()
+	raddr := conn.RemoteAddr()
 	if raddr == nil {
 		return false
 	}
-	if pingAddr, ok := raddr.(*netstack.PingAddr); ok {
-		return pingAddr.Addr().IsValid()
+	if ip, ok := pingAddrOf(raddr); ok {
+		return ip.IsValid()
 	}
 	return true
 }
 
 // goSendto sends data to a specific destination using datagram sockets.
-func GoSendto(s uint64, buf unsafe.Pointer, len int32, flags int32, to unsafe.Pointer, tolen int32) int32 {
+func GoSendto(t Thread, s uint64, buf unsafe.Pointer, len int32, flags int32, to unsafe.Pointer, tolen int32) int32 {
 	LogCall("Sendto", s, buf, len, flags, to, tolen)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
+		return -1
+	}
+	if stackWaking(t, st) {
+		return -1
+	}
+	if netDown(t, st) {
+		return -1
+	}
+	if code := st.sendError(flags); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	if st.Type == TypeTCP {
+		// A connected stream ignores the destination, as Winsock does
+		return GoSend(t, s, buf, len, flags)
+	}
+
+	dest, code := prepareSendto(st, to, tolen)
+	if code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 
 	data := unsafe.Slice((*byte)(buf), int(len))
 
-	var udpAddr *net.UDPAddr
-	var pingAddr net.Addr
+	if st.IsNonBlocking {
+		st.beginWrite(st.Conn, time.Now().Add(time.Nanosecond))
+	} else {
+		st.beginWrite(st.Conn, time.Time{})
+	}
+	defer st.endWrite()
+
+	n, err := writeDatagram(st, st.Conn, data, dest)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && st.IsNonBlocking {
+			t.setLastError(WSAEWOULDBLOCK)
+		} else {
+			t.setLastError(mapError(err))
+		}
+		return -1
+	}
+
+	return int32(n)
+}
+
+// prepareSendto validates the destination of a sendto on a datagram or raw
+// socket and binds the socket implicitly if needed. It returns the
+// destination, invalid for a connected socket, or the WSA error.
+func prepareSendto(st *SocketState, to unsafe.Pointer, tolen int32) (netip.AddrPort, int32) {
+	var dest netip.AddrPort
 	if to != nil {
-		addr, err := parseSockAddrIn(to)
+		addr, err := parseSockAddr(to, tolen)
 		if err != nil {
-			setLastError(WSAEINVAL)
-			return -1
+			return dest, mapError(err)
 		}
-		if st.Type == TypeRaw {
-			host, _, _ := net.SplitHostPort(addr)
-			netipAddr, _ := netip.ParseAddr(host)
-			pingAddr = netstack.PingAddrFromAddr(netipAddr)
-		} else {
-			udpAddr, _ = net.ResolveUDPAddr("udp", addr)
+		if !checkSockAddrFamily(st, addr) {
+			return dest, WSAEFAULT
+		}
+		if err := checkDest(st, addr); err != nil {
+			return dest, mapError(err)
 		}
+		dest = addr
 	} else if !isConnected(st) {
 		// If not connected and 'to' is nil, it's an error
-		setLastError(WSAEDESTADDRREQ)
-		return -1
+		return dest, WSAEDESTADDRREQ
 	}
 
 	if st.Conn == nil {
-		if st.Type == TypeUDP {
-			stack, err := GetStack()
-			if err != nil {
-				setLastError(WSAEHOSTUNREACH)
-				return -1
-			}
-			// Implicit bind to 0.0.0.0:0 (any port, IPv4)
-			conn, err := stack.ListenUDP(&net.UDPAddr{
-				IP:   net.IPv4zero,
-				Port: 0,
-			})
-			if err != nil {
-				setLastError(mapError(err))
-				return -1
-			}
-			st.Conn = conn
-		} else if st.Type == TypeRaw {
-			stack, err := GetStack()
-			if err != nil {
-				setLastError(WSAEHOSTUNREACH)
-				return -1
-			}
-			conn, err := stack.ListenPing(netstack.PingAddrFromAddr(netip.MustParseAddr("0.0.0.0")))
-			if err != nil {
-				setLastError(mapError(err))
-				return -1
-			}
-			st.Conn = conn
+		backend, err := socketBackend(st, dest.Addr())
+		if err != nil {
+			return dest, mapError(err)
+		}
+		var conn net.Conn
+		if st.Type == TypeRaw {
+			conn, err = backend.ListenPing(unspecifiedAddr(st.AddressFamily))
 		} else {
-			setLastError(WSAENOTCONN)
-			return -1
+			// Implicit bind to the wildcard address of the socket's family (any port)
+			conn, err = backend.DialUDP(st, netip.AddrPortFrom(unspecifiedAddr(st.AddressFamily), 0), netip.AddrPort{})
+		}
+		if err != nil {
+			return dest, mapError(err)
 		}
+		st.rebind(func() { st.Conn, st.Backend = conn, backend })
+		st.setState(StateBound)
 	}
-
-	pConn, ok := st.Conn.(net.PacketConn)
-	if !ok {
-		// If it's a TCP conn or listener, fail
-		setLastError(WSAEINVAL)
-		return -1
+	if err := backendReady(st.Backend); err != nil {
+		return dest, mapError(err)
+	}
+	if isConnected(st) {
+		// 'to' is ignored and it acts like send()
+		return netip.AddrPort{}, 0
+	}
+	// Fail at once rather than let WireGuard drop the datagram
+	if err := checkRoute(st.Backend, dest.Addr()); err != nil {
+		return dest, mapError(err)
 	}
 
-	if st.IsNonBlocking {
-		st.Conn.SetWriteDeadline(time.Now().Add(time.Nanosecond))
-	} else {
-		st.Conn.SetWriteDeadline(time.Time{})
+	if _, ok := st.Conn.(net.PacketConn); !ok {
+		return dest, WSAEINVAL
 	}
+	return dest, 0
+}
 
-	var n int
-	var err error
+// beginRead applies d to conn for a synchronous read and marks the read as
+// in progress until endRead, so that overlapped receive attempts leave the
+// deadline alone meanwhile (see tx_extd.go).
+func (st *SocketState) beginRead(conn net.Conn, d time.Time) {
+	st.rxMu.Lock()
+	st.rxSync++
+	st.setReadDeadline(conn, d)
+	st.rxMu.Unlock()
+}
 
-	// If the socket is connected, 'to' is ignored and it acts like send()
-	if isConnected(st) {
-		n, err = st.Conn.Write(data)
-	} else {
-		if st.Type == TypeRaw {
-			n, err = pConn.WriteTo(data, pingAddr)
-		} else {
-			n, err = pConn.WriteTo(data, udpAddr)
-		}
-	}
+// endRead ends a read started with beginRead.
+func (st *SocketState) endRead() {
+	st.rxMu.Lock()
+	st.rxSync--
+	st.rxMu.Unlock()
+}
 
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && st.IsNonBlocking {
-			setLastError(WSAEWOULDBLOCK)
-		} else {
-			setLastError(mapError(err))
-		}
-		return -1
-	}
+// beginWrite is beginRead for writes.
+func (st *SocketState) beginWrite(conn net.Conn, d time.Time) {
+	st.txMu.Lock()
+	st.txSync++
+	st.setWriteDeadline(conn, d)
+	st.txMu.Unlock()
+}
 
-	return int32(n)
+// endWrite ends a write started with beginWrite.
+func (st *SocketState) endWrite() {
+	st.txMu.Lock()
+	st.txSync--
+	st.txMu.Unlock()
+}
+
+// setReadDeadline applies d to conn and records it as the read deadline that
+// an overlapped receive attempt restores after applying its own. The caller
+// holds rxMu.
+func (st *SocketState) setReadDeadline(conn net.Conn, d time.Time) {
+	st.rxDeadline = d
+	conn.SetReadDeadline(d)
+}
+
+// setWriteDeadline is setReadDeadline for writes. The caller holds txMu.
+func (st *SocketState) setWriteDeadline(conn net.Conn, d time.Time) {
+	st.txDeadline = d
+	conn.SetWriteDeadline(d)
+}
+
+// writeDatagram sends data on a socket prepared by prepareSendto: to dest, or
+// to the peer when dest is invalid.
+func writeDatagram(st *SocketState, conn net.Conn, data []byte, dest netip.AddrPort) (int, error) {
+	if !dest.IsValid() {
+		return conn.Write(data)
+	}
+	pConn := conn.(net.PacketConn)
+	if st.Type == TypeRaw {
+		return pConn.WriteTo(data, netstack.PingAddrFromAddr(dest.Addr()))
+	}
+	return pConn.WriteTo(data, net.UDPAddrFromAddrPort(dest))
 }
 
 // goRecvfrom receives a datagram and stores the source address.
-func GoRecvfrom(s uint64, buf unsafe.Pointer, len int32, flags int32, from unsafe.Pointer, fromlen *int32) int32 {
+func GoRecvfrom(t Thread, s uint64, buf unsafe.Pointer, len int32, flags int32, from unsafe.Pointer, fromlen *int32) int32 {
 	LogCall("Recvfrom", s, buf, len, flags, from, fromlen)
 	st, ok := registry.Get(s)
 	if !ok {
-		setLastError(WSAENOTSOCK)
+		t.setLastError(WSAENOTSOCK)
 		return -1
 	}
-
-	if st.Conn == nil {
-		setLastError(WSAEINVAL)
+	if netDown(t, st) {
 		return -1
 	}
-
-	pConn, ok := st.Conn.(net.PacketConn)
-	if !ok {
-		setLastError(WSAEINVAL)
+	if code := st.recvError(flags); code != 0 {
+		t.setLastError(code)
+		return -1
+	}
+	if st.Type == TypeTCP {
+		// The source of a connected stream is its peer
+		n := GoRecv(t, s, buf, len, flags)
+		if n >= 0 && from != nil && fromlen != nil {
+			writeSockAddr(from, fromlen, netAddrToAddrPort(st.Conn.RemoteAddr()), st.AddressFamily)
+		}
+		return n
+	}
+	if code := prepareRecvfrom(st, from, fromlen); code != 0 {
+		t.setLastError(code)
 		return -1
 	}
 
 	data := unsafe.Slice((*byte)(buf), int(len))
 
 	if st.IsNonBlocking {
-		st.Conn.SetReadDeadline(time.Now().Add(time.Nanosecond))
+		st.beginRead(st.Conn, time.Now().Add(time.Nanosecond))
 	} else {
-		st.Conn.SetReadDeadline(time.Time{})
+		st.beginRead(st.Conn, time.Time{})
+	}
+	defer st.endRead()
+
+	n, raddr, err := readDatagram(st, st.Conn, data)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && st.IsNonBlocking {
+			t.setLastError(WSAEWOULDBLOCK)
+		} else {
+			t.setLastError(mapError(err))
+		}
+		return -1
 	}
 
+	if from != nil {
+		writeSockAddr(from, fromlen, netAddrToAddrPort(raddr), st.AddressFamily)
+	}
+
+	return int32(n)
+}
+
+// prepareRecvfrom checks that a datagram or raw socket can receive into the
+// source-address buffer from, returning the WSA error if not.
+func prepareRecvfrom(st *SocketState, from unsafe.Pointer, fromlen *int32) int32 {
+	if st.Conn == nil {
+		return WSAEINVAL
+	}
+	if _, ok := st.Conn.(net.PacketConn); !ok {
+		return WSAEINVAL
+	}
+
+	// A short source-address buffer is rejected before the datagram is consumed.
+	if from != nil && (fromlen == nil || *fromlen < sockAddrLen(st.AddressFamily)) {
+		return WSAEFAULT
+	}
+	return 0
+}
+
+// readDatagram receives one datagram, or one framed ICMP message on a raw
+// socket, into data and returns its length and source.
+func readDatagram(st *SocketState, conn net.Conn, data []byte) (int, net.Addr, error) {
+	pConn := conn.(net.PacketConn)
+
 	var n int
 	var raddr net.Addr
 	var err error
 
 	if st.Type == TypeRaw {
-		icmpData := make([]byte, int(len))
-		if isConnected(st) {
-			n, err = st.Conn.Read(icmpData)
-			raddr = st.Conn.RemoteAddr()
+		icmpData := make([]byte, len(data))
+		if hasPeer(conn) {
+			n, err = conn.Read(icmpData)
+			raddr = conn.RemoteAddr()
 		} else {
 			n, raddr, err = pConn.ReadFrom(icmpData)
 		}
 
 		if err == nil && n > 0 {
-			var srcIP netip.Addr
-			if pingAddr, ok := raddr.(*netstack.PingAddr); ok {
-				srcIP = pingAddr.Addr()
-			}
-
-			hdr := synthesizeIPv4Header(srcIP, netip.MustParseAddr("0.0.0.0"), n)
-
-			copied := copy(data, hdr)
-			copied += copy(data[copied:], icmpData[:n])
-			n = copied
+			srcIP, _ := pingAddrOf(raddr)
+			n = frameRawICMP(st, data, srcIP, icmpData[:n])
 		}
 	} else {
-		if isConnected(st) {
-			n, err = st.Conn.Read(data)
-			raddr = st.Conn.RemoteAddr()
+		if hasPeer(conn) {
+			n, err = conn.Read(data)
+			raddr = conn.RemoteAddr()
 		} else {
 			n, raddr, err = pConn.ReadFrom(data)
 		}
 	}
-
-	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && st.IsNonBlocking {
-			setLastError(WSAEWOULDBLOCK)
-		} else {
-			setLastError(mapError(err))
-		}
-		return -1
-	}
-
-	if from != nil && fromlen != nil && *fromlen >= 16 {
-		sa := (*struct {
-			Family uint16
-			Port   uint16
-			Addr   [4]byte
-			Zero   [8]byte
-		})(from)
-		sa.Family = 2
-
-		if st.Type == TypeRaw {
-			if pingAddr, ok := raddr.(*netstack.PingAddr); ok {
-				sa.Port = 0
-				addr4 := pingAddr.Addr().As4()
-				copy(sa.Addr[:], addr4[:])
-			}
-		} else {
-			if udpPeer, ok := raddr.(*net.UDPAddr); ok {
-				sa.Port = uint16(udpPeer.Port>>8) | uint16(udpPeer.Port&0xFF)<<8
-				copy(sa.Addr[:], udpPeer.IP.To4())
-			}
-		}
-		*fromlen = 16
-	}
-
-	return int32(n)
+	return n, raddr, err
 }
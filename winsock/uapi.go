@@ -0,0 +1,77 @@
+// uapi.go — Optional UAPI endpoint for a tunnel's WireGuard device, so the
+// standard wg tool can inspect (wg show) and change (wg set) the device living
+// inside the host process. Enabled per tunnel with the [Interface] keys
+// UAPI = true | <name> | <path> and UAPIAccess = <SDDL or octal mode>; the
+// listener is a named pipe on Windows and a Unix socket elsewhere (see
+// uapi_windows.go and uapi_other.go). Each connection speaks the get=1/set=1
+// text protocol through device.IpcHandle. Changes made this way are not part
+// of the config and can be undone by the next reload.
+package winsock
+
+import (
+	"strconv"
+	"strings"
+)
+
+// uapiSettings is the UAPI part of an [Interface] section.
+type uapiSettings struct {
+	Enabled bool
+	Path    string // listener path; "" = derived from the tunnel name
+	Access  string // platform access control; "" = default
+}
+
+// parseUAPIValue reads the value of a UAPI key: a boolean (also on/off,
+// yes/no), or the name or path the listener is published under.
+func parseUAPIValue(value string) uapiSettings {
+	switch strings.ToLower(value) {
+	case "on", "yes":
+		return uapiSettings{Enabled: true}
+	case "off", "no":
+		return uapiSettings{}
+	}
+	if on, err := strconv.ParseBool(value); err == nil {
+		return uapiSettings{Enabled: on}
+	}
+	return uapiSettings{Enabled: true, Path: value}
+}
+
+// startUAPI opens the UAPI listener configured for t, replacing a listener
+// with different settings. Failures are logged; the tunnel runs without it.
+func (t *tunnel) startUAPI(ifc *WGInterface) {
+	if t.Device == nil || (t.uapiListener != nil && t.uapi == ifc.UAPI) {
+		return
+	}
+	t.stopUAPI()
+	t.uapi = ifc.UAPI
+	if !ifc.UAPI.Enabled {
+		return
+	}
+
+	path := uapiPath(ifc.UAPI.Path, processProfile()+"-"+t.Name)
+	ln, err := listenUAPI(path, ifc.UAPI.Access)
+	if err != nil {
+		LogNotice("tunnel %s: cannot open UAPI listener %s: %v", t.Name, path, err)
+		return
+	}
+	LogNotice("tunnel %s: UAPI listening on %s", t.Name, path)
+	t.uapiListener = ln
+
+	dev := t.Device
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+}
+
+// stopUAPI closes t's UAPI listener, if any.
+func (t *tunnel) stopUAPI() {
+	if t.uapiListener != nil {
+		t.uapiListener.Close()
+		t.uapiListener = nil
+	}
+}
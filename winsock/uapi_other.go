@@ -0,0 +1,81 @@
+//go:build !windows
+
+// uapi_other.go — Unix socket listener for the UAPI endpoint. A bare name is
+// published as /var/run/wireguard/<name>.sock, where the wg tool looks for
+// userspace interfaces; a value containing a slash is used as the socket path.
+// Access is an octal file mode, 0600 by default. A stale socket left behind by
+// a crashed process is replaced; a live one is reported as in use.
+package winsock
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	uapiSocketDir  = "/var/run/wireguard"
+	uapiSocketMode = 0o600
+)
+
+// uapiPath returns the socket for a configured UAPI value, or for name if the
+// value is empty.
+func uapiPath(value, name string) string {
+	if value == "" {
+		value = name
+	}
+	if strings.Contains(value, "/") {
+		return value
+	}
+	return filepath.Join(uapiSocketDir, value+".sock")
+}
+
+// checkUAPIAccess validates a UAPIAccess value as an octal permission mode.
+func checkUAPIAccess(access string) error {
+	_, err := parseUAPIMode(access)
+	return err
+}
+
+func parseUAPIMode(access string) (os.FileMode, error) {
+	if access == "" {
+		return uapiSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(access, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, errors.New("want an octal mode such as 0660")
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenUAPI creates the Unix socket at path.
+func listenUAPI(path, access string) (net.Listener, error) {
+	mode, err := parseUAPIMode(access)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		if c, dialErr := net.Dial("unix", path); dialErr == nil {
+			c.Close()
+			return nil, errors.New("socket in use")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		if ln, err = net.Listen("unix", path); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,48 @@
+// uapi_windows.go — Named pipe listener for the UAPI endpoint. A bare name is
+// published under the pipe prefix wg.exe searches, so `wg show <name>` finds
+// it; that prefix only admits elevated processes, and an unelevated host needs
+// a full \\.\pipe\ path instead. Access is an SDDL security descriptor,
+// defaulting to wireguard-go's SYSTEM and Administrators only.
+package winsock
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/ipc/namedpipe"
+)
+
+// uapiPipePrefix is where wg.exe looks for WireGuard interfaces.
+const uapiPipePrefix = `\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`
+
+// uapiPath returns the pipe for a configured UAPI value, or for name if the
+// value is empty.
+func uapiPath(value, name string) string {
+	if value == "" {
+		value = name
+	}
+	if strings.HasPrefix(value, `\\`) {
+		return value
+	}
+	return uapiPipePrefix + value
+}
+
+// checkUAPIAccess validates a UAPIAccess value as an SDDL string.
+func checkUAPIAccess(access string) error {
+	_, err := windows.SecurityDescriptorFromString(access)
+	return err
+}
+
+// listenUAPI creates the named pipe at path.
+func listenUAPI(path, access string) (net.Listener, error) {
+	sd := ipc.UAPISecurityDescriptor
+	if access != "" {
+		var err error
+		if sd, err = windows.SecurityDescriptorFromString(access); err != nil {
+			return nil, err
+		}
+	}
+	return (&namedpipe.ListenConfig{SecurityDescriptor: sd}).Listen(path)
+}
@@ -1,11 +1,14 @@
 package winsock
 
 import (
+	"net/netip"
 	"reflect"
 	"unsafe"
 
-	"gvisor.dev/gvisor/pkg/waiter"
+	"golang.zx2c4.com/wireguard/tun/netstack"
 	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 // GetWaiterQueue extracts the underlying waiter.Queue from a net.Conn or net.Listener
@@ -74,7 +77,56 @@ func GetEndpoint(obj interface{}) tcpip.Endpoint {
 	return nil
 }
 
-// UpdateWaiterQueue updates the WaiterQueue and Endpoint for a SocketState.
+// GetTCPIPStack extracts the gVisor stack behind a netstack.Net. The wireguard
+// netstack package keeps it unexported, but endpoints that need socket options
+// applied before bind (IPV6_V6ONLY) must be created on it directly.
+func GetTCPIPStack(tnet *netstack.Net) *stack.Stack {
+	if tnet == nil {
+		return nil
+	}
+
+	v := reflect.ValueOf(tnet).Elem()
+	stField := v.FieldByName("stack")
+	if !stField.IsValid() || stField.Kind() != reflect.Ptr {
+		return nil
+	}
+	return (*stack.Stack)(unsafe.Pointer(stField.Pointer()))
+}
+
+// WithNetDNS returns a copy of tnet that resolves names with servers, or nil
+// if the netstack internals are not as expected. The servers are fixed at
+// CreateNetTUN time and unexported, and lookups read them unsynchronized, so a
+// config reload that changes DNS= cannot patch them in place. The copy shares
+// tnet's stack; lookups still running on tnet finish with the old servers.
+func WithNetDNS(tnet *netstack.Net, servers []netip.Addr) *netstack.Net {
+	if tnet == nil {
+		return nil
+	}
+
+	dup := new(netstack.Net)
+	*dup = *tnet
+	dnsField := reflect.ValueOf(dup).Elem().FieldByName("dnsServers")
+	if !dnsField.IsValid() || dnsField.Type() != reflect.TypeOf(servers) {
+		return nil
+	}
+	*(*[]netip.Addr)(unsafe.Pointer(dnsField.UnsafeAddr())) = servers
+	return dup
+}
+
+// socketObject returns the connection or listener backing st, if any.
+func (st *SocketState) socketObject() interface{} {
+	if st.Conn != nil {
+		return st.Conn
+	}
+	if st.Listener != nil {
+		return st.Listener
+	}
+	return nil
+}
+
+// UpdateWaiterQueue updates the WaiterQueue, Endpoint and readiness source for
+// a SocketState from its backend's readiness hook. The caller holds stateMu
+// (see rebind) unless st is not registered yet.
 func UpdateWaiterQueue(st *SocketState) {
 	// Unregister existing waiter if any
 	if st.WaiterEntry != nil && st.WaiterQueue != nil {
@@ -82,15 +134,10 @@ func UpdateWaiterQueue(st *SocketState) {
 		st.WaiterEntry = nil
 	}
 
-	if st.Conn != nil {
-		st.WaiterQueue = GetWaiterQueue(st.Conn)
-		st.Endpoint = GetEndpoint(st.Conn)
-	} else if st.Listener != nil {
-		st.WaiterQueue = GetWaiterQueue(st.Listener)
-		st.Endpoint = GetEndpoint(st.Listener)
-	} else {
-		st.WaiterQueue = nil
-		st.Endpoint = nil
+	st.WaiterQueue, st.Ready, st.Endpoint = nil, nil, nil
+	if obj := st.socketObject(); obj != nil && st.Backend != nil {
+		st.WaiterQueue, st.Ready = st.Backend.Readiness(obj)
+		st.Endpoint, _ = st.Ready.(tcpip.Endpoint)
 	}
 
 	// Re-register waiter if WSAEventSelect was called
@@ -112,8 +159,8 @@ func UpdateWaiterQueue(st *SocketState) {
 			st.WaiterQueue.EventRegister(st.WaiterEntry)
 
 			// Trigger an initial notification to catch already-ready events
-			if st.Endpoint != nil {
-				readyMask := st.Endpoint.Readiness(mask)
+			if st.Ready != nil {
+				readyMask := st.Ready.Readiness(mask)
 				if readyMask != 0 {
 					st.NotifyEvent(readyMask)
 				}
@@ -0,0 +1,815 @@
+// wg_conf.go — wg-quick compatible configuration parser. Reads the [Interface]
+// and [Peer] sections of a wg.conf (PrivateKey, ListenPort, FwMark, Address,
+// DNS with search domains, MTU; PublicKey, PresharedKey, AllowedIPs, Endpoint,
+// PersistentKeepalive, Transport), accepting repeated Address/DNS/AllowedIPs
+// lines and comma-separated lists the way wg-quick does. wg-quick's host-side
+// keys (Table, SaveConfig, Pre/PostUp, Pre/PostDown) are accepted and ignored
+// since there is no OS interface to configure. A file may hold several
+// [Interface] sections, each (optionally named with Name =) defining its own
+// tunnel with the [Peer] sections that follow it; UAPI / UAPIAccess publish its
+// device to the wg tool (see uapi.go) and the AmneziaWG keys Jc, Jmin, Jmax,
+// S1, S2 and H1-H4 obfuscate its packets (see obfuscation.go). A [Split]
+// section (KLINIKAL extension) lists Exclude and Include routes for split
+// tunneling, and a [Proxy] section (Address, Username, Password) sends the
+// outer WireGuard traffic through a SOCKS5 proxy; both apply to the whole file
+// and may appear anywhere. Every malformed line is reported with its line
+// number, and WGConfig.IpcRequest renders the result as a UAPI set=1 body for
+// device.IpcSet.
+package winsock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultMTU is used when [Interface] has no MTU line (wg-quick default).
+const defaultMTU = 1420
+
+// wgKey is a Curve25519 key or preshared key decoded from base64.
+type wgKey [32]byte
+
+// Hex returns the key in the lowercase hex form used by the UAPI protocol.
+func (k wgKey) Hex() string {
+	return hex.EncodeToString(k[:])
+}
+
+// writeUAPI writes "name=<hex key>\n" to b without creating an intermediate
+// string, so secret keys only live in buffers that can be wiped.
+func (k *wgKey) writeUAPI(b *secretBuffer, name string) {
+	var enc [64]byte
+	hex.Encode(enc[:], k[:])
+	b.WriteString(name)
+	b.WriteByte('=')
+	b.Write(enc[:])
+	b.WriteByte('\n')
+	wipe(enc[:])
+}
+
+// WGInterface holds the parsed [Interface] section.
+type WGInterface struct {
+	Name        string // tunnel name; wg0, wg1, ... unless set with Name =
+	PrivateKey  wgKey
+	Addresses   []netip.Prefix
+	DNS         []netip.Addr
+	DNSSearch   []string
+	MTU         int
+	ListenPort  int // 0 = let the bind choose
+	FwMark      uint32
+	UAPI        uapiSettings
+	Obfuscation obfuscation // off unless Jc/Jmin/Jmax/S1/S2/H1-H4 are set
+}
+
+// WGPeer holds one parsed [Peer] section.
+type WGPeer struct {
+	PublicKey           wgKey
+	PresharedKey        wgKey
+	HasPresharedKey     bool
+	Endpoint            string // host:port as written; resolved by IpcRequest
+	Transport           string // outer transport: "udp" (default) or "tcp"
+	AllowedIPs          []netip.Prefix
+	PersistentKeepalive int // seconds, 0 = off
+
+	resolved *endpointLookup // Endpoint resolved ahead by ResolveEndpoints; nil = not yet
+}
+
+// endpointLookup is the outcome of resolving a peer Endpoint.
+type endpointLookup struct {
+	addr string
+	err  error
+}
+
+// WGConfig is a fully parsed and validated wg-quick configuration.
+type WGConfig struct {
+	Interface WGInterface
+	Peers     []WGPeer
+}
+
+// SplitRules holds the [Split] routes deciding which destinations bypass the
+// tunnels (see tunnel_route.go).
+type SplitRules struct {
+	Exclude []netip.Prefix // sent through the host network
+	Include []netip.Prefix // kept in the tunnels; everything else is direct when set
+}
+
+// ConfigFile is everything parsed from one configuration file.
+type ConfigFile struct {
+	Tunnels []*WGConfig
+	Split   SplitRules
+	Proxy   *ProxyConfig // nil unless a [Proxy] section is present
+}
+
+// Wipe zeroes the key material of every tunnel in the file and the proxy
+// password.
+func (f *ConfigFile) Wipe() {
+	for _, cfg := range f.Tunnels {
+		cfg.Wipe()
+	}
+	f.Proxy.Wipe()
+}
+
+// ConfigError is a single diagnostic tied to a line of the configuration.
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// configParser accumulates diagnostics while walking the file.
+type configParser struct {
+	file string
+	errs []error
+	seen map[string]int // per-section single-valued keys already set → line
+}
+
+func (p *configParser) errorf(line int, format string, args ...interface{}) {
+	p.errs = append(p.errs, &ConfigError{File: p.file, Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// once reports whether a single-valued key appears for the first time in the
+// current section, flagging repeats.
+func (p *configParser) once(line int, key string) bool {
+	if prev, dup := p.seen[key]; dup {
+		p.errorf(line, "duplicate %s (first set on line %d)", key, prev)
+		return false
+	}
+	p.seen[key] = line
+	return true
+}
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func parseKey(value string) (wgKey, error) {
+	var k wgKey
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	defer wipe(decoded)
+	if err != nil {
+		return k, errors.New("not valid base64")
+	}
+	if len(decoded) != len(k) {
+		return k, fmt.Errorf("decodes to %d bytes, want 32", len(decoded))
+	}
+	copy(k[:], decoded)
+	return k, nil
+}
+
+// parsePrefix accepts "addr/bits" or a bare address (host prefix).
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		return netip.ParsePrefix(value)
+	}
+	ip, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func parseRangedInt(value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	if n < min || n > max {
+		return 0, fmt.Errorf("out of range %d-%d", min, max)
+	}
+	return n, nil
+}
+
+// ParseConfig parses wg-quick formatted configuration data. name is used only
+// to label diagnostics. Each [Interface] section starts a separate tunnel that
+// owns the [Peer] sections following it; a file with one [Interface] is a plain
+// wg-quick config. All problems found are returned together.
+func ParseConfig(name string, data []byte) (*ConfigFile, error) {
+	p := &configParser{file: filepath.Base(name)}
+	var split SplitRules
+	var proxy *ProxyConfig
+	var cfgs []*WGConfig
+	var cfg *WGConfig
+
+	section := ""
+	sectionLine := 0
+	var peer *WGPeer
+
+	// finishSection validates required keys once a section is complete.
+	finishSection := func() {
+		switch section {
+		case "Interface":
+			if _, ok := p.seen["PrivateKey"]; !ok {
+				p.errorf(sectionLine, "[Interface] is missing PrivateKey")
+			}
+			if len(cfg.Interface.Addresses) == 0 {
+				p.errorf(sectionLine, "[Interface] is missing Address")
+			}
+			if err := cfg.Interface.Obfuscation.check(); err != nil {
+				p.errorf(sectionLine, "invalid obfuscation: %v", err)
+			}
+		case "Peer":
+			if _, ok := p.seen["PublicKey"]; !ok {
+				p.errorf(sectionLine, "[Peer] is missing PublicKey")
+			}
+			if cfg != nil {
+				cfg.Peers = append(cfg.Peers, *peer)
+			}
+			peer = nil
+		case "Proxy":
+			if _, ok := p.seen["Address"]; !ok {
+				p.errorf(sectionLine, "[Proxy] is missing Address")
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				p.errorf(lineNo, "malformed section header %q", line)
+				continue
+			}
+			finishSection()
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			sectionLine = lineNo
+			p.seen = map[string]int{}
+			switch section {
+			case "Interface":
+				cfg = &WGConfig{}
+				cfg.Interface.MTU = defaultMTU
+				cfg.Interface.Name = fmt.Sprintf("wg%d", len(cfgs))
+				cfgs = append(cfgs, cfg)
+			case "Peer":
+				if cfg == nil {
+					p.errorf(lineNo, "[Peer] before any [Interface]")
+				}
+				peer = &WGPeer{}
+			case "Split":
+			case "Proxy":
+				if proxy != nil {
+					p.errorf(lineNo, "duplicate [Proxy] section")
+				}
+				proxy = &ProxyConfig{}
+			default:
+				p.errorf(lineNo, "unknown section [%s]", section)
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			p.errorf(lineNo, "expected Key = Value, got %q", line)
+			continue
+		}
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+
+		switch section {
+		case "":
+			p.errorf(lineNo, "%s outside of any section", key)
+		case "Interface":
+			p.interfaceKey(&cfg.Interface, lineNo, key, value)
+		case "Peer":
+			p.peerKey(peer, lineNo, key, value)
+		case "Split":
+			p.splitKey(&split, lineNo, key, value)
+		case "Proxy":
+			p.proxyKey(proxy, lineNo, key, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p.file, err)
+	}
+	finishSection()
+
+	if len(cfgs) == 0 {
+		p.errorf(lineNo, "missing [Interface] section")
+	}
+	names := make(map[string]bool, len(cfgs))
+	for _, c := range cfgs {
+		if names[c.Interface.Name] {
+			p.errorf(lineNo, "duplicate tunnel Name %q", c.Interface.Name)
+		}
+		names[c.Interface.Name] = true
+	}
+
+	if len(p.errs) > 0 {
+		for _, c := range cfgs {
+			c.Wipe()
+		}
+		proxy.Wipe()
+		return nil, errors.Join(p.errs...)
+	}
+	return &ConfigFile{Tunnels: cfgs, Split: split, Proxy: proxy}, nil
+}
+
+// proxyKey applies one [Proxy] line.
+func (p *configParser) proxyKey(proxy *ProxyConfig, line int, key, value string) {
+	switch strings.ToLower(key) {
+	case "address":
+		if !p.once(line, "Address") {
+			return
+		}
+		host, port, err := net.SplitHostPort(value)
+		if err != nil || host == "" {
+			p.errorf(line, "invalid Address %q: want host:port or [v6]:port", value)
+			return
+		}
+		if _, err := parseRangedInt(port, 1, 65535); err != nil {
+			p.errorf(line, "invalid Address port %q: %v", port, err)
+			return
+		}
+		proxy.Address = value
+
+	case "username":
+		if !p.once(line, "Username") {
+			return
+		}
+		if len(value) > 255 {
+			p.errorf(line, "Username longer than 255 bytes")
+			return
+		}
+		proxy.Username = value
+
+	case "password":
+		if !p.once(line, "Password") {
+			return
+		}
+		if len(value) > 255 {
+			p.errorf(line, "Password longer than 255 bytes")
+			return
+		}
+		proxy.Password = []byte(value)
+
+	default:
+		p.errorf(line, "unknown [Proxy] key %q", key)
+	}
+}
+
+// ParsePeer parses a single [Peer] section given on its own, with or without
+// the section header, as KlinikalAddPeer receives it.
+func ParsePeer(name string, data []byte) (*WGPeer, error) {
+	p := &configParser{file: filepath.Base(name), seen: map[string]int{}}
+	peer := &WGPeer{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if line != "[Peer]" || len(p.seen) > 0 {
+				p.errorf(lineNo, "expected a single [Peer] section, got %q", line)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			p.errorf(lineNo, "expected Key = Value, got %q", line)
+			continue
+		}
+		p.peerKey(peer, lineNo, strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", p.file, err)
+	}
+	if _, ok := p.seen["PublicKey"]; !ok {
+		p.errorf(lineNo, "[Peer] is missing PublicKey")
+	}
+	if len(p.errs) > 0 {
+		wipe(peer.PresharedKey[:])
+		return nil, errors.Join(p.errs...)
+	}
+	return peer, nil
+}
+
+// interfaceKey applies one [Interface] line.
+func (p *configParser) interfaceKey(ifc *WGInterface, line int, key, value string) {
+	switch strings.ToLower(key) {
+	case "name":
+		// KLINIKAL extension: names the tunnel when a file holds several
+		if !p.once(line, "Name") {
+			return
+		}
+		if !isDNSName(value) || strings.Contains(value, ".") {
+			p.errorf(line, "invalid Name %q", value)
+			return
+		}
+		ifc.Name = value
+
+	case "privatekey":
+		if !p.once(line, "PrivateKey") {
+			return
+		}
+		k, err := parseKey(value)
+		if err != nil {
+			p.errorf(line, "invalid PrivateKey: %v", err)
+			return
+		}
+		ifc.PrivateKey = k
+
+	case "address":
+		for _, item := range splitList(value) {
+			prefix, err := parsePrefix(item)
+			if err != nil {
+				p.errorf(line, "invalid Address %q", item)
+				continue
+			}
+			ifc.Addresses = append(ifc.Addresses, prefix)
+		}
+
+	case "dns":
+		// wg-quick treats non-IP entries as search domains
+		for _, item := range splitList(value) {
+			if ip, err := netip.ParseAddr(item); err == nil {
+				ifc.DNS = append(ifc.DNS, ip.Unmap())
+			} else if isDNSName(item) {
+				ifc.DNSSearch = append(ifc.DNSSearch, strings.TrimSuffix(item, "."))
+			} else {
+				p.errorf(line, "invalid DNS entry %q", item)
+			}
+		}
+
+	case "mtu":
+		if !p.once(line, "MTU") {
+			return
+		}
+		n, err := parseRangedInt(value, 576, 65535)
+		if err != nil {
+			p.errorf(line, "invalid MTU %q: %v", value, err)
+			return
+		}
+		ifc.MTU = n
+
+	case "listenport":
+		if !p.once(line, "ListenPort") {
+			return
+		}
+		n, err := parseRangedInt(value, 0, 65535)
+		if err != nil {
+			p.errorf(line, "invalid ListenPort %q: %v", value, err)
+			return
+		}
+		ifc.ListenPort = n
+
+	case "fwmark":
+		if !p.once(line, "FwMark") {
+			return
+		}
+		if value == "off" {
+			return
+		}
+		n, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			p.errorf(line, "invalid FwMark %q", value)
+			return
+		}
+		ifc.FwMark = uint32(n)
+
+	case "uapi":
+		// KLINIKAL extension: expose the device to the wg tool (uapi.go)
+		if !p.once(line, "UAPI") {
+			return
+		}
+		access := ifc.UAPI.Access
+		ifc.UAPI = parseUAPIValue(value)
+		ifc.UAPI.Access = access
+
+	case "uapiaccess":
+		if !p.once(line, "UAPIAccess") {
+			return
+		}
+		if err := checkUAPIAccess(value); err != nil {
+			p.errorf(line, "invalid UAPIAccess %q: %v", value, err)
+			return
+		}
+		ifc.UAPI.Access = value
+
+	// AmneziaWG obfuscation (obfuscation.go)
+	case "jc":
+		p.obfuscationInt(line, "Jc", value, obfMaxJunkCount, &ifc.Obfuscation.Jc)
+	case "jmin":
+		p.obfuscationInt(line, "Jmin", value, obfMaxJunkSize, &ifc.Obfuscation.Jmin)
+	case "jmax":
+		p.obfuscationInt(line, "Jmax", value, obfMaxJunkSize, &ifc.Obfuscation.Jmax)
+	case "s1":
+		p.obfuscationInt(line, "S1", value, obfMaxS1, &ifc.Obfuscation.S1)
+	case "s2":
+		p.obfuscationInt(line, "S2", value, obfMaxS2, &ifc.Obfuscation.S2)
+
+	case "h1", "h2", "h3", "h4":
+		name := strings.ToUpper(key)
+		if !p.once(line, name) {
+			return
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || n == 0 {
+			p.errorf(line, "invalid %s %q: want 1-4294967295", name, value)
+			return
+		}
+		ifc.Obfuscation.H[name[1]-'1'] = uint32(n)
+
+	case "table", "saveconfig", "preup", "postup", "predown", "postdown":
+		// Host routing/hook keys have no meaning for an in-process stack
+		LogCall("ConfigIgnored", key, line)
+
+	default:
+		p.errorf(line, "unknown [Interface] key %q", key)
+	}
+}
+
+// obfuscationInt parses an obfuscation count or size of up to max into dst.
+func (p *configParser) obfuscationInt(line int, name, value string, max int, dst *int) {
+	if !p.once(line, name) {
+		return
+	}
+	n, err := parseRangedInt(value, 0, max)
+	if err != nil {
+		p.errorf(line, "invalid %s %q: %v", name, value, err)
+		return
+	}
+	*dst = n
+}
+
+// peerKey applies one [Peer] line.
+func (p *configParser) peerKey(peer *WGPeer, line int, key, value string) {
+	switch strings.ToLower(key) {
+	case "publickey":
+		if !p.once(line, "PublicKey") {
+			return
+		}
+		k, err := parseKey(value)
+		if err != nil {
+			p.errorf(line, "invalid PublicKey: %v", err)
+			return
+		}
+		peer.PublicKey = k
+
+	case "presharedkey":
+		if !p.once(line, "PresharedKey") {
+			return
+		}
+		k, err := parseKey(value)
+		if err != nil {
+			p.errorf(line, "invalid PresharedKey: %v", err)
+			return
+		}
+		peer.PresharedKey = k
+		peer.HasPresharedKey = true
+
+	case "allowedips":
+		for _, item := range splitList(value) {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				p.errorf(line, "invalid AllowedIPs entry %q", item)
+				continue
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix.Masked())
+		}
+
+	case "endpoint":
+		if !p.once(line, "Endpoint") {
+			return
+		}
+		host, port, err := net.SplitHostPort(value)
+		if err != nil || host == "" {
+			p.errorf(line, "invalid Endpoint %q: want host:port or [v6]:port", value)
+			return
+		}
+		if _, err := parseRangedInt(port, 1, 65535); err != nil {
+			p.errorf(line, "invalid Endpoint port %q: %v", port, err)
+			return
+		}
+		peer.Endpoint = value
+
+	case "persistentkeepalive":
+		if !p.once(line, "PersistentKeepalive") {
+			return
+		}
+		if value == "off" {
+			return
+		}
+		n, err := parseRangedInt(value, 0, 65535)
+		if err != nil {
+			p.errorf(line, "invalid PersistentKeepalive %q: %v", value, err)
+			return
+		}
+		peer.PersistentKeepalive = n
+
+	case "transport":
+		// KLINIKAL extension: WireGuard over a framed TCP stream (tcp_bind.go)
+		if !p.once(line, "Transport") {
+			return
+		}
+		switch t := strings.ToLower(value); t {
+		case "udp", "tcp":
+			peer.Transport = t
+		default:
+			p.errorf(line, "invalid Transport %q: want udp or tcp", value)
+		}
+
+	default:
+		p.errorf(line, "unknown [Peer] key %q", key)
+	}
+}
+
+// splitKey applies one [Split] line. Exclude and Include may repeat and take
+// comma-separated prefixes or bare addresses.
+func (p *configParser) splitKey(split *SplitRules, line int, key, value string) {
+	var list *[]netip.Prefix
+	switch strings.ToLower(key) {
+	case "exclude":
+		list = &split.Exclude
+	case "include":
+		list = &split.Include
+	default:
+		p.errorf(line, "unknown [Split] key %q", key)
+		return
+	}
+	for _, item := range splitList(value) {
+		prefix, err := parsePrefix(item)
+		if err != nil {
+			p.errorf(line, "invalid %s entry %q", key, item)
+			continue
+		}
+		*list = append(*list, prefix.Masked())
+	}
+}
+
+// isDNSName reports whether s looks like a hostname usable as a search domain.
+func isDNSName(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LocalAddrs returns the interface addresses without their prefix lengths, as
+// netstack.CreateNetTUN expects.
+func (c *WGConfig) LocalAddrs() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(c.Interface.Addresses))
+	for _, p := range c.Interface.Addresses {
+		addrs = append(addrs, p.Addr())
+	}
+	return addrs
+}
+
+// Wipe zeroes the private and preshared keys held by the configuration.
+func (c *WGConfig) Wipe() {
+	wipe(c.Interface.PrivateKey[:])
+	for i := range c.Peers {
+		wipe(c.Peers[i].PresharedKey[:])
+	}
+}
+
+// Routes returns the union of the peers' AllowedIPs, i.e. the destinations
+// this tunnel carries. Peers without AllowedIPs route everything.
+func (c *WGConfig) Routes() []netip.Prefix {
+	var routes []netip.Prefix
+	for _, peer := range c.Peers {
+		if len(peer.AllowedIPs) == 0 {
+			routes = append(routes, netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0"))
+			continue
+		}
+		routes = append(routes, peer.AllowedIPs...)
+	}
+	return routes
+}
+
+// ResolveEndpoints resolves every peer Endpoint now, so that rendering UAPI
+// bodies later does no DNS lookups. Reloads and control calls run it before
+// taking the stack lock.
+func (c *WGConfig) ResolveEndpoints() {
+	for i := range c.Peers {
+		if c.Peers[i].Endpoint != "" {
+			c.Peers[i].lookupEndpoint()
+		}
+	}
+}
+
+// lookupEndpoint resolves the peer Endpoint unless that was done already.
+func (peer *WGPeer) lookupEndpoint() *endpointLookup {
+	if peer.resolved == nil {
+		addr, err := resolveEndpoint(peer.Endpoint)
+		peer.resolved = &endpointLookup{addr: addr, err: err}
+	}
+	return peer.resolved
+}
+
+// IpcRequest renders the configuration as a UAPI set=1 body. Peer endpoints
+// are resolved here unless ResolveEndpoints did it already; a name that does
+// not resolve yet is left out and picked up by the tunnel's endpoint resolver.
+// The body contains secret keys: the caller wipes it once the device has
+// consumed it.
+func (c *WGConfig) IpcRequest() ([]byte, error) {
+	var request secretBuffer
+	c.Interface.PrivateKey.writeUAPI(&request, "private_key")
+	if c.Interface.ListenPort != 0 {
+		fmt.Fprintf(&request, "listen_port=%d\n", c.Interface.ListenPort)
+	}
+	if c.Interface.FwMark != 0 {
+		fmt.Fprintf(&request, "fwmark=%d\n", c.Interface.FwMark)
+	}
+	request.WriteString("replace_peers=true\n")
+
+	for i := range c.Peers {
+		peer := &c.Peers[i]
+		peer.PublicKey.writeUAPI(&request, "public_key")
+		if peer.HasPresharedKey {
+			peer.PresharedKey.writeUAPI(&request, "preshared_key")
+		}
+
+		if err := peer.writeEndpointUAPI(&request); err != nil {
+			wipe(request.Bytes())
+			return nil, err
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(&request, "persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+		}
+		peer.writeAllowedIPsUAPI(&request)
+	}
+
+	return request.Bytes(), nil
+}
+
+// writeEndpointUAPI resolves the peer Endpoint, if ResolveEndpoints has not,
+// and writes its endpoint= line. A hostname that does not resolve is logged
+// and skipped, since the endpoint resolver keeps retrying it; a malformed
+// Endpoint is an error.
+func (peer *WGPeer) writeEndpointUAPI(b *secretBuffer) error {
+	if peer.Endpoint == "" {
+		return nil
+	}
+	lookup := peer.lookupEndpoint()
+	resolvedEndpoint, err := lookup.addr, lookup.err
+	if err != nil && isHostnameEndpoint(peer.Endpoint) {
+		LogNotice("peer %s: cannot resolve Endpoint %q: %v (will retry)", peer.PublicKey.Hex()[:8], peer.Endpoint, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("peer %s: invalid Endpoint %q: %w", peer.PublicKey.Hex()[:8], peer.Endpoint, err)
+	}
+	fmt.Fprintf(b, "endpoint=%s\n", uapiEndpoint(peer.Transport, resolvedEndpoint))
+	return nil
+}
+
+// writeAllowedIPsUAPI replaces the peer's allowed IPs, defaulting to the full
+// v4 and v6 ranges when the config lists none.
+func (peer *WGPeer) writeAllowedIPsUAPI(b *secretBuffer) {
+	b.WriteString("replace_allowed_ips=true\n")
+	if len(peer.AllowedIPs) == 0 {
+		b.WriteString("allowed_ip=0.0.0.0/0\n")
+		b.WriteString("allowed_ip=::/0\n")
+		return
+	}
+	for _, prefix := range peer.AllowedIPs {
+		fmt.Fprintf(b, "allowed_ip=%s\n", prefix)
+	}
+}